@@ -6,10 +6,12 @@ require (
 	github.com/gin-gonic/gin v1.6.2
 	github.com/go-resty/resty/v2 v2.2.0
 	github.com/golang/protobuf v1.3.5
+	github.com/klauspost/cpuid v1.3.1 // indirect
+	github.com/klauspost/reedsolomon v1.9.3
 	github.com/minio/minio-go/v6 v6.0.52
 	github.com/sirupsen/logrus v1.5.0
 	github.com/stretchr/testify v1.4.0
 	go.mongodb.org/mongo-driver v1.3.2
-	golang.org/x/crypto v0.0.0-20191205180655-e7c4368fe9dd // indirect
+	golang.org/x/crypto v0.0.0-20191205180655-e7c4368fe9dd
 	google.golang.org/grpc v1.28.1
 )
@@ -11,6 +11,8 @@ export function getFiles(params) {
 
 export function upload(item) {
   var form_data = new FormData()
+  // size must precede file, the server streams the file part
+  form_data.append('size', item.file.size)
   form_data.append('file', item.file)
   return request({
     url: '/storage/upload',
@@ -27,14 +29,116 @@ export function upload(item) {
   })
 }
 
+export function createUpload(data) {
+  return request({
+    url: '/storage/uploads',
+    method: 'post',
+    data
+  })
+}
+
+export function getUploads() {
+  return request({
+    url: '/storage/uploads',
+    method: 'get'
+  })
+}
+
+export function getUpload(id) {
+  return request({
+    url: '/storage/uploads/' + id,
+    method: 'get'
+  })
+}
+
+export function putUploadChunk(id, offset, chunk) {
+  return request({
+    url: '/storage/uploads/' + id,
+    method: 'put',
+    params: { offset },
+    headers: {
+      'Content-Type': 'application/octet-stream'
+    },
+    timeout: 0,
+    data: chunk
+  })
+}
+
+export function completeUpload(id) {
+  return request({
+    url: '/storage/uploads/' + id + '/complete',
+    method: 'post',
+    timeout: 0
+  })
+}
+
+export function abortUpload(id) {
+  return request({
+    url: '/storage/uploads/' + id,
+    method: 'delete'
+  })
+}
+
+// resumableUpload uploads a file in chunks, resuming an unfinished upload of
+// the same file and retrying failed chunks from the offset the server is at.
+export async function resumableUpload(item, retries = 3) {
+  const file = item.file
+  const uploads = (await getUploads()).data.items
+  let session = uploads.find(u => u.filename === file.name && u.size === file.size)
+  if (!session) {
+    session = (await createUpload({ filename: file.name, size: file.size })).data
+  }
+
+  let failures = 0
+  while (session.offset < session.size) {
+    const end = Math.min(session.offset + session.chunk_size, session.size)
+    try {
+      session = (await putUploadChunk(session.id, session.offset, file.slice(session.offset, end))).data
+      failures = 0
+    } catch (error) {
+      if (++failures > retries) {
+        throw error
+      }
+      session = (await getUpload(session.id)).data
+    }
+    item.onProgress({ percent: session.offset / session.size * 100 | 0 })
+  }
+
+  return completeUpload(session.id)
+}
+
 export function deleteFile(filename) {
   return request({
-    url: '/storage/delete/' + filename,
+    url: '/storage/delete/' + filename.split('/').map(encodeURIComponent).join('/'),
     method: 'delete'
   })
 }
 
+export function createDir(path) {
+  return request({
+    url: '/storage/dirs',
+    method: 'post',
+    data: { path }
+  })
+}
+
+export function deleteDir(path, recursive) {
+  return request({
+    url: '/storage/dirs',
+    method: 'delete',
+    params: { path, recursive }
+  })
+}
+
+export function move(from, to) {
+  return request({
+    url: '/storage/move',
+    method: 'post',
+    data: { from, to }
+  })
+}
+
 export function genDownloadLink(filename) {
   // TODO: insecure, should use temporary token
-  return process.env.VUE_APP_BASE_API + '/storage/download?filename=' + filename + '&t=' + getToken()
+  return process.env.VUE_APP_BASE_API + '/storage/download?filename=' + encodeURIComponent(filename) + '&t=' + getToken()
 }
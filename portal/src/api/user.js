@@ -27,17 +27,55 @@ export function logout() {
   })
 }
 
-export function setStrategy(pref) {
+export function setStrategy(pref, migrate) {
   return request({
     url: '/user/strategy',
     method: 'post',
+    params: { migrate },
     data: pref
   })
 }
 
+export function getMigration() {
+  return request({
+    url: '/user/strategy/migration',
+    method: 'get'
+  })
+}
+
 export function getStrategy() {
   return request({
     url: '/user/strategy',
     method: 'get'
   })
 }
+
+export function changePassword(data) {
+  return request({
+    url: '/user/password',
+    method: 'post',
+    data
+  })
+}
+
+export function resetPassword(data) {
+  return request({
+    url: '/user/password/reset',
+    method: 'post',
+    data
+  })
+}
+
+export function getKeys() {
+  return request({
+    url: '/user/keys',
+    method: 'get'
+  })
+}
+
+export function createKeys() {
+  return request({
+    url: '/user/keys',
+    method: 'post'
+  })
+}
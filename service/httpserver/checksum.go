@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	log "github.com/sirupsen/logrus"
+)
+
+// errChecksumMismatch is returned if the content read back from the sites
+// does not match the checksum recorded for the file.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// contentHash computes the checksums recorded for a file.
+type contentHash struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+func newContentHash() *contentHash {
+	return &contentHash{
+		sha256: sha256.New(),
+		md5:    md5.New(),
+	}
+}
+
+func (h *contentHash) Write(p []byte) (int, error) {
+	h.sha256.Write(p)
+	h.md5.Write(p)
+	return len(p), nil
+}
+
+// sum sets the checksums of file.
+func (h *contentHash) sum(file *dao.File) {
+	file.SHA256 = hex.EncodeToString(h.sha256.Sum(nil))
+	file.MD5 = hex.EncodeToString(h.md5.Sum(nil))
+}
+
+// save saves the hash states in session, so that hashing goes on with the
+// next chunk.
+func (h *contentHash) save(session *dao.UploadSession) error {
+	var err error
+	session.SHA256State, err = h.sha256.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	session.MD5State, err = h.md5.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// sessionHash returns the hash of the content session has received so far.
+func sessionHash(session *dao.UploadSession) (*contentHash, error) {
+	h := newContentHash()
+	if session.SHA256State == nil {
+		return h, nil
+	}
+
+	err := h.sha256.(encoding.BinaryUnmarshaler).UnmarshalBinary(session.SHA256State)
+	if err != nil {
+		return nil, err
+	}
+	err = h.md5.(encoding.BinaryUnmarshaler).UnmarshalBinary(session.MD5State)
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// checksumFile reads a file stored without checksums, such as one made up
+// of the parts of a multipart upload, and records its checksums. A file
+// replaced in the meantime is left alone.
+func checksumFile(username string, file dao.File) {
+	r, servedBy, err := openFile(username, &file, 0)
+	if err != nil {
+		log.WithError(err).Errorf("open %v of %v for its checksums", file.Filename, username)
+		return
+	}
+	defer r.Close()
+
+	h := newContentHash()
+	n, err := io.Copy(h, r)
+	if err == nil && n != file.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		log.WithError(err).Errorf("read %v of %v from %v for its checksums", file.Filename, username, servedBy)
+		return
+	}
+
+	h.sum(&file)
+	err = d.SetFileChecksums(username, file)
+	if err != nil && err != dao.ErrFileChanged {
+		log.WithError(err).Errorf("record checksums of %v of %v", file.Filename, username)
+	}
+}
+
+// digest returns the Digest header value of file, or "" if its checksum is
+// unknown.
+func digest(file *dao.File) string {
+	sum, err := hex.DecodeString(file.SHA256)
+	if err != nil || len(sum) == 0 {
+		return ""
+	}
+
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// verifyReader checks the content of a file against its SHA-256 checksum
+// once all of it is read. The last bytes are checked before they are served,
+// on a mismatch the last read returns nothing but the error, so that the
+// file is never served complete. The sites that served the content are
+// reported as failed.
+type verifyReader struct {
+	io.ReadCloser
+	file     *dao.File
+	servedBy string
+	hash     hash.Hash
+	// read is the number of bytes served, all of which are hashed.
+	read int64
+
+	// username, if set, owns file and the sites of a replicated file that
+	// fail the check are queued for repair.
+	username string
+	// reopen, if set, opens the file from the start on another copy, it
+	// fails once there is none left.
+	reopen func() (io.ReadCloser, string, error)
+}
+
+// verifyFile returns r, which reads file from the start, checking its
+// checksum if it is known.
+func verifyFile(r io.ReadCloser, file *dao.File, servedBy string) io.ReadCloser {
+	if file.SHA256 == "" {
+		return r
+	}
+
+	return &verifyReader{
+		ReadCloser: r,
+		file:       file,
+		servedBy:   servedBy,
+		hash:       sha256.New(),
+	}
+}
+
+func (r *verifyReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.ReadCloser.Read(p)
+
+		// Readers of a known size stop at the end rather than wait for
+		// EOF, a site may also end early or serve more than the file holds.
+		end := r.read+int64(n) >= r.file.Size || err == io.EOF
+		if !end || r.matches(p[:n]) {
+			r.hash.Write(p[:n])
+			r.read += int64(n)
+			return n, err
+		}
+
+		r.mismatch(r.read + int64(n))
+		if !r.retry() {
+			return 0, errChecksumMismatch
+		}
+	}
+}
+
+// matches reports whether the content served so far followed by last is
+// the whole file.
+func (r *verifyReader) matches(last []byte) bool {
+	if r.read+int64(len(last)) != r.file.Size {
+		return false
+	}
+
+	state, err := r.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return false
+	}
+	h := sha256.New()
+	if h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state) != nil {
+		return false
+	}
+	h.Write(last)
+
+	return hex.EncodeToString(h.Sum(nil)) == r.file.SHA256
+}
+
+// mismatch reports the sites that served a file of read bytes not matching
+// its checksum.
+func (r *verifyReader) mismatch(read int64) {
+	log.Errorf("%v from %v does not match its checksum after %v of %v bytes", r.file.Filename, r.servedBy, read, r.file.Size)
+	for _, site := range strings.Split(r.servedBy, ",") {
+		registry.observe(site, 0, errChecksumMismatch)
+		if r.username != "" && r.file.Erasure == nil {
+			repairs.suspect(r.username, r.file.Filename, site)
+		}
+	}
+}
+
+// retry goes on reading from another copy that has the same content as
+// served so far, it returns false if there is none.
+func (r *verifyReader) retry() bool {
+	if r.reopen == nil {
+		return false
+	}
+	served := r.hash.Sum(nil)
+
+	for {
+		body, servedBy, err := r.reopen()
+		if err != nil {
+			return false
+		}
+
+		h := sha256.New()
+		_, err = io.CopyN(h, body, r.read)
+		if err == nil && bytes.Equal(h.Sum(nil), served) {
+			log.Warnf("read %v from %v after a mismatch on %v at %v", r.file.Filename, servedBy, r.servedBy, r.read)
+			r.ReadCloser.Close()
+			r.ReadCloser = body
+			r.servedBy = servedBy
+			return true
+		}
+		body.Close()
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyReader(t *testing.T) {
+	registry = newSiteRegistry(nil)
+	content := "hello, world"
+	sum := sha256.Sum256([]byte(content))
+	file := &dao.File{
+		Filename: "hello.txt",
+		Size:     int64(len(content)),
+		SHA256:   hex.EncodeToString(sum[:]),
+	}
+
+	tests := []struct {
+		name    string
+		served  string
+		wantErr bool
+	}{
+		{"intact", content, false},
+		{"corrupt", "hello, World", true},
+		{"short", content[:5], true},
+		{"empty", "", true},
+		{"long", content + "!", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := verifyFile(ioutil.NopCloser(strings.NewReader(tt.served)), file, "site")
+			got, err := ioutil.ReadAll(r)
+			if tt.wantErr {
+				require.Equal(t, errChecksumMismatch, err)
+				require.NotEqual(t, content, string(got))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, content, string(got))
+		})
+	}
+}
+
+func TestVerifyReaderRetry(t *testing.T) {
+	sites, cleanup := newTestSites(t, 2)
+	defer cleanup()
+
+	content := testContent(100000)
+	sum := sha256.Sum256(content)
+	file := &dao.File{
+		Filename: "f",
+		Size:     int64(len(content)),
+		SHA256:   hex.EncodeToString(sum[:]),
+		Sites:    siteNames(sites),
+	}
+	// corrupt returns content with the byte at i flipped.
+	corrupt := func(i int) []byte {
+		c := append([]byte(nil), content...)
+		c[i] ^= 0xff
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		objects [][]byte
+		wantErr bool
+		// suspect is whether the first site is queued for repair.
+		suspect bool
+	}{
+		{"intact", [][]byte{content, content}, false, false},
+		{"end corrupt", [][]byte{corrupt(len(content) - 1), content}, false, true},
+		// The replica reader fails over from a short copy by itself.
+		{"short", [][]byte{content[:len(content)-1], content}, false, false},
+		{"served part corrupt", [][]byte{corrupt(10), content}, true, true},
+		{"all corrupt", [][]byte{corrupt(len(content) - 1), corrupt(len(content) - 1)}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetRegistry(sites)
+			repairs.cleared("u", "f", file.Sites)
+			for i, s := range sites {
+				s.setObject("u/f", tt.objects[i])
+			}
+
+			r, servedBy, err := openFile("u", file, 0)
+			require.NoError(t, err)
+			require.Equal(t, sites[0].name, servedBy)
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if tt.wantErr {
+				require.Equal(t, errChecksumMismatch, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, content, got)
+			}
+
+			require.Equal(t, tt.suspect, repairs.isSuspect("u", "f", sites[0].name))
+			if tt.suspect && bytes.Equal(tt.objects[1], content) {
+				// The site that served bad content ranks last, unless
+				// the other one has served bad content as well.
+				require.Equal(t, sites[0].name, registry.rank(file.Sites)[1])
+			}
+		})
+	}
+}
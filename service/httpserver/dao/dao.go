@@ -2,13 +2,31 @@ package dao
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
+	"strings"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrWrongPassword is returned if a password does not match.
+	ErrWrongPassword = errors.New("wrong password")
+	// ErrUserExists is returned if a user is created under a taken name.
+	ErrUserExists = errors.New("user exists")
+	// ErrFileNotFound is returned if a file does not exist.
+	ErrFileNotFound = errors.New("file not found")
+	// ErrFileExists is returned if a file is moved onto another file.
+	ErrFileExists = errors.New("file exists")
+	// ErrFileChanged is returned if a file has been replaced or removed
+	// since it was read.
+	ErrFileChanged = errors.New("file changed")
 )
 
 // Dao encapsulates database operations.
@@ -16,14 +34,26 @@ type Dao struct {
 	client     *mongo.Client
 	database   string
 	collection string
+	// migrated holds the names of the users whose files are all in the
+	// file collection.
+	migrated sync.Map
 }
 
 type User struct {
 	Username string
 	Password string
 	Role     string
-	Strategy Strategy
-	Files    []File
+	// Disabled users can neither log in nor use their S3 credentials.
+	Disabled bool `bson:",omitempty"`
+	// AccessKey and SecretKey are the credentials of the S3 API.
+	AccessKey string `bson:",omitempty"`
+	SecretKey string `bson:",omitempty"`
+	Strategy  Strategy
+	// Quota, if set, takes the place of the quota of the role.
+	Quota *Quota `bson:",omitempty"`
+	// Files are the files of users from before files had a collection of
+	// their own, they are moved there when accessed.
+	Files []File `bson:",omitempty"`
 }
 
 type File struct {
@@ -31,10 +61,140 @@ type File struct {
 	Size         int64    `json:"size"`
 	LastModified int64    `json:"last_modified"`
 	Sites        []string `json:"sites"`
+	// Object is the name of the object storing the file on its sites.
+	Object string `json:"-" bson:",omitempty"`
+	// Erasure is set if the file is erasure coded rather than replicated.
+	Erasure *Erasure `json:"erasure,omitempty" bson:",omitempty"`
+	// SHA256 and MD5 are hex digests of the content, they are empty for
+	// files stored before checksums were recorded.
+	SHA256 string `json:"sha256,omitempty" bson:",omitempty"`
+	MD5    string `json:"md5,omitempty" bson:",omitempty"`
+}
+
+// Erasure describes how an erasure-coded file is laid out. The file is cut
+// into stripes of DataShards blocks of BlockSize bytes, each stripe gets
+// ParityShards parity blocks, and shard i is the concatenation of the i-th
+// block of every stripe.
+type Erasure struct {
+	DataShards   int   `json:"data_shards"`
+	ParityShards int   `json:"parity_shards"`
+	BlockSize    int64 `json:"block_size"`
+	// Shards holds the site of each shard, or "" if the shard is lost.
+	Shards []string `json:"shards"`
 }
 
+// StrategyVersion is the version of the strategy model. Strategies of
+// version 0 were saved before it was versioned and only use Sites, Name,
+// Replicas and the erasure-coding parameters.
+const StrategyVersion = 1
+
+// Strategy is the placement policy of a user.
 type Strategy struct {
-	Sites []string `json:"sites"`
+	Version int      `json:"version"`
+	Sites   []string `json:"sites"`
+	// Name is the scheduler strategy, e.g. replicate-all or cheapest.
+	Name string `json:"name"`
+	// Replicas is the number of copies for strategies that need one.
+	Replicas int `json:"replicas"`
+	// DataShards and ParityShards select erasure coding if DataShards is
+	// positive, otherwise files are replicated to all sites.
+	DataShards   int `json:"data_shards"`
+	ParityShards int `json:"parity_shards"`
+	// Regions, if not empty, are the regions all sites must be in.
+	Regions []string `json:"regions"`
+	// ForbiddenRegions are the regions no site may be in.
+	ForbiddenRegions []string `json:"forbidden_regions"`
+	// MaxCostPerGB, if positive, is the highest monthly price per GB of the
+	// sites files are placed on.
+	MaxCostPerGB float64 `json:"max_cost_per_gb"`
+	// MaxLatency, if positive, is the highest latency in milliseconds of the
+	// sites files are placed on.
+	MaxLatency int64 `json:"max_latency"`
+	// Overrides change the placement of some files, the first one matching
+	// a file applies.
+	Overrides []Override `json:"overrides"`
+}
+
+// Override is a placement for the files under a path or of a size. Fields
+// left zero are taken from the strategy.
+type Override struct {
+	// Prefix, if not empty, matches the files whose names start with it.
+	Prefix string `json:"prefix"`
+	// MinSize and MaxSize, if positive, match the files of known size that
+	// are at least or at most as large.
+	MinSize int64 `json:"min_size"`
+	MaxSize int64 `json:"max_size"`
+
+	Sites        []string `json:"sites"`
+	Name         string   `json:"name"`
+	Replicas     int      `json:"replicas"`
+	DataShards   int      `json:"data_shards"`
+	ParityShards int      `json:"parity_shards"`
+	MaxCostPerGB float64  `json:"max_cost_per_gb"`
+	MaxLatency   int64    `json:"max_latency"`
+}
+
+// Matches reports whether the override applies to a file of given name and
+// size, size is -1 if unknown.
+func (o *Override) Matches(filename string, size int64) bool {
+	if !strings.HasPrefix(filename, o.Prefix) {
+		return false
+	}
+	if o.MinSize > 0 && (size < 0 || size < o.MinSize) {
+		return false
+	}
+	if o.MaxSize > 0 && (size < 0 || size > o.MaxSize) {
+		return false
+	}
+
+	return true
+}
+
+// ForFile returns the strategy a file of given name and size is placed by,
+// with the first matching override applied. size is -1 if unknown.
+func (s *Strategy) ForFile(filename string, size int64) *Strategy {
+	for _, o := range s.Overrides {
+		if o.Matches(filename, size) {
+			return s.With(o)
+		}
+	}
+
+	resolved := *s
+	resolved.Overrides = nil
+	return &resolved
+}
+
+// With returns the strategy with override o applied.
+func (s *Strategy) With(o Override) *Strategy {
+	resolved := *s
+	resolved.Overrides = nil
+
+	if len(o.Sites) > 0 {
+		resolved.Sites = o.Sites
+	}
+	if o.Name != "" {
+		resolved.Name = o.Name
+	}
+	// An override with replicas replicates, one with data shards
+	// erasure-codes, whatever the strategy does.
+	if o.Replicas > 0 {
+		resolved.Replicas = o.Replicas
+		resolved.DataShards = 0
+		resolved.ParityShards = 0
+	}
+	if o.DataShards > 0 {
+		resolved.Replicas = 0
+		resolved.DataShards = o.DataShards
+		resolved.ParityShards = o.ParityShards
+	}
+	if o.MaxCostPerGB > 0 {
+		resolved.MaxCostPerGB = o.MaxCostPerGB
+	}
+	if o.MaxLatency > 0 {
+		resolved.MaxLatency = o.MaxLatency
+	}
+
+	return &resolved
 }
 
 // NewDao constructs a data access object (Dao).
@@ -49,14 +209,15 @@ func NewDao(mongoURI, database, collection string) (*Dao, error) {
 		return nil, err
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
 	err = client.Ping(ctx, readpref.Primary())
 	if err != nil {
 		return nil, err
 	}
 
 	dao.client = client
-	err = dao.ensureIndex("username", true)
+	err = dao.ensureIndexes()
 	if err != nil {
 		return nil, err
 	}
@@ -64,8 +225,106 @@ func NewDao(mongoURI, database, collection string) (*Dao, error) {
 	return dao, nil
 }
 
+func (d *Dao) ensureIndexes() error {
+	err := d.ensureIndex("username", true)
+	if err != nil {
+		return err
+	}
+
+	// Users without keys have no accesskey field, a sparse index skips them.
+	err = d.createIndex(d.collection, mongo.IndexModel{
+		Keys: bson.M{
+			"accesskey": 1,
+		},
+		Options: options.Index().SetUnique(true).SetSparse(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = d.createIndex(fileCollection, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "username", Value: 1},
+			{Key: "filename", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Listings sort by size and modification time as well as by name.
+	for _, field := range []string{"size", "lastmodified"} {
+		err = d.createIndex(fileCollection, mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "username", Value: 1},
+				{Key: field, Value: 1},
+				{Key: "filename", Value: 1},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = d.createIndex(roleCollection, mongo.IndexModel{
+		Keys: bson.M{
+			"role": 1,
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = d.createIndex(dirCollection, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "username", Value: 1},
+			{Key: "path", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = d.createIndex(reservationCollection, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "username", Value: 1},
+			{Key: "id", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	// Reservations of uploads that have gone away are dropped by mongodb.
+	err = d.createIndex(reservationCollection, mongo.IndexModel{
+		Keys: bson.M{
+			"expires": 1,
+		},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, collection := range []string{uploadCollection, sessionCollection} {
+		err = d.createIndex(collection, mongo.IndexModel{
+			Keys: bson.M{
+				"id": 1,
+			},
+			Options: options.Index().SetUnique(true),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (d *Dao) ensureIndex(index string, unique bool) error {
-	col := d.client.Database(d.database).Collection(d.collection)
 	idx := mongo.IndexModel{
 		Keys: bson.M{
 			index: 1,
@@ -75,6 +334,12 @@ func (d *Dao) ensureIndex(index string, unique bool) error {
 		},
 	}
 
+	return d.createIndex(d.collection, idx)
+}
+
+func (d *Dao) createIndex(collection string, idx mongo.IndexModel) error {
+	col := d.client.Database(d.database).Collection(collection)
+
 	_, err := col.Indexes().CreateOne(context.TODO(), idx)
 	if err != nil {
 		return err
@@ -83,14 +348,24 @@ func (d *Dao) ensureIndex(index string, unique bool) error {
 	return nil
 }
 
-// CreateNewUser creates a new user.
+// CreateNewUser creates a new user, user.Password is the plaintext password
+// and stored hashed.
 func (d *Dao) CreateNewUser(user User) error {
 	col := d.client.Database(d.database).Collection(d.collection)
 
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+
+	user.Password = hash
 	user.Strategy = Strategy{Sites: []string{}}
-	user.Files = []File{}
+	user.Files = nil
 
-	_, err := col.InsertOne(context.TODO(), user)
+	_, err = col.InsertOne(context.TODO(), user)
+	if isDuplicateKey(err) {
+		return ErrUserExists
+	}
 	if err != nil {
 		return err
 	}
@@ -116,42 +391,100 @@ func (d *Dao) GetUserInfo(username string) (*User, error) {
 	return &u, nil
 }
 
-// GetUserFiles returns files of given user.
-func (d *Dao) GetUserFiles(username string) (*[]File, error) {
+// VerifyPassword returns the info of given user if password is correct.
+// Passwords stored in plaintext by earlier versions are hashed on the way.
+func (d *Dao) VerifyPassword(username, password string) (*User, error) {
+	user, err := d.GetUserInfo(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isHashed(user.Password) {
+		if subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+			return nil, ErrWrongPassword
+		}
+
+		err = d.SetUserPassword(username, password)
+		if err != nil {
+			return nil, err
+		}
+
+		return d.GetUserInfo(username)
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err != nil {
+		return nil, ErrWrongPassword
+	}
+
+	return user, nil
+}
+
+// SetUserPassword sets the password of given user.
+func (d *Dao) SetUserPassword(username, password string) error {
 	col := d.client.Database(d.database).Collection(d.collection)
 
-	var u User
-	err := col.FindOne(context.TODO(), bson.M{"username": username}, &options.FindOneOptions{
-		Projection: bson.M{
-			"files": 1,
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	res, err := col.UpdateOne(
+		context.TODO(),
+		bson.M{
+			"username": username,
 		},
-	}).Decode(&u)
+		bson.M{
+			"$set": bson.M{
+				"password": hash,
+			},
+		},
+	)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
 	}
 
-	return &u.Files, nil
+	return nil
 }
 
-// GetUserStrategy returns the storage strategy of given user.
-func (d *Dao) GetUserStrategy(username string) (*Strategy, error) {
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// isHashed reports whether a stored password is a bcrypt hash.
+func isHashed(password string) bool {
+	_, err := bcrypt.Cost([]byte(password))
+	return err == nil
+}
+
+// GetUserByAccessKey returns the info of the user owning given access key.
+func (d *Dao) GetUserByAccessKey(accessKey string) (*User, error) {
 	col := d.client.Database(d.database).Collection(d.collection)
 
 	var u User
-	err := col.FindOne(context.TODO(), bson.M{"username": username}, &options.FindOneOptions{
+	err := col.FindOne(context.TODO(), bson.M{"accesskey": accessKey}, &options.FindOneOptions{
 		Projection: bson.M{
-			"strategy": 1,
+			"strategy": 0,
+			"files":    0,
 		},
 	}).Decode(&u)
 	if err != nil {
 		return nil, err
 	}
 
-	return &u.Strategy, nil
+	return &u, nil
 }
 
-// SetUserStrategy sets the storage strategy of given user.
-func (d *Dao) SetUserStrategy(username string, strategy Strategy) error {
+// SetUserKeys sets the S3 credentials of given user.
+func (d *Dao) SetUserKeys(username, accessKey, secretKey string) error {
 	col := d.client.Database(d.database).Collection(d.collection)
 
 	_, err := col.UpdateOne(
@@ -161,7 +494,8 @@ func (d *Dao) SetUserStrategy(username string, strategy Strategy) error {
 		},
 		bson.M{
 			"$set": bson.M{
-				"strategy": strategy,
+				"accesskey": accessKey,
+				"secretkey": secretKey,
 			},
 		},
 	)
@@ -172,67 +506,146 @@ func (d *Dao) SetUserStrategy(username string, strategy Strategy) error {
 	return nil
 }
 
-// AddFile adds given file for given user.
-func (d *Dao) AddFile(username string, file File) error {
+// GetUsernames returns the names of all users.
+func (d *Dao) GetUsernames() ([]string, error) {
 	col := d.client.Database(d.database).Collection(d.collection)
 
-	_, err := col.UpdateOne(
-		context.TODO(),
-		bson.M{
-			"username": username,
+	cur, err := col.Find(context.TODO(), bson.M{}, &options.FindOptions{
+		Projection: bson.M{
+			"username": 1,
 		},
-		bson.M{
-			"$push": bson.M{
-				"files": file,
-			},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	err = cur.All(context.TODO(), &users)
+	if err != nil {
+		return nil, err
+	}
+
+	usernames := make([]string, len(users))
+	for i, user := range users {
+		usernames[i] = user.Username
+	}
+
+	return usernames, nil
+}
+
+// ListUsers returns all users in order of username, without their
+// passwords, secret keys, strategies and files.
+func (d *Dao) ListUsers() ([]User, error) {
+	col := d.client.Database(d.database).Collection(d.collection)
+
+	cur, err := col.Find(context.TODO(), bson.M{}, &options.FindOptions{
+		Projection: bson.M{
+			"password":  0,
+			"secretkey": 0,
+			"strategy":  0,
+			"files":     0,
 		},
-	)
+		Sort: bson.M{
+			"username": 1,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+	err = cur.All(context.TODO(), &users)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// SetUserRole sets the role of given user.
+func (d *Dao) SetUserRole(username, role string) error {
+	return d.setUser(username, bson.M{"$set": bson.M{"role": role}})
+}
+
+// SetUserDisabled disables or enables given user.
+func (d *Dao) SetUserDisabled(username string, disabled bool) error {
+	update := bson.M{"$set": bson.M{"disabled": true}}
+	if !disabled {
+		update = bson.M{"$unset": bson.M{"disabled": ""}}
+	}
+
+	return d.setUser(username, update)
+}
+
+// setUser applies update to the document of given user.
+func (d *Dao) setUser(username string, update bson.M) error {
+	col := d.client.Database(d.database).Collection(d.collection)
+
+	res, err := col.UpdateOne(context.TODO(), bson.M{"username": username}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// DeleteUser removes given user along with the records of its files,
+// directories, uploads and quota reservations. The objects stored for them
+// are left to the caller.
+func (d *Dao) DeleteUser(username string) error {
+	col := d.client.Database(d.database).Collection(d.collection)
+
+	res, err := col.DeleteOne(context.TODO(), bson.M{"username": username})
 	if err != nil {
 		return err
 	}
+	if res.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	for _, collection := range []string{fileCollection, dirCollection, sessionCollection, uploadCollection, reservationCollection} {
+		col = d.client.Database(d.database).Collection(collection)
+		_, err = col.DeleteMany(context.TODO(), bson.M{"username": username})
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-// GetFileInfo returns the info of given file.
-func (d *Dao) GetFileInfo(username, filename string) (*File, error) {
+// GetUserStrategy returns the storage strategy of given user.
+func (d *Dao) GetUserStrategy(username string) (*Strategy, error) {
 	col := d.client.Database(d.database).Collection(d.collection)
 
 	var u User
-	err := col.FindOne(
-		context.TODO(),
-		bson.M{
-			"username": username,
+	err := col.FindOne(context.TODO(), bson.M{"username": username}, &options.FindOneOptions{
+		Projection: bson.M{
+			"strategy": 1,
 		},
-		&options.FindOneOptions{
-			Projection: bson.M{
-				"files": bson.M{
-					"$elemMatch": bson.M{
-						"filename": filename,
-					},
-				},
-			},
-		}).Decode(&u)
-	if err != nil || len(u.Files) == 0 {
-		return nil, errors.New("file not found")
+	}).Decode(&u)
+	if err != nil {
+		return nil, err
 	}
 
-	return &u.Files[0], nil
+	return &u.Strategy, nil
 }
 
-// RemoveFile removes the given file from database.
-func (d *Dao) RemoveFile(username, filename string) error {
+// SetUserStrategy sets the storage strategy of given user.
+func (d *Dao) SetUserStrategy(username string, strategy Strategy) error {
 	col := d.client.Database(d.database).Collection(d.collection)
 
-	_, err := col.UpdateOne(context.TODO(),
+	_, err := col.UpdateOne(
+		context.TODO(),
 		bson.M{
 			"username": username,
 		},
 		bson.M{
-			"$pull": bson.M{
-				"files": bson.M{
-					"filename": filename,
-				},
+			"$set": bson.M{
+				"strategy": strategy,
 			},
 		},
 	)
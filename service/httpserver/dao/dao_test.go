@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 const (
@@ -26,7 +28,13 @@ func init() {
 func TestAll(t *testing.T) {
 	// drop collection
 	d.client.Database(database).Collection(collection).Drop(context.TODO())
-	d.ensureIndex("username", true)
+	d.client.Database(database).Collection(uploadCollection).Drop(context.TODO())
+	d.client.Database(database).Collection(sessionCollection).Drop(context.TODO())
+	d.client.Database(database).Collection(dirCollection).Drop(context.TODO())
+	d.client.Database(database).Collection(fileCollection).Drop(context.TODO())
+	d.client.Database(database).Collection(roleCollection).Drop(context.TODO())
+	d.client.Database(database).Collection(reservationCollection).Drop(context.TODO())
+	d.ensureIndexes()
 
 	user := User{
 		Username: "admin",
@@ -50,12 +58,27 @@ func TestAll(t *testing.T) {
 			Size:         2048,
 			LastModified: time.Now().Unix(),
 			Sites:        []string{"gz", "sh"},
+			Erasure: &Erasure{
+				DataShards:   1,
+				ParityShards: 1,
+				BlockSize:    2048,
+				Shards:       []string{"gz", "sh"},
+			},
 		},
 	}
 
 	testCreateUser(t, user)
 	testGetUserInfo(t, user.Username, user)
 
+	testVerifyPassword(t, user.Username, "secret")
+	testWrongPassword(t, user.Username, "wrong")
+	testSetUserPassword(t, user.Username, "changed")
+	testVerifyPassword(t, user.Username, "changed")
+	testWrongPassword(t, user.Username, "secret")
+	testPlaintextPassword(t, "legacy", "plaintext")
+
+	testSetUserKeys(t, user.Username, "AKIDEXAMPLE", "secret")
+
 	testSetUserStrategy(t, user.Username, strategy)
 	testGetUserStrategy(t, user.Username, strategy)
 
@@ -69,9 +92,61 @@ func TestAll(t *testing.T) {
 	testFileNotExists(t, user.Username, files[0].Filename)
 	testGetUserFiles(t, user.Username, files[1:])
 
+	replaced := files[1]
+	replaced.Size = 4096
+	replaced.Object = "admin/.objects/1"
+	replaced.SHA256 = "ad7facb2586fc6e966c004d7d1d16b024f5805ff7cb47c7a85dabd8b48892ca7"
+	replaced.MD5 = "0f343b0931126a20f133d67c2b018a3b"
+	testPutFile(t, user.Username, replaced)
+	testGetFileInfo(t, user.Username, replaced.Filename, replaced)
+	testGetUserFiles(t, user.Username, []File{replaced})
+
+	moved := replaced
+	moved.Sites = []string{"gz", "bj"}
+	moved.Erasure = &Erasure{
+		DataShards:   1,
+		ParityShards: 1,
+		BlockSize:    2048,
+		Shards:       []string{"gz", "bj"},
+	}
+	testUpdateFileSites(t, user.Username, replaced, moved)
+	testGetFileInfo(t, user.Username, moved.Filename, moved)
+	stale := files[1]
+	testFileChanged(t, user.Username, stale, stale)
+	// A layout read before the update above is not written back.
+	testFileChanged(t, user.Username, replaced, replaced)
+
+	rewritten := moved
+	rewritten.Object = "admin/.objects/3"
+	rewritten.Erasure = nil
+	testReplaceFile(t, user.Username, moved, rewritten)
+	testGetFileInfo(t, user.Username, rewritten.Filename, rewritten)
+	err := d.ReplaceFile(user.Username, moved, rewritten)
+	require.Equal(t, ErrFileChanged, err)
+
+	summed := rewritten
+	summed.SHA256, summed.MD5 = "sha256", "md5"
+	require.Nil(t, d.SetFileChecksums(user.Username, summed))
+	testGetFileInfo(t, user.Username, summed.Filename, summed)
+	require.Equal(t, ErrFileChanged, d.SetFileChecksums(user.Username, moved))
+	err = d.ReplaceFile(user.Username, replaced, moved)
+	require.Equal(t, ErrFileChanged, err)
+	testGetUsernames(t, []string{user.Username, "legacy"})
+
 	testRemoveFile(t, user.Username, files[1].Filename)
 	testFileNotExists(t, user.Username, files[1].Filename)
 	testGetUserFiles(t, user.Username, files[2:])
+
+	testMoveFile(t, user.Username)
+	testDirs(t, user.Username)
+	testListDir(t, user.Username)
+	testMigrateFiles(t)
+	testQueryFiles(t, user.Username)
+	testQuota(t, user)
+	testUserAdmin(t)
+
+	testUpload(t, user.Username)
+	testUploadSession(t, user.Username)
 }
 
 func testCreateUser(t *testing.T, user User) {
@@ -82,9 +157,44 @@ func testCreateUser(t *testing.T, user User) {
 func testGetUserInfo(t *testing.T, username string, want User) {
 	user, err := d.GetUserInfo(username)
 	require.Nil(t, err)
+	require.True(t, isHashed(user.Password))
+	user.Password = want.Password
 	require.Equal(t, want, *user)
 }
 
+func testVerifyPassword(t *testing.T, username, password string) {
+	user, err := d.VerifyPassword(username, password)
+	require.Nil(t, err)
+	require.Equal(t, username, user.Username)
+}
+
+func testWrongPassword(t *testing.T, username, password string) {
+	_, err := d.VerifyPassword(username, password)
+	require.Equal(t, ErrWrongPassword, err)
+}
+
+func testSetUserPassword(t *testing.T, username, password string) {
+	err := d.SetUserPassword(username, password)
+	require.Nil(t, err)
+}
+
+func testPlaintextPassword(t *testing.T, username, password string) {
+	col := d.client.Database(database).Collection(collection)
+	_, err := col.InsertOne(context.TODO(), User{
+		Username: username,
+		Password: password,
+	})
+	require.Nil(t, err)
+
+	testWrongPassword(t, username, "wrong")
+	testVerifyPassword(t, username, password)
+
+	user, err := d.GetUserInfo(username)
+	require.Nil(t, err)
+	require.True(t, isHashed(user.Password))
+	testVerifyPassword(t, username, password)
+}
+
 func testAddFile(t *testing.T, username string, file File) {
 	err := d.AddFile(username, file)
 	require.Nil(t, err)
@@ -103,7 +213,7 @@ func testGetFileInfo(t *testing.T, username, filename string, want File) {
 
 func testFileNotExists(t *testing.T, username, filename string) {
 	_, err := d.GetFileInfo(username, filename)
-	require.NotNil(t, err)
+	require.Equal(t, ErrFileNotFound, err)
 }
 
 func testGetUserFiles(t *testing.T, username string, want []File) {
@@ -122,3 +232,534 @@ func testGetUserStrategy(t *testing.T, username string, want Strategy) {
 	require.Nil(t, err)
 	require.Equal(t, want, *strategy)
 }
+
+func testPutFile(t *testing.T, username string, file File) {
+	err := d.PutFile(username, file)
+	require.Nil(t, err)
+}
+
+func testUpdateFileSites(t *testing.T, username string, old, file File) {
+	err := d.UpdateFileSites(username, old, file)
+	require.Nil(t, err)
+}
+
+func testReplaceFile(t *testing.T, username string, old, file File) {
+	err := d.ReplaceFile(username, old, file)
+	require.Nil(t, err)
+}
+
+func testFileChanged(t *testing.T, username string, old, file File) {
+	err := d.UpdateFileSites(username, old, file)
+	require.Equal(t, ErrFileChanged, err)
+}
+
+func testGetUsernames(t *testing.T, want []string) {
+	usernames, err := d.GetUsernames()
+	require.Nil(t, err)
+	require.ElementsMatch(t, want, usernames)
+}
+
+func testSetUserKeys(t *testing.T, username, accessKey, secretKey string) {
+	err := d.SetUserKeys(username, accessKey, secretKey)
+	require.Nil(t, err)
+
+	user, err := d.GetUserByAccessKey(accessKey)
+	require.Nil(t, err)
+	require.Equal(t, username, user.Username)
+	require.Equal(t, secretKey, user.SecretKey)
+
+	_, err = d.GetUserByAccessKey("unknown")
+	require.NotNil(t, err)
+}
+
+func testUpload(t *testing.T, username string) {
+	now := time.Now().Unix()
+	upload := Upload{
+		ID:       "upload1",
+		Username: username,
+		Filename: "testfile3",
+		Object:   "object3",
+		Created:  now,
+		Updated:  now,
+		Targets: []Target{
+			{Site: "bj", UploadID: "1"},
+			{Site: "sh", UploadID: "2"},
+		},
+	}
+	err := d.CreateUpload(upload)
+	require.Nil(t, err)
+
+	parts := []Part{
+		{Number: 2, Size: 10, ETag: "b", LastModified: now, TargetETags: []string{"b1", "b2"}},
+		{Number: 1, Size: 20, ETag: "a", LastModified: now, TargetETags: []string{"a1", ""}},
+		{Number: 2, Size: 30, ETag: "c", LastModified: now + 1, TargetETags: []string{"c1", "c2"}},
+	}
+	for i, part := range parts {
+		err = d.PutUploadPart(username, upload.ID, part, now+int64(i))
+		require.Nil(t, err)
+	}
+	require.Equal(t, ErrNoUpload, d.PutUploadPart("other", upload.ID, parts[0], now))
+	require.Nil(t, d.FailUploadTargets(username, upload.ID, []int{1}))
+
+	got, err := d.GetUpload(username, upload.ID)
+	require.Nil(t, err)
+	upload.Parts = []Part{parts[2], parts[1]}
+	upload.Updated = now + 2
+	upload.Targets[1].Failed = true
+	require.Equal(t, upload, *got)
+
+	_, err = d.GetUpload("other", upload.ID)
+	require.NotNil(t, err)
+
+	// Uploads from before have staged parts and no update time.
+	legacy := Upload{
+		ID:       "upload0",
+		Username: username,
+		Filename: "testfile3",
+		Created:  now - 10,
+		Parts:    []Part{{Number: 1, Size: 5, ETag: "d", Site: "gz", Object: "1"}},
+	}
+	require.Nil(t, d.CreateUpload(legacy))
+
+	all, err := d.GetAllUploads()
+	require.Nil(t, err)
+	require.ElementsMatch(t, []Upload{upload, legacy}, all)
+	uploads, err := d.GetUserUploads(username)
+	require.Nil(t, err)
+	require.Equal(t, []Upload{legacy, upload}, uploads)
+
+	stale, err := d.GetStaleUploads(now)
+	require.Nil(t, err)
+	require.Equal(t, []Upload{legacy}, stale)
+	require.Equal(t, ErrNoUpload, d.RemoveStaleUpload(username, upload.ID, now))
+	require.Nil(t, d.RemoveStaleUpload(username, legacy.ID, now))
+	stale, err = d.GetStaleUploads(now + 3)
+	require.Nil(t, err)
+	require.Equal(t, []Upload{upload}, stale)
+
+	err = d.RemoveUpload(username, upload.ID)
+	require.Nil(t, err)
+	require.Equal(t, ErrNoUpload, d.RemoveUpload(username, upload.ID))
+	_, err = d.GetUpload(username, upload.ID)
+	require.NotNil(t, err)
+}
+
+func testUploadSession(t *testing.T, username string) {
+	session := UploadSession{
+		ID:        "session1",
+		Username:  username,
+		Filename:  "testfile4",
+		Object:    "admin/.objects/2",
+		Size:      100,
+		ChunkSize: 60,
+		Created:   time.Now().Unix(),
+		Targets: []Target{
+			{Site: "bj", UploadID: "1"},
+			{Site: "sh", UploadID: "2"},
+		},
+	}
+	err := d.CreateUploadSession(session)
+	require.Nil(t, err)
+
+	now := time.Now().Unix()
+	leased := session
+	leased.Lease, leased.LeaseExpires = "lease1", now+60
+	require.Nil(t, d.LeaseUploadSession(leased, now))
+	// The lease is held until it expires.
+	other := session
+	other.Lease, other.LeaseExpires = "lease2", now+60
+	require.Equal(t, ErrSessionChanged, d.LeaseUploadSession(other, now))
+	require.Equal(t, ErrSessionChanged, d.UpdateUploadSession(other))
+	require.Nil(t, d.LeaseUploadSession(other, now+60))
+	require.Equal(t, ErrSessionChanged, d.UpdateUploadSession(leased))
+
+	session.Lease = other.Lease
+	session.Offset = 60
+	session.Updated = now
+	session.Targets[0].Parts = []TargetPart{{Number: 1, ETag: "a"}}
+	session.Targets[1].Failed = true
+	session.SHA256State = []byte("sha256 state")
+	session.MD5State = []byte("md5 state")
+	err = d.UpdateUploadSession(session)
+	require.Nil(t, err)
+	err = d.UpdateUploadSession(session)
+	require.Equal(t, ErrSessionChanged, err)
+	// A lease is taken of the session as it is now only.
+	require.Equal(t, ErrSessionChanged, d.LeaseUploadSession(leased, now+60))
+	session.Lease = ""
+
+	got, err := d.GetUploadSession(username, session.ID)
+	require.Nil(t, err)
+	require.Equal(t, session, *got)
+
+	sessions, err := d.GetUploadSessions(username)
+	require.Nil(t, err)
+	require.Equal(t, []UploadSession{session}, sessions)
+	sessions, err = d.GetStaleUploadSessions(now)
+	require.Nil(t, err)
+	require.Empty(t, sessions)
+	sessions, err = d.GetStaleUploadSessions(now + 1)
+	require.Nil(t, err)
+	require.Equal(t, []UploadSession{session}, sessions)
+
+	err = d.RemoveUploadSession(username, session.ID)
+	require.Nil(t, err)
+	_, err = d.GetUploadSession(username, session.ID)
+	require.NotNil(t, err)
+}
+
+func TestStrategyForFile(t *testing.T) {
+	strategy := Strategy{
+		Version:    StrategyVersion,
+		Sites:      []string{"bj", "sh", "gz"},
+		DataShards: 2, ParityShards: 1,
+		Overrides: []Override{
+			{Prefix: "logs/", Replicas: 1, Sites: []string{"gz"}},
+			{MinSize: 1 << 30, Name: "cheapest", MaxCostPerGB: 0.1},
+		},
+	}
+
+	got := strategy.ForFile("logs/a", 10)
+	require.Equal(t, []string{"gz"}, got.Sites)
+	require.Equal(t, 1, got.Replicas)
+	require.Equal(t, 0, got.DataShards)
+	require.Nil(t, got.Overrides)
+
+	got = strategy.ForFile("big", 2<<30)
+	require.Equal(t, "cheapest", got.Name)
+	require.Equal(t, 0.1, got.MaxCostPerGB)
+	require.Equal(t, 2, got.DataShards)
+
+	// sizes are unknown to size overrides
+	got = strategy.ForFile("big", -1)
+	require.Equal(t, "", got.Name)
+	require.Equal(t, strategy.Sites, got.Sites)
+}
+
+func testMoveFile(t *testing.T, username string) {
+	a := File{Filename: "docs/a", Size: 1, LastModified: 1, Sites: []string{"bj"}}
+	b := File{Filename: "docs/sub/b", Size: 2, LastModified: 2, Sites: []string{"sh"}, Object: "admin/.objects/b"}
+	c := File{Filename: "docsx", Size: 3, LastModified: 3, Sites: []string{"gz"}}
+	testAddFile(t, username, b)
+	testAddFile(t, username, a)
+	testAddFile(t, username, c)
+
+	files, err := d.GetFilesWithPrefix(username, "docs/")
+	require.Nil(t, err)
+	require.Equal(t, []File{a, b}, files)
+
+	err = d.MoveFile(username, a, "docsx", "admin/docs/a")
+	require.Equal(t, ErrFileExists, err)
+	err = d.MoveFile(username, a, "notes/a", "admin/docs/a")
+	require.Nil(t, err)
+	err = d.MoveFile(username, a, "notes/b", "admin/docs/a")
+	require.Equal(t, ErrFileChanged, err)
+
+	moved := a
+	moved.Filename = "notes/a"
+	moved.Object = "admin/docs/a"
+	testGetFileInfo(t, username, moved.Filename, moved)
+	testFileNotExists(t, username, a.Filename)
+
+	for _, file := range []File{moved, b, c} {
+		testRemoveFile(t, username, file.Filename)
+	}
+}
+
+func testDirs(t *testing.T, username string) {
+	for _, p := range []string{"docs", "docs/sub", "pics"} {
+		err := d.CreateDir(Dir{Username: username, Path: p, Created: 1})
+		require.Nil(t, err)
+	}
+	err := d.CreateDir(Dir{Username: username, Path: "docs", Created: 2})
+	require.Equal(t, ErrDirExists, err)
+
+	dirs, err := d.GetDirs(username, "docs")
+	require.Nil(t, err)
+	require.Equal(t, []Dir{
+		{Username: username, Path: "docs", Created: 1},
+		{Username: username, Path: "docs/sub", Created: 1},
+	}, dirs)
+
+	err = d.MoveDirs(username, "docs", "archive/docs")
+	require.Nil(t, err)
+	dirs, err = d.GetDirs(username, "")
+	require.Nil(t, err)
+	require.Equal(t, []Dir{
+		{Username: username, Path: "archive/docs", Created: 1},
+		{Username: username, Path: "archive/docs/sub", Created: 1},
+		{Username: username, Path: "pics", Created: 1},
+	}, dirs)
+
+	err = d.RemoveDirs(username, "archive")
+	require.Nil(t, err)
+	err = d.RemoveDirs(username, "archive/docs")
+	require.Nil(t, err)
+	dirs, err = d.GetDirs(username, "")
+	require.Nil(t, err)
+	require.Equal(t, []Dir{{Username: username, Path: "pics", Created: 1}}, dirs)
+}
+
+func testMigrateFiles(t *testing.T) {
+	files := []File{
+		{Filename: "a", Size: 1, LastModified: 1, Sites: []string{"bj"}},
+		{Filename: "b", Size: 2, LastModified: 2, Sites: []string{"sh"}},
+	}
+	col := d.client.Database(database).Collection(collection)
+	for _, username := range []string{"embedded1", "embedded2"} {
+		_, err := col.InsertOne(context.TODO(), User{
+			Username: username,
+			Password: "secret",
+			Files:    files,
+		})
+		require.Nil(t, err)
+	}
+
+	// Files are moved when accessed, and by MigrateFiles.
+	testGetUserFiles(t, "embedded1", files)
+	err := d.MigrateFiles()
+	require.Nil(t, err)
+
+	for _, username := range []string{"embedded1", "embedded2"} {
+		var u User
+		err = col.FindOne(context.TODO(), bson.M{"username": username}).Decode(&u)
+		require.Nil(t, err)
+		require.Empty(t, u.Files)
+
+		testGetUserFiles(t, username, files)
+		for _, file := range files {
+			testRemoveFile(t, username, file.Filename)
+		}
+		_, err = col.DeleteOne(context.TODO(), bson.M{"username": username})
+		require.Nil(t, err)
+	}
+}
+
+func testQueryFiles(t *testing.T, username string) {
+	files := []File{
+		{Filename: "docs/a.txt", Size: 30, LastModified: 100, Sites: []string{"bj"}},
+		{Filename: "docs/B.txt", Size: 10, LastModified: 300, Sites: []string{"bj", "sh"}},
+		{Filename: "pics/c.png", Size: 20, LastModified: 200, Sites: []string{"sh"}},
+		{Filename: "pics/d.png", Size: 20, LastModified: 400, Sites: []string{"gz"}},
+	}
+	for _, file := range files {
+		testAddFile(t, username, file)
+	}
+
+	queryTests := []struct {
+		query FileQuery
+		want  []File
+	}{
+		{FileQuery{}, []File{files[1], files[0], files[2], files[3]}},
+		{FileQuery{Prefix: "docs/"}, []File{files[1], files[0]}},
+		{FileQuery{Name: "b.TXT"}, []File{files[1]}},
+		{FileQuery{MinSize: 20, Sort: SortBySize}, []File{files[2], files[3], files[0]}},
+		{FileQuery{MaxSize: 20, Sort: SortBySize, Desc: true}, []File{files[3], files[2], files[1]}},
+		{FileQuery{After: 200, Before: 400, Sort: SortByLastModified}, []File{files[2], files[1]}},
+		{FileQuery{Site: "sh"}, []File{files[1], files[2]}},
+		{FileQuery{Sort: SortBySize, Offset: 1, Limit: 2}, []File{files[2], files[3]}},
+		{FileQuery{StartAfter: "docs/a.txt"}, []File{files[2], files[3]}},
+	}
+	for _, test := range queryTests {
+		page, err := d.QueryFiles(username, test.query)
+		require.Nil(t, err)
+		require.Equal(t, test.want, page.Files, "%+v", test.query)
+		if test.query.Limit == 0 {
+			require.Equal(t, int64(len(test.want)), page.Total)
+			require.Empty(t, page.NextCursor)
+		}
+	}
+
+	// Pages follow each other, files of the same size are ordered by name.
+	var got []File
+	q := FileQuery{Sort: SortBySize, Limit: 1}
+	for {
+		page, err := d.QueryFiles(username, q)
+		require.Nil(t, err)
+		require.Equal(t, int64(len(files)), page.Total)
+		got = append(got, page.Files...)
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	require.Equal(t, []File{files[1], files[2], files[3], files[0]}, got)
+
+	_, err := d.QueryFiles(username, FileQuery{Cursor: "!"})
+	require.Equal(t, ErrInvalidCursor, err)
+
+	for _, file := range files {
+		testRemoveFile(t, username, file.Filename)
+	}
+}
+
+func testQuota(t *testing.T, user User) {
+	quota, err := d.GetUserQuota(user.Username)
+	require.Nil(t, err)
+	require.Equal(t, Quota{}, quota)
+
+	roleQuota := Quota{MaxBytes: 1 << 30, MaxFiles: 100}
+	require.Nil(t, d.SetRoleQuota(user.Role, roleQuota))
+	quotas, err := d.GetRoleQuotas()
+	require.Nil(t, err)
+	require.Equal(t, []RoleQuota{{Role: user.Role, Quota: roleQuota}}, quotas)
+	quota, err = d.GetUserQuota(user.Username)
+	require.Nil(t, err)
+	require.Equal(t, roleQuota, quota)
+
+	userQuota := Quota{MaxFiles: 10}
+	require.Nil(t, d.SetUserQuota(user.Username, &userQuota))
+	quota, err = d.GetUserQuota(user.Username)
+	require.Nil(t, err)
+	require.Equal(t, userQuota, quota)
+	require.Nil(t, d.SetUserQuota(user.Username, nil))
+	quota, err = d.GetUserQuota(user.Username)
+	require.Nil(t, err)
+	require.Equal(t, roleQuota, quota)
+	require.Equal(t, mongo.ErrNoDocuments, d.SetUserQuota("nobody", nil))
+
+	files := []File{
+		{Filename: "replicated", Size: 100, Sites: []string{"bj", "sh"}},
+		{
+			Filename: "erasure-coded",
+			Size:     101,
+			Sites:    []string{"bj", "sh", "gz"},
+			Erasure:  &Erasure{DataShards: 2, ParityShards: 1, Shards: []string{"bj", "sh", "gz"}},
+		},
+	}
+	for _, file := range files {
+		testAddFile(t, user.Username, file)
+	}
+	usage, err := d.GetUserUsage(user.Username)
+	require.Nil(t, err)
+	require.Equal(t, Usage{Files: 2, Bytes: 201, StoredBytes: 200 + 51*3}, *usage)
+	for _, file := range files {
+		testRemoveFile(t, user.Username, file.Filename)
+	}
+
+	usage, err = d.GetUserUsage(user.Username)
+	require.Nil(t, err)
+	require.Equal(t, Usage{}, *usage)
+
+	now := time.Now()
+	require.Nil(t, d.Reserve(user.Username, "a", 100, now.Add(time.Hour)))
+	require.Nil(t, d.Reserve(user.Username, "a", 50, now.Add(time.Hour)))
+	require.Nil(t, d.Reserve(user.Username, "b", 10, now.Add(time.Hour)))
+	require.Nil(t, d.Reserve(user.Username, "expired", 1000, now.Add(-time.Second)))
+	require.Nil(t, d.Reserve("nobody", "c", 1000, now.Add(time.Hour)))
+	held, bytes, err := d.GetReserved(user.Username, now)
+	require.Nil(t, err)
+	require.Equal(t, []int64{2, 160}, []int64{held, bytes})
+	require.Nil(t, d.Reserve(user.Username, "a", -150, now.Add(time.Hour)))
+	require.Nil(t, d.RemoveReservation(user.Username, "b"))
+	held, bytes, err = d.GetReserved(user.Username, now)
+	require.Nil(t, err)
+	require.Equal(t, []int64{1, 0}, []int64{held, bytes})
+}
+
+func testUserAdmin(t *testing.T) {
+	user := User{Username: "alice", Password: "secret", Role: "user"}
+	testCreateUser(t, user)
+	require.Equal(t, ErrUserExists, d.CreateNewUser(user))
+
+	users, err := d.ListUsers()
+	require.Nil(t, err)
+	usernames := make([]string, len(users))
+	for i, u := range users {
+		require.Empty(t, u.Password)
+		require.Empty(t, u.SecretKey)
+		usernames[i] = u.Username
+	}
+	require.Equal(t, []string{"admin", "alice", "legacy"}, usernames)
+
+	require.Nil(t, d.SetUserRole(user.Username, "admin"))
+	require.Nil(t, d.SetUserDisabled(user.Username, true))
+	info, err := d.GetUserInfo(user.Username)
+	require.Nil(t, err)
+	require.Equal(t, "admin", info.Role)
+	require.True(t, info.Disabled)
+	require.Nil(t, d.SetUserDisabled(user.Username, false))
+	info, err = d.GetUserInfo(user.Username)
+	require.Nil(t, err)
+	require.False(t, info.Disabled)
+	require.Equal(t, mongo.ErrNoDocuments, d.SetUserRole("nobody", "admin"))
+	require.Equal(t, mongo.ErrNoDocuments, d.SetUserDisabled("nobody", true))
+
+	testAddFile(t, user.Username, File{Filename: "file", Size: 1, Sites: []string{"bj"}})
+	require.Nil(t, d.CreateDir(Dir{Username: user.Username, Path: "dir", Created: 1}))
+	require.Nil(t, d.DeleteUser(user.Username))
+	_, err = d.GetUserInfo(user.Username)
+	require.Equal(t, mongo.ErrNoDocuments, err)
+	testFileNotExists(t, user.Username, "file")
+	dirs, err := d.GetDirs(user.Username, "")
+	require.Nil(t, err)
+	require.Empty(t, dirs)
+	require.Equal(t, mongo.ErrNoDocuments, d.DeleteUser(user.Username))
+}
+
+func testListDir(t *testing.T, username string) {
+	files := []File{
+		{Filename: "a", Size: 1, Sites: []string{"bj"}},
+		{Filename: "b/1", Size: 1, Sites: []string{"bj"}},
+		{Filename: "b/2", Size: 1, Sites: []string{"bj"}},
+		{Filename: "c", Size: 1, Sites: []string{"bj"}},
+		{Filename: "d/e/1", Size: 1, Sites: []string{"bj"}},
+	}
+	for _, file := range files {
+		testAddFile(t, username, file)
+	}
+	require.Nil(t, d.CreateDir(Dir{Username: username, Path: "b", Created: 1}))
+	require.Nil(t, d.CreateDir(Dir{Username: username, Path: "empty", Created: 1}))
+
+	// Pages of two entries, files and prefixes alike.
+	var gotFiles, gotPrefixes []string
+	q := DirQuery{Delimiter: "/", Limit: 2, Dirs: true}
+	for pages := 0; ; pages++ {
+		require.True(t, pages < 4)
+		page, err := d.ListDir(username, q)
+		require.Nil(t, err)
+		require.True(t, len(page.Files)+len(page.Prefixes) <= 2)
+		for _, file := range page.Files {
+			gotFiles = append(gotFiles, file.Filename)
+		}
+		gotPrefixes = append(gotPrefixes, page.Prefixes...)
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	require.Equal(t, []string{"a", "c"}, gotFiles)
+	// pics is left by testDirs.
+	require.Equal(t, []string{"b/", "d/", "empty/", "pics/"}, gotPrefixes)
+
+	page, err := d.ListDir(username, DirQuery{Prefix: "d/", Delimiter: "/", StartAfter: "d/"})
+	require.Nil(t, err)
+	require.Empty(t, page.Files)
+	require.Equal(t, []string{"d/e/"}, page.Prefixes)
+	page, err = d.ListDir(username, DirQuery{Delimiter: "/", StartAfter: "b/"})
+	require.Nil(t, err)
+	require.Equal(t, []File{files[3]}, page.Files)
+	require.Equal(t, []string{"d/"}, page.Prefixes)
+
+	for _, dir := range []string{"b", "d", "d/e", "empty"} {
+		found, err := d.IsDir(username, dir)
+		require.Nil(t, err)
+		require.True(t, found, dir)
+	}
+	found, err := d.IsDir(username, "a")
+	require.Nil(t, err)
+	require.False(t, found)
+	found, err = d.HasEntries(username, "empty")
+	require.Nil(t, err)
+	require.False(t, found)
+
+	byName, err := d.GetFilesByName(username, []string{"c", "a", "x"})
+	require.Nil(t, err)
+	require.Equal(t, []File{files[0], files[3]}, byName)
+
+	for _, file := range files {
+		testRemoveFile(t, username, file.Filename)
+	}
+	require.Nil(t, d.RemoveDirs(username, "b"))
+	require.Nil(t, d.RemoveDirs(username, "empty"))
+}
@@ -0,0 +1,338 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const dirCollection = "dir"
+
+// ErrDirExists is returned when creating a directory that already exists.
+var ErrDirExists = errors.New("directory exists")
+
+// Dir is a directory created by a user. Directories that files are in exist
+// without a record, only empty ones need one to show up.
+type Dir struct {
+	Username string
+	// Path is the slash separated path of the directory, without leading or
+	// trailing slashes.
+	Path    string
+	Created int64
+}
+
+// CreateDir records a directory, it fails with ErrDirExists if the
+// directory has been created before.
+func (d *Dao) CreateDir(dir Dir) error {
+	col := d.client.Database(d.database).Collection(dirCollection)
+
+	_, err := col.InsertOne(context.TODO(), dir)
+	if isDuplicateKey(err) {
+		return ErrDirExists
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetDirs returns the directories of given user whose paths start with
+// prefix, in order of path.
+func (d *Dao) GetDirs(username, prefix string) ([]Dir, error) {
+	col := d.client.Database(d.database).Collection(dirCollection)
+
+	filter := bson.M{"username": username}
+	if prefix != "" {
+		filter["path"] = bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}
+	}
+	cur, err := col.Find(context.TODO(), filter, &options.FindOptions{
+		Sort: bson.M{
+			"path": 1,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := []Dir{}
+	err = cur.All(context.TODO(), &dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	return dirs, nil
+}
+
+// RemoveDirs removes a directory of given user and the directories below.
+func (d *Dao) RemoveDirs(username, path string) error {
+	col := d.client.Database(d.database).Collection(dirCollection)
+
+	_, err := col.DeleteMany(context.TODO(), bson.M{
+		"username": username,
+		"$or": bson.A{
+			bson.M{"path": path},
+			bson.M{"path": bson.M{"$regex": "^" + regexp.QuoteMeta(path+"/")}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MoveDirs moves a directory of given user and the directories below to
+// path to. Directories that exist at the destination are kept.
+func (d *Dao) MoveDirs(username, from, to string) error {
+	col := d.client.Database(d.database).Collection(dirCollection)
+
+	dirs, err := d.GetDirs(username, from)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if dir.Path != from && !strings.HasPrefix(dir.Path, from+"/") {
+			continue
+		}
+
+		moved := dir
+		moved.Path = to + strings.TrimPrefix(dir.Path, from)
+		err = d.CreateDir(moved)
+		if err != nil && err != ErrDirExists {
+			return err
+		}
+		_, err = col.DeleteOne(context.TODO(), bson.M{"username": username, "path": dir.Path})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsDir reports whether path is a directory of given user, either recorded
+// or with files or directories below it.
+func (d *Dao) IsDir(username, path string) (bool, error) {
+	found, err := d.exists(dirCollection, bson.M{"username": username, "path": path})
+	if err != nil || found {
+		return found, err
+	}
+
+	return d.HasEntries(username, path)
+}
+
+// HasEntries reports whether given user has files or recorded directories
+// below path.
+func (d *Dao) HasEntries(username, path string) (bool, error) {
+	err := d.migrateUserFiles(username)
+	if err != nil {
+		return false, err
+	}
+
+	below := bson.M{"$regex": "^" + regexp.QuoteMeta(path+"/")}
+	found, err := d.exists(fileCollection, bson.M{"username": username, "filename": below})
+	if err != nil || found {
+		return found, err
+	}
+
+	return d.exists(dirCollection, bson.M{"username": username, "path": below})
+}
+
+// exists reports whether a document of collection matches filter.
+func (d *Dao) exists(collection string, filter bson.M) (bool, error) {
+	col := d.client.Database(d.database).Collection(collection)
+
+	err := col.FindOne(context.TODO(), filter, &options.FindOneOptions{
+		Projection: bson.M{"_id": 1},
+	}).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DirQuery selects a page of the entries under a prefix, as S3 lists them:
+// the paths that have the delimiter after the prefix are rolled up into a
+// prefix up to and including the delimiter.
+type DirQuery struct {
+	Prefix string
+	// Delimiter must not be empty.
+	Delimiter string
+	// StartAfter skips the entries up to and including it, unless there is
+	// a Cursor, the NextCursor of the previous page.
+	StartAfter string
+	Cursor     string
+	// Limit is the number of entries of a page, files and prefixes alike.
+	Limit int64
+	// Dirs, if set, lists the recorded directories as paths ending with a
+	// slash.
+	Dirs bool
+}
+
+// DirPage is a page of the entries under a prefix, each in order of name.
+type DirPage struct {
+	Files    []File
+	Prefixes []string
+	// NextCursor selects the next page, it is empty on the last page.
+	NextCursor string
+}
+
+// dirEntry is an entry of a directory listing, the name of a file or a
+// rolled up prefix.
+type dirEntry struct {
+	Key    string `bson:"_id"`
+	Prefix bool
+}
+
+// ListDir returns a page of the entries of given user under a prefix. The
+// paths are rolled up in the database, and only the entries of the page are
+// read.
+func (d *Dao) ListDir(username string, q DirQuery) (*DirPage, error) {
+	if q.Delimiter == "" {
+		return nil, errors.New("empty delimiter")
+	}
+	after := q.StartAfter
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after = c.Filename
+	}
+	err := d.migrateUserFiles(username)
+	if err != nil {
+		return nil, err
+	}
+
+	match := bson.M{"$regex": "^" + regexp.QuoteMeta(q.Prefix)}
+	if after != "" {
+		match["$gt"] = after
+	}
+	entries, err := d.rollUp(fileCollection, bson.M{"username": username, "filename": match}, "$filename", q, after, false)
+	if err != nil {
+		return nil, err
+	}
+	if q.Dirs {
+		dirs, err := d.rollUp(dirCollection, bson.M{
+			"username": username,
+			"path":     bson.M{"$regex": "^" + regexp.QuoteMeta(q.Prefix)},
+		}, bson.M{"$concat": bson.A{"$path", "/"}}, q, after, true)
+		if err != nil {
+			return nil, err
+		}
+		entries = mergeEntries(entries, dirs)
+	}
+
+	page := &DirPage{Files: []File{}, Prefixes: []string{}}
+	var names []string
+	for i, entry := range entries {
+		if q.Limit > 0 && int64(i) == q.Limit {
+			page.NextCursor = encodeCursor(&File{Filename: entries[i-1].Key}, "")
+			break
+		}
+		if entry.Prefix {
+			page.Prefixes = append(page.Prefixes, entry.Key)
+		} else {
+			names = append(names, entry.Key)
+		}
+	}
+	if len(names) > 0 {
+		page.Files, err = d.GetFilesByName(username, names)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
+}
+
+// rollUp returns the entries after after of the documents of collection
+// matching match, whose name is given by the expression name, only the
+// prefixes if prefixes is set. The entries are in order of key, at most one
+// more than the limit of q.
+func (d *Dao) rollUp(collection string, match bson.M, name interface{}, q DirQuery, after string, prefixes bool) ([]dirEntry, error) {
+	index := bson.M{"$indexOfBytes": bson.A{"$name", q.Delimiter, len(q.Prefix)}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$project", Value: bson.M{"name": name}}},
+		{{Key: "$project", Value: bson.M{"name": 1, "index": index}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"$cond": bson.A{
+				bson.M{"$gte": bson.A{"$index", 0}},
+				bson.M{"$substrBytes": bson.A{"$name", 0, bson.M{"$add": bson.A{"$index", len(q.Delimiter)}}}},
+				"$name",
+			}},
+			"prefix": bson.M{"$max": bson.M{"$gte": bson.A{"$index", 0}}},
+		}}},
+		{{Key: "$match", Value: bson.M{"_id": bson.M{"$gt": after}}}},
+	}
+	if prefixes {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{"prefix": true}}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: bson.M{"_id": 1}}})
+	if q.Limit > 0 {
+		// One more entry tells whether there is a next page.
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: q.Limit + 1}})
+	}
+
+	col := d.client.Database(d.database).Collection(collection)
+	cur, err := col.Aggregate(context.TODO(), pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []dirEntry{}
+	err = cur.All(context.TODO(), &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// mergeEntries merges two lists of entries in order of key, an entry in both
+// is kept once.
+func mergeEntries(a, b []dirEntry) []dirEntry {
+	merged := make([]dirEntry, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || len(a) > 0 && a[0].Key < b[0].Key:
+			merged = append(merged, a[0])
+			a = a[1:]
+		case len(a) == 0 || b[0].Key < a[0].Key:
+			merged = append(merged, b[0])
+			b = b[1:]
+		default:
+			merged = append(merged, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+
+	return merged
+}
+
+// isDuplicateKey reports whether err is a unique index violation.
+func isDuplicateKey(err error) bool {
+	we, ok := err.(mongo.WriteException)
+	if !ok {
+		return false
+	}
+
+	for _, e := range we.WriteErrors {
+		if e.Code == 11000 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,601 @@
+package dao
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Files are kept in a collection of their own, one document per file. They
+// used to be embedded in the user document, such files are moved over the
+// first time the files of the user are accessed, or by MigrateFiles.
+
+const fileCollection = "file"
+
+// fileDoc is a file as stored in the file collection.
+type fileDoc struct {
+	Username string
+	File     `bson:",inline"`
+}
+
+// fileFilter returns the filter that selects the files of given user
+// matching match.
+func fileFilter(username string, match bson.M) bson.M {
+	filter := bson.M{"username": username}
+	for k, v := range match {
+		filter[k] = v
+	}
+	return filter
+}
+
+// findFiles returns the files of given user matching match, in order of
+// name.
+func (d *Dao) findFiles(username string, match bson.M) ([]File, error) {
+	err := d.migrateUserFiles(username)
+	if err != nil {
+		return nil, err
+	}
+
+	col := d.client.Database(d.database).Collection(fileCollection)
+	cur, err := col.Find(context.TODO(), fileFilter(username, match), &options.FindOptions{
+		Sort: bson.M{
+			"filename": 1,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []fileDoc
+	err = cur.All(context.TODO(), &docs)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]File, len(docs))
+	for i := range docs {
+		files[i] = docs[i].File
+	}
+
+	return files, nil
+}
+
+// GetUserFiles returns files of given user.
+func (d *Dao) GetUserFiles(username string) (*[]File, error) {
+	files, err := d.findFiles(username, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &files, nil
+}
+
+// GetFilesWithPrefix returns the files of given user whose names start with
+// prefix, in order of name.
+func (d *Dao) GetFilesWithPrefix(username, prefix string) ([]File, error) {
+	return d.findFiles(username, bson.M{
+		"filename": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)},
+	})
+}
+
+// GetFilesByName returns the files of given user of the given names that
+// exist, in order of name.
+func (d *Dao) GetFilesByName(username string, filenames []string) ([]File, error) {
+	return d.findFiles(username, bson.M{
+		"filename": bson.M{"$in": filenames},
+	})
+}
+
+// Sort orders of file queries.
+const (
+	SortByName         = "name"
+	SortBySize         = "size"
+	SortByLastModified = "last_modified"
+)
+
+// ErrInvalidCursor is returned if a query cursor cannot be decoded.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// sortFields are the fields files are sorted by for each sort order.
+var sortFields = map[string]string{
+	SortByName:         "filename",
+	SortBySize:         "size",
+	SortByLastModified: "lastmodified",
+}
+
+// FileQuery selects a page of the files of a user. Zero fields do not
+// restrict the files.
+type FileQuery struct {
+	// Prefix is the start of the names of the files.
+	Prefix string
+	// StartAfter, if set, selects the names after it.
+	StartAfter string
+	// Name is a part of the names of the files, matched case-insensitively.
+	Name string
+	// MinSize and MaxSize are the range of sizes, MaxSize is ignored unless
+	// positive.
+	MinSize int64
+	MaxSize int64
+	// After and Before are the range of modification times in seconds since
+	// the epoch.
+	After  int64
+	Before int64
+	// Site is a site the files must be stored on.
+	Site string
+
+	// Sort is the sort order, by name if empty, Desc reverses it.
+	Sort string
+	Desc bool
+	// Cursor is the NextCursor of the previous page, Offset is the number of
+	// files to skip if there is no cursor. Limit is the size of the page, all
+	// files are returned if it is 0.
+	Cursor string
+	Offset int64
+	Limit  int64
+	// SkipTotal leaves Total 0, counting scans all the files selected.
+	SkipTotal bool
+}
+
+// FilePage is a page of files.
+type FilePage struct {
+	Files []File
+	// Total is the number of files selected on all pages.
+	Total int64
+	// NextCursor selects the next page, it is empty on the last page.
+	NextCursor string
+}
+
+// pageCursor is the position after the last file of a page: the value of the
+// sort field and the name of the file, which breaks ties.
+type pageCursor struct {
+	Value    interface{} `bson:"v"`
+	Filename string      `bson:"f"`
+}
+
+// QueryFiles returns a page of the files of given user.
+func (d *Dao) QueryFiles(username string, q FileQuery) (*FilePage, error) {
+	field, ok := sortFields[q.Sort]
+	if q.Sort == "" {
+		field, ok = "filename", true
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown sort order %q", q.Sort)
+	}
+
+	filter := queryFilter(q)
+	err := d.migrateUserFiles(username)
+	if err != nil {
+		return nil, err
+	}
+
+	col := d.client.Database(d.database).Collection(fileCollection)
+	var total int64
+	if !q.SkipTotal {
+		total, err = col.CountDocuments(context.TODO(), fileFilter(username, filter))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order, after := 1, "$gt"
+	if q.Desc {
+		order, after = -1, "$lt"
+	}
+	opts := &options.FindOptions{
+		Sort: bson.D{
+			{Key: field, Value: order},
+			{Key: "filename", Value: order},
+		},
+	}
+	if q.Limit > 0 {
+		// One more file tells whether there is a next page.
+		opts.SetLimit(q.Limit + 1)
+	}
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		position := bson.A{
+			bson.M{field: bson.M{after: c.Value}},
+			bson.M{field: c.Value, "filename": bson.M{after: c.Filename}},
+		}
+		if field == "filename" {
+			position = bson.A{bson.M{"filename": bson.M{after: c.Filename}}}
+		}
+		filter = bson.M{"$and": bson.A{filter, bson.M{"$or": position}}}
+	} else if q.Offset > 0 {
+		opts.SetSkip(q.Offset)
+	}
+
+	cur, err := col.Find(context.TODO(), fileFilter(username, filter), opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []fileDoc
+	err = cur.All(context.TODO(), &docs)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &FilePage{Files: []File{}, Total: total}
+	for i := range docs {
+		if q.Limit > 0 && int64(i) == q.Limit {
+			page.NextCursor = encodeCursor(&docs[i-1].File, q.Sort)
+			break
+		}
+		page.Files = append(page.Files, docs[i].File)
+	}
+
+	return page, nil
+}
+
+// queryFilter returns the filter selecting the files q asks for, regardless
+// of the page.
+func queryFilter(q FileQuery) bson.M {
+	var and bson.A
+	if q.Prefix != "" {
+		and = append(and, bson.M{"filename": bson.M{"$regex": "^" + regexp.QuoteMeta(q.Prefix)}})
+	}
+	if q.StartAfter != "" {
+		and = append(and, bson.M{"filename": bson.M{"$gt": q.StartAfter}})
+	}
+	if q.Name != "" {
+		and = append(and, bson.M{"filename": bson.M{"$regex": regexp.QuoteMeta(q.Name), "$options": "i"}})
+	}
+
+	size := bson.M{}
+	if q.MinSize > 0 {
+		size["$gte"] = q.MinSize
+	}
+	if q.MaxSize > 0 {
+		size["$lte"] = q.MaxSize
+	}
+	if len(size) > 0 {
+		and = append(and, bson.M{"size": size})
+	}
+
+	modified := bson.M{}
+	if q.After > 0 {
+		modified["$gte"] = q.After
+	}
+	if q.Before > 0 {
+		modified["$lt"] = q.Before
+	}
+	if len(modified) > 0 {
+		and = append(and, bson.M{"lastmodified": modified})
+	}
+
+	if q.Site != "" {
+		and = append(and, bson.M{"sites": q.Site})
+	}
+
+	if len(and) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": and}
+}
+
+// encodeCursor returns the cursor of the page after file.
+func encodeCursor(file *File, sort string) string {
+	c := pageCursor{Filename: file.Filename}
+	switch sort {
+	case SortBySize:
+		c.Value = file.Size
+	case SortByLastModified:
+		c.Value = file.LastModified
+	}
+
+	b, _ := bson.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string) (*pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c pageCursor
+	err = bson.Unmarshal(b, &c)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// AddFile adds given file for given user.
+func (d *Dao) AddFile(username string, file File) error {
+	err := d.migrateUserFiles(username)
+	if err != nil {
+		return err
+	}
+
+	col := d.client.Database(d.database).Collection(fileCollection)
+	_, err = col.InsertOne(context.TODO(), fileDoc{username, file})
+	if isDuplicateKey(err) {
+		return ErrFileExists
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// PutFile adds given file for given user, replacing a file of the same name.
+func (d *Dao) PutFile(username string, file File) error {
+	err := d.migrateUserFiles(username)
+	if err != nil {
+		return err
+	}
+
+	col := d.client.Database(d.database).Collection(fileCollection)
+	_, err = col.ReplaceOne(
+		context.TODO(),
+		bson.M{
+			"username": username,
+			"filename": file.Filename,
+		},
+		fileDoc{username, file},
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateFileSites saves the sites and erasure layout of file, old is the
+// file as read before. It fails with ErrFileChanged if the file has been
+// replaced or removed, or its layout has changed, since old was read.
+func (d *Dao) UpdateFileSites(username string, old, file File) error {
+	set := bson.M{
+		"sites": file.Sites,
+	}
+	if file.Erasure != nil {
+		set["erasure"] = file.Erasure
+	}
+
+	return d.updateFile(username, matchLayout(old), bson.M{"$set": set})
+}
+
+// SetFileChecksums saves the checksums of file. It fails with
+// ErrFileChanged if the file has been replaced or removed.
+func (d *Dao) SetFileChecksums(username string, file File) error {
+	return d.updateFile(username, matchFile(file), bson.M{
+		"$set": bson.M{
+			"sha256": file.SHA256,
+			"md5":    file.MD5,
+		},
+	})
+}
+
+// ReplaceFile replaces old with file. It fails with ErrFileChanged if old has
+// been replaced or removed, or its layout has changed, since it was read.
+func (d *Dao) ReplaceFile(username string, old, file File) error {
+	err := d.migrateUserFiles(username)
+	if err != nil {
+		return err
+	}
+
+	col := d.client.Database(d.database).Collection(fileCollection)
+	res, err := col.ReplaceOne(context.TODO(), fileFilter(username, matchLayout(old)), fileDoc{username, file})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrFileChanged
+	}
+
+	return nil
+}
+
+// MoveFile renames given file to to, object is the object name to record
+// so that the file stays readable under its new name, empty if it is
+// recorded already. It fails with ErrFileExists if a file named to exists,
+// and with ErrFileChanged if the file has been replaced or removed since it
+// was read.
+func (d *Dao) MoveFile(username string, file File, to, object string) error {
+	set := bson.M{
+		"filename": to,
+	}
+	if object != "" {
+		set["object"] = object
+	}
+
+	err := d.updateFile(username, matchFile(file), bson.M{"$set": set})
+	if isDuplicateKey(err) {
+		return ErrFileExists
+	}
+	return err
+}
+
+// matchFile returns the filter that matches file unless it has been replaced
+// or removed. Files are told apart by name, modification time and object.
+func matchFile(file File) bson.M {
+	match := bson.M{
+		"filename":     file.Filename,
+		"lastmodified": file.LastModified,
+	}
+	if file.Object != "" {
+		match["object"] = file.Object
+	}
+	return match
+}
+
+// matchLayout returns the filter that matches file unless it has been
+// replaced or removed, or its sites or erasure layout have changed. Layout
+// updates use it so that a layout read before another update, e.g. by a
+// repair and a migration of the same file, is not written back.
+func matchLayout(file File) bson.M {
+	match := matchFile(file)
+	match["sites"] = file.Sites
+	match["erasure"] = file.Erasure
+	return match
+}
+
+// updateFile applies update to the file match matches, it fails with
+// ErrFileChanged if there is none.
+func (d *Dao) updateFile(username string, match bson.M, update bson.M) error {
+	err := d.migrateUserFiles(username)
+	if err != nil {
+		return err
+	}
+
+	col := d.client.Database(d.database).Collection(fileCollection)
+	res, err := col.UpdateOne(context.TODO(), fileFilter(username, match), update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrFileChanged
+	}
+
+	return nil
+}
+
+// GetFileInfo returns the info of given file.
+func (d *Dao) GetFileInfo(username, filename string) (*File, error) {
+	files, err := d.findFiles(username, bson.M{"filename": filename})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, ErrFileNotFound
+	}
+
+	return &files[0], nil
+}
+
+// RemoveFile removes the given file from database.
+func (d *Dao) RemoveFile(username, filename string) error {
+	err := d.migrateUserFiles(username)
+	if err != nil {
+		return err
+	}
+
+	col := d.client.Database(d.database).Collection(fileCollection)
+	_, err = col.DeleteOne(context.TODO(), bson.M{
+		"username": username,
+		"filename": filename,
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MigrateFiles moves the files embedded in user documents to the file
+// collection. Files can be used while they are moved.
+func (d *Dao) MigrateFiles() error {
+	col := d.client.Database(d.database).Collection(d.collection)
+
+	cur, err := col.Find(context.TODO(), bson.M{"files.0": bson.M{"$exists": true}}, &options.FindOptions{
+		Projection: bson.M{
+			"username": 1,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var users []User
+	err = cur.All(context.TODO(), &users)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		err = d.migrateUserFiles(user.Username)
+		if err != nil {
+			return fmt.Errorf("migrate %v's files: %v", user.Username, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateUserFiles moves the files embedded in the document of given user to
+// the file collection. Each file is inserted unless a file of the same name,
+// which is newer, is in the collection already, and only then pulled from the
+// user document, so that a crash in between leaves the file in both places
+// rather than in none. Users found without embedded files are remembered and
+// not looked up again, files are never embedded anew.
+func (d *Dao) migrateUserFiles(username string) error {
+	if _, ok := d.migrated.Load(username); ok {
+		return nil
+	}
+
+	users := d.client.Database(d.database).Collection(d.collection)
+	files := d.client.Database(d.database).Collection(fileCollection)
+
+	var u User
+	err := users.FindOne(context.TODO(), bson.M{"username": username, "files.0": bson.M{"$exists": true}}, &options.FindOneOptions{
+		Projection: bson.M{
+			"files": 1,
+		},
+	}).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		d.migrated.Store(username, true)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, file := range u.Files {
+		ins, err := files.UpdateOne(
+			context.TODO(),
+			bson.M{
+				"username": username,
+				"filename": file.Filename,
+			},
+			bson.M{
+				"$setOnInsert": fileDoc{username, file},
+			},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+
+		match := matchFile(file)
+		res, err := users.UpdateOne(
+			context.TODO(),
+			bson.M{
+				"username": username,
+				"files": bson.M{
+					"$elemMatch": match,
+				},
+			},
+			bson.M{
+				"$pull": bson.M{
+					"files": match,
+				},
+			},
+		)
+		if err != nil {
+			return err
+		}
+		if res.ModifiedCount == 0 && ins.UpsertedCount > 0 {
+			// A concurrent migration moved the file first, and it has been
+			// removed or renamed since, it must not come back.
+			_, err = files.DeleteOne(context.TODO(), fileFilter(username, match))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package dao
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	roleCollection        = "role"
+	reservationCollection = "reservation"
+)
+
+// Quota limits what a user may store, a limit of 0 is no limit.
+type Quota struct {
+	MaxBytes int64 `json:"max_bytes"`
+	MaxFiles int64 `json:"max_files"`
+}
+
+// RoleQuota is the quota of the users of a role that have none of their own.
+type RoleQuota struct {
+	Role  string `json:"role"`
+	Quota Quota  `json:"quota"`
+}
+
+// Usage is what a user stores. Bytes is the size of the files, StoredBytes
+// is what they take up on the sites, counting every replica and shard.
+type Usage struct {
+	Files       int64 `json:"files"`
+	Bytes       int64 `json:"bytes"`
+	StoredBytes int64 `json:"stored_bytes"`
+}
+
+// Reservation holds quota for a file while it is being stored. Bytes count
+// as the quota mode counts them, every reservation counts as a file. A
+// reservation is dropped once Expires has passed, so that the quota held by
+// an upload that has gone away is freed.
+type Reservation struct {
+	ID       string
+	Username string
+	Bytes    int64
+	Expires  time.Time
+}
+
+// SetUserQuota sets the quota of given user, nil to fall back to the quota
+// of the role of the user.
+func (d *Dao) SetUserQuota(username string, quota *Quota) error {
+	col := d.client.Database(d.database).Collection(d.collection)
+
+	update := bson.M{"$set": bson.M{"quota": quota}}
+	if quota == nil {
+		update = bson.M{"$unset": bson.M{"quota": ""}}
+	}
+	res, err := col.UpdateOne(context.TODO(), bson.M{"username": username}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// SetRoleQuota sets the quota of given role.
+func (d *Dao) SetRoleQuota(role string, quota Quota) error {
+	col := d.client.Database(d.database).Collection(roleCollection)
+
+	_, err := col.ReplaceOne(
+		context.TODO(),
+		bson.M{"role": role},
+		RoleQuota{Role: role, Quota: quota},
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetRoleQuotas returns the quotas of all roles that have one, in order of
+// role.
+func (d *Dao) GetRoleQuotas() ([]RoleQuota, error) {
+	col := d.client.Database(d.database).Collection(roleCollection)
+
+	cur, err := col.Find(context.TODO(), bson.M{}, &options.FindOptions{
+		Sort: bson.M{
+			"role": 1,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	quotas := []RoleQuota{}
+	err = cur.All(context.TODO(), &quotas)
+	if err != nil {
+		return nil, err
+	}
+
+	return quotas, nil
+}
+
+// GetUserQuota returns the quota of given user, which is the quota of the
+// role of the user unless the user has one. It is the zero Quota if neither
+// has one.
+func (d *Dao) GetUserQuota(username string) (Quota, error) {
+	col := d.client.Database(d.database).Collection(d.collection)
+
+	var u User
+	err := col.FindOne(context.TODO(), bson.M{"username": username}, &options.FindOneOptions{
+		Projection: bson.M{
+			"role":  1,
+			"quota": 1,
+		},
+	}).Decode(&u)
+	if err != nil {
+		return Quota{}, err
+	}
+	if u.Quota != nil {
+		return *u.Quota, nil
+	}
+
+	col = d.client.Database(d.database).Collection(roleCollection)
+	var rq RoleQuota
+	err = col.FindOne(context.TODO(), bson.M{"role": u.Role}).Decode(&rq)
+	if err == mongo.ErrNoDocuments {
+		return Quota{}, nil
+	}
+	if err != nil {
+		return Quota{}, err
+	}
+
+	return rq.Quota, nil
+}
+
+// GetUserUsage sums up the files of given user. A replicated file takes up
+// its size on each of its sites, an erasure-coded one a shard of it.
+func (d *Dao) GetUserUsage(username string) (*Usage, error) {
+	err := d.migrateUserFiles(username)
+	if err != nil {
+		return nil, err
+	}
+
+	sites := bson.M{"$size": bson.M{"$ifNull": bson.A{"$sites", bson.A{}}}}
+	stored := bson.M{"$cond": bson.A{
+		bson.M{"$gt": bson.A{"$erasure.datashards", 0}},
+		bson.M{"$multiply": bson.A{
+			bson.M{"$ceil": bson.M{"$divide": bson.A{"$size", "$erasure.datashards"}}},
+			sites,
+		}},
+		bson.M{"$multiply": bson.A{"$size", sites}},
+	}}
+
+	col := d.client.Database(d.database).Collection(fileCollection)
+	cur, err := col.Aggregate(context.TODO(), mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"username": username}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":         nil,
+			"files":       bson.M{"$sum": 1},
+			"bytes":       bson.M{"$sum": "$size"},
+			"storedbytes": bson.M{"$sum": stored},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var usage []Usage
+	err = cur.All(context.TODO(), &usage)
+	if err != nil {
+		return nil, err
+	}
+	if len(usage) == 0 {
+		return &Usage{}, nil
+	}
+
+	return &usage[0], nil
+}
+
+// Reserve adds bytes to given reservation of given user, which is created if
+// there is none, and has it expire at expires. bytes may be negative to give
+// back what is no longer needed.
+func (d *Dao) Reserve(username, id string, bytes int64, expires time.Time) error {
+	col := d.client.Database(d.database).Collection(reservationCollection)
+
+	_, err := col.UpdateOne(
+		context.TODO(),
+		bson.M{
+			"id":       id,
+			"username": username,
+		},
+		bson.M{
+			"$inc": bson.M{
+				"bytes": bytes,
+			},
+			"$set": bson.M{
+				"expires": expires,
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetReserved returns the number of reservations of given user that have
+// not expired at now, and the bytes they hold.
+func (d *Dao) GetReserved(username string, now time.Time) (int64, int64, error) {
+	col := d.client.Database(d.database).Collection(reservationCollection)
+
+	cur, err := col.Aggregate(context.TODO(), mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"username": username, "expires": bson.M{"$gt": now}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   nil,
+			"files": bson.M{"$sum": 1},
+			"bytes": bson.M{"$sum": "$bytes"},
+		}}},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var reserved []struct {
+		Files int64
+		Bytes int64
+	}
+	err = cur.All(context.TODO(), &reserved)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(reserved) == 0 {
+		return 0, 0, nil
+	}
+
+	return reserved[0].Files, reserved[0].Bytes, nil
+}
+
+// RemoveReservation removes given reservation of given user.
+func (d *Dao) RemoveReservation(username, id string) error {
+	col := d.client.Database(d.database).Collection(reservationCollection)
+
+	_, err := col.DeleteOne(context.TODO(), bson.M{"id": id, "username": username})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package dao
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const sessionCollection = "uploadsession"
+
+// ErrSessionChanged is returned if an upload session has moved on since it
+// was read, or another request holds its lease.
+var ErrSessionChanged = errors.New("upload session changed")
+
+// UploadSession is a resumable upload in progress. The file is received in
+// chunks of ChunkSize bytes, each of which is uploaded as a part of a
+// multipart upload on every target.
+type UploadSession struct {
+	ID        string `json:"id"`
+	Username  string `json:"-"`
+	Filename  string `json:"filename"`
+	Object    string `json:"-"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+	// Offset is the number of bytes received so far.
+	Offset  int64 `json:"offset"`
+	Created int64 `json:"created"`
+	Updated int64 `json:"updated"`
+	// Erasure is set if the file is erasure coded, the i-th shard goes to
+	// the i-th target.
+	Erasure *Erasure `json:"erasure,omitempty" bson:",omitempty"`
+	Targets []Target `json:"-"`
+	// SHA256State and MD5State are the marshaled hash states of the content
+	// received so far.
+	SHA256State []byte `json:"-" bson:",omitempty"`
+	MD5State    []byte `json:"-" bson:",omitempty"`
+	// Lease is held by the request working on the session until
+	// LeaseExpires, so that a chunk is uploaded by one request at a time.
+	Lease        string `json:"-" bson:",omitempty"`
+	LeaseExpires int64  `json:"-" bson:",omitempty"`
+}
+
+// Target is the multipart upload of a session on a single site.
+type Target struct {
+	Site     string
+	UploadID string
+	Parts    []TargetPart
+	// Failed is set once the site has dropped out of the session.
+	Failed bool
+}
+
+// TargetPart is a part uploaded to a target.
+type TargetPart struct {
+	Number int
+	ETag   string
+}
+
+// CreateUploadSession records a new upload session.
+func (d *Dao) CreateUploadSession(session UploadSession) error {
+	col := d.client.Database(d.database).Collection(sessionCollection)
+
+	_, err := col.InsertOne(context.TODO(), session)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetUploadSession returns given upload session of given user.
+func (d *Dao) GetUploadSession(username, id string) (*UploadSession, error) {
+	col := d.client.Database(d.database).Collection(sessionCollection)
+
+	var s UploadSession
+	err := col.FindOne(context.TODO(), bson.M{"id": id, "username": username}).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// GetUploadSessions returns the upload sessions of given user.
+func (d *Dao) GetUploadSessions(username string) ([]UploadSession, error) {
+	col := d.client.Database(d.database).Collection(sessionCollection)
+
+	cur, err := col.Find(context.TODO(), bson.M{"username": username})
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []UploadSession{}
+	err = cur.All(context.TODO(), &sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// GetStaleUploadSessions returns the upload sessions of all users that
+// have not been updated since before.
+func (d *Dao) GetStaleUploadSessions(before int64) ([]UploadSession, error) {
+	col := d.client.Database(d.database).Collection(sessionCollection)
+
+	cur, err := col.Find(context.TODO(), bson.M{"updated": bson.M{"$lt": before}})
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []UploadSession{}
+	err = cur.All(context.TODO(), &sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// LeaseUploadSession takes the lease of session for session.Lease until
+// session.LeaseExpires. It fails with ErrSessionChanged if the session has
+// been updated since it was read, or another lease has not expired by now.
+func (d *Dao) LeaseUploadSession(session UploadSession, now int64) error {
+	col := d.client.Database(d.database).Collection(sessionCollection)
+
+	res, err := col.UpdateOne(
+		context.TODO(),
+		bson.M{
+			"id":       session.ID,
+			"username": session.Username,
+			"offset":   session.Offset,
+			"updated":  session.Updated,
+			"$or": bson.A{
+				bson.M{"leaseexpires": bson.M{"$exists": false}},
+				bson.M{"leaseexpires": bson.M{"$lte": now}},
+			},
+		},
+		bson.M{
+			"$set": bson.M{
+				"lease":        session.Lease,
+				"leaseexpires": session.LeaseExpires,
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrSessionChanged
+	}
+
+	return nil
+}
+
+// UpdateUploadSession saves the offset, targets, hash states and update time
+// of session and gives up its lease. It fails with ErrSessionChanged unless
+// the session is still leased for session.Lease, so that a chunk is
+// committed only once.
+func (d *Dao) UpdateUploadSession(session UploadSession) error {
+	col := d.client.Database(d.database).Collection(sessionCollection)
+
+	res, err := col.UpdateOne(
+		context.TODO(),
+		bson.M{
+			"id":       session.ID,
+			"username": session.Username,
+			"lease":    session.Lease,
+		},
+		bson.M{
+			"$set": bson.M{
+				"offset":      session.Offset,
+				"updated":     session.Updated,
+				"targets":     session.Targets,
+				"sha256state": session.SHA256State,
+				"md5state":    session.MD5State,
+			},
+			"$unset": bson.M{
+				"lease":        "",
+				"leaseexpires": "",
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrSessionChanged
+	}
+
+	return nil
+}
+
+// RemoveUploadSession removes given upload session.
+func (d *Dao) RemoveUploadSession(username, id string) error {
+	col := d.client.Database(d.database).Collection(sessionCollection)
+
+	_, err := col.DeleteOne(context.TODO(), bson.M{"id": id, "username": username})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const uploadCollection = "upload"
+
+// ErrNoUpload is returned if a multipart upload has been completed, aborted
+// or expired, or has been used since it was read.
+var ErrNoUpload = errors.New("no such upload")
+
+// Upload is a multipart upload in progress. Each part is uploaded as a part
+// of a multipart upload on every target, like the chunks of an
+// UploadSession, so that completing the upload completes those.
+//
+// Uploads without targets are from before, their parts are staged as
+// objects on a single site. They can only be aborted.
+type Upload struct {
+	ID       string
+	Username string
+	Filename string
+	Object   string `bson:",omitempty"`
+	Created  int64
+	// Updated is the time the upload was created or a part was last
+	// uploaded, it is not set on uploads from before.
+	Updated int64 `bson:",omitempty"`
+	// Erasure is set if the file is erasure coded, the i-th shard goes to
+	// the i-th target. Every part is encoded on its own.
+	Erasure *Erasure `bson:",omitempty"`
+	Targets []Target `bson:",omitempty"`
+	Parts   []Part
+}
+
+// Part is an uploaded part of a multipart upload.
+type Part struct {
+	Number int
+	Size   int64
+	// ETag is the MD5 of the part.
+	ETag         string
+	LastModified int64 `bson:",omitempty"`
+	// TargetETags are the etags of the part on each target of the upload,
+	// "" on targets it has failed on.
+	TargetETags []string `bson:",omitempty"`
+	// Site and Object are the staged object of a part of an upload from
+	// before.
+	Site   string `bson:",omitempty"`
+	Object string `bson:",omitempty"`
+}
+
+// CreateUpload records a new multipart upload.
+func (d *Dao) CreateUpload(upload Upload) error {
+	col := d.client.Database(d.database).Collection(uploadCollection)
+
+	if upload.Parts == nil {
+		upload.Parts = []Part{}
+	}
+
+	_, err := col.InsertOne(context.TODO(), upload)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetUpload returns given multipart upload of given user.
+func (d *Dao) GetUpload(username, id string) (*Upload, error) {
+	col := d.client.Database(d.database).Collection(uploadCollection)
+
+	var u Upload
+	err := col.FindOne(context.TODO(), bson.M{"id": id, "username": username}).Decode(&u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// GetUserUploads returns the multipart uploads of given user, in order of
+// file name and creation.
+func (d *Dao) GetUserUploads(username string) ([]Upload, error) {
+	return d.findUploads(bson.M{"username": username}, &options.FindOptions{
+		Sort: bson.D{
+			{Key: "filename", Value: 1},
+			{Key: "created", Value: 1},
+			{Key: "id", Value: 1},
+		},
+	})
+}
+
+// GetAllUploads returns the multipart uploads of all users.
+func (d *Dao) GetAllUploads() ([]Upload, error) {
+	return d.findUploads(bson.M{}, nil)
+}
+
+// GetStaleUploads returns the multipart uploads of all users that have not
+// been updated since before.
+func (d *Dao) GetStaleUploads(before int64) ([]Upload, error) {
+	return d.findUploads(staleUpload(before), nil)
+}
+
+// staleUpload returns the filter that matches uploads not updated since
+// before. Uploads from before count as updated when they were created.
+func staleUpload(before int64) bson.M {
+	return bson.M{
+		"$or": bson.A{
+			bson.M{"updated": bson.M{"$lt": before}},
+			bson.M{"updated": bson.M{"$exists": false}, "created": bson.M{"$lt": before}},
+		},
+	}
+}
+
+func (d *Dao) findUploads(filter bson.M, opts *options.FindOptions) ([]Upload, error) {
+	col := d.client.Database(d.database).Collection(uploadCollection)
+
+	cur, err := col.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	uploads := []Upload{}
+	err = cur.All(context.TODO(), &uploads)
+	if err != nil {
+		return nil, err
+	}
+
+	return uploads, nil
+}
+
+// PutUploadPart adds a part to given multipart upload, replacing a part of
+// the same number, and sets the update time of the upload. It fails with
+// ErrNoUpload if the upload has been removed.
+func (d *Dao) PutUploadPart(username, id string, part Part, updated int64) error {
+	col := d.client.Database(d.database).Collection(uploadCollection)
+
+	// A part of the same number may be pushed in between, the part replaces
+	// it then.
+	for i := 0; i < 2; i++ {
+		res, err := col.UpdateOne(
+			context.TODO(),
+			bson.M{
+				"id":           id,
+				"username":     username,
+				"parts.number": part.Number,
+			},
+			bson.M{
+				"$set": bson.M{
+					"parts.$": part,
+					"updated": updated,
+				},
+			},
+		)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount > 0 {
+			return nil
+		}
+
+		res, err = col.UpdateOne(
+			context.TODO(),
+			bson.M{
+				"id":           id,
+				"username":     username,
+				"parts.number": bson.M{"$ne": part.Number},
+			},
+			bson.M{
+				"$push": bson.M{
+					"parts": part,
+				},
+				"$set": bson.M{
+					"updated": updated,
+				},
+			},
+		)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount > 0 {
+			return nil
+		}
+	}
+
+	return ErrNoUpload
+}
+
+// FailUploadTargets marks given targets of given multipart upload as failed.
+func (d *Dao) FailUploadTargets(username, id string, targets []int) error {
+	col := d.client.Database(d.database).Collection(uploadCollection)
+
+	set := bson.M{}
+	for _, i := range targets {
+		set[fmt.Sprintf("targets.%d.failed", i)] = true
+	}
+
+	_, err := col.UpdateOne(context.TODO(), bson.M{"id": id, "username": username}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RemoveUpload removes given multipart upload. It fails with ErrNoUpload if
+// it has been removed already, so that an upload is completed or aborted
+// once.
+func (d *Dao) RemoveUpload(username, id string) error {
+	return d.removeUpload(bson.M{"id": id, "username": username})
+}
+
+// RemoveStaleUpload removes given multipart upload unless it has been
+// updated since before, it fails with ErrNoUpload otherwise.
+func (d *Dao) RemoveStaleUpload(username, id string, before int64) error {
+	filter := staleUpload(before)
+	filter["id"] = id
+	filter["username"] = username
+	return d.removeUpload(filter)
+}
+
+func (d *Dao) removeUpload(filter bson.M) error {
+	col := d.client.Database(d.database).Collection(uploadCollection)
+
+	res, err := col.DeleteOne(context.TODO(), filter)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNoUpload
+	}
+
+	return nil
+}
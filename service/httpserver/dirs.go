@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Files are named by slash separated paths, directories are the prefixes
+// of these paths. Empty directories are recorded by the dao so that they
+// show up in listings.
+
+var (
+	errInvalidPath = errors.New("invalid path")
+	errPathExists  = errors.New("path exists")
+	errDirNotEmpty = errors.New("directory not empty")
+)
+
+// cleanPath returns p without leading and trailing slashes. Paths with
+// empty, "." or ".." elements are invalid.
+func cleanPath(p string) (string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" || path.Clean("/"+p) != "/"+p {
+		return "", errInvalidPath
+	}
+
+	return p, nil
+}
+
+// dirBatch is the number of files removed or moved at once.
+const dirBatch = 100
+
+// isDir reports whether dir is a directory of given user, either recorded
+// or holding files.
+func isDir(username, dir string) (bool, error) {
+	return d.IsDir(username, dir)
+}
+
+// checkParents fails with errPathExists if one of the parent directories of
+// p is a file of given user.
+func checkParents(username, p string) error {
+	var parents []string
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	if len(parents) == 0 {
+		return nil
+	}
+
+	files, err := d.GetFilesByName(username, parents)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return errPathExists
+	}
+
+	return nil
+}
+
+// checkFilePath fails with errPathExists if p cannot be a file of given
+// user, because it is a directory or one of its parents is a file.
+func checkFilePath(username, p string) error {
+	dir, err := isDir(username, p)
+	if err != nil {
+		return err
+	}
+	if dir {
+		return errPathExists
+	}
+
+	return checkParents(username, p)
+}
+
+// makeDir records a directory of given user and its parents. It fails
+// with errPathExists if the directory or one of its parents is a file.
+func makeDir(username, dir string) error {
+	_, err := d.GetFileInfo(username, dir)
+	if err == nil {
+		return errPathExists
+	}
+	if err != dao.ErrFileNotFound {
+		return err
+	}
+	err = checkParents(username, dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for p := dir; p != "."; p = path.Dir(p) {
+		err = d.CreateDir(dao.Dir{
+			Username: username,
+			Path:     p,
+			Created:  now,
+		})
+		if err != nil && err != dao.ErrDirExists {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeDir removes a directory of given user. Unless recursive, it fails
+// with errDirNotEmpty if the directory has files or directories in it. The
+// files are removed a batch at a time.
+func removeDir(username, dir string, recursive bool) error {
+	if !recursive {
+		found, err := d.HasEntries(username, dir)
+		if err != nil {
+			return err
+		}
+		if found {
+			return errDirNotEmpty
+		}
+	}
+
+	for {
+		files, err := filesBelow(username, dir)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+		for i := range files {
+			err = removeFile(username, &files[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.RemoveDirs(username, dir)
+}
+
+// filesBelow returns the first batch of the files of given user below dir.
+func filesBelow(username, dir string) ([]dao.File, error) {
+	page, err := d.QueryFiles(username, dao.FileQuery{
+		Prefix:    dir + "/",
+		Limit:     dirBatch,
+		SkipTotal: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Files, nil
+}
+
+// movePath moves a file or a directory of given user from one path to
+// another. Directories are moved a batch of files at a time, a failure
+// leaves the files moved so far at the destination. It fails with
+// errPathExists if the destination exists or one of its parents is a file.
+func movePath(username, from, to string) error {
+	if to == from || strings.HasPrefix(to, from+"/") {
+		return errInvalidPath
+	}
+
+	exists, err := pathExists(username, to)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errPathExists
+	}
+	err = checkParents(username, to)
+	if err != nil {
+		return err
+	}
+
+	file, err := d.GetFileInfo(username, from)
+	if err == nil {
+		return d.MoveFile(username, *file, to, objectName(username, file))
+	}
+	if err != dao.ErrFileNotFound {
+		return err
+	}
+
+	// Moved files leave the source, so the first batch is always the next.
+	for {
+		files, err := filesBelow(username, from)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+		for i := range files {
+			file := &files[i]
+			err = d.MoveFile(username, *file, to+strings.TrimPrefix(file.Filename, from), objectName(username, file))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.MoveDirs(username, from, to)
+}
+
+// pathExists reports whether p is a file or a directory of given user.
+func pathExists(username, p string) (bool, error) {
+	_, err := d.GetFileInfo(username, p)
+	if err == nil {
+		return true, nil
+	}
+	if err != dao.ErrFileNotFound {
+		return false, err
+	}
+
+	return isDir(username, p)
+}
+
+func createDir(c *gin.Context) {
+	username := c.GetString(usernameKey)
+
+	var form struct {
+		Path string `json:"path" binding:"required"`
+	}
+	err := c.ShouldBindJSON(&form)
+	if err == nil {
+		form.Path, err = cleanPath(form.Path)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "A valid path is required.",
+		})
+		return
+	}
+
+	err = makeDir(username, form.Path)
+	if err == errPathExists {
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "A file of the same name or in place of a parent directory exists.",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("create directory %v for %v", form.Path, username)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    codeOK,
+		"message": "Create directory successfully",
+	})
+}
+
+func deleteDir(c *gin.Context) {
+	username := c.GetString(usernameKey)
+
+	dir, err := cleanPath(c.Query("path"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "A valid path is required.",
+		})
+		return
+	}
+
+	exists, err := isDir(username, dir)
+	if err == nil && !exists {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeFileNotExists,
+			"message": "The given directory not exists.",
+		})
+		return
+	}
+	if err == nil {
+		err = removeDir(username, dir, c.Query("recursive") == "true")
+	}
+	if err == errDirNotEmpty {
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "The directory is not empty.",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("remove directory %v of %v", dir, username)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    codeOK,
+		"message": "Delete directory successfully",
+	})
+}
+
+func move(c *gin.Context) {
+	username := c.GetString(usernameKey)
+
+	var form struct {
+		From string `json:"from" binding:"required"`
+		To   string `json:"to" binding:"required"`
+	}
+	err := c.ShouldBindJSON(&form)
+	if err == nil {
+		form.From, err = cleanPath(form.From)
+	}
+	if err == nil {
+		form.To, err = cleanPath(form.To)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Valid paths are required.",
+		})
+		return
+	}
+
+	exists, err := pathExists(username, form.From)
+	if err == nil && !exists {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeFileNotExists,
+			"message": "The given file not exists.",
+		})
+		return
+	}
+	if err == nil {
+		err = movePath(username, form.From, form.To)
+	}
+	switch {
+	case err == errInvalidPath:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "A directory cannot be moved into itself.",
+		})
+		return
+	case err == errPathExists || err == dao.ErrFileExists:
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "The destination exists.",
+		})
+		return
+	case err == dao.ErrFileChanged:
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "The file has changed, try again.",
+		})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("move %v to %v for %v", form.From, form.To, username)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    codeOK,
+		"message": "Move successfully",
+	})
+}
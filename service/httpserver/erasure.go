@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/klauspost/reedsolomon"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxBlockSize is the largest size of a shard's block of a stripe.
+const maxBlockSize = 1 << 20
+
+var errTooFewShards = errors.New("too few shards available")
+
+// blockSize chooses the block size for a file of given size, small files
+// get small blocks so that they are not padded to a whole stripe.
+func blockSize(size int64, dataShards int) int64 {
+	if size < 0 {
+		return maxBlockSize
+	}
+
+	block := (size + int64(dataShards) - 1) / int64(dataShards)
+	if block > maxBlockSize {
+		return maxBlockSize
+	}
+	if block == 0 {
+		return 1
+	}
+
+	return block
+}
+
+// shardSize returns the size of each shard of a file of given size.
+func shardSize(size int64, dataShards int, block int64) int64 {
+	stripe := block * int64(dataShards)
+	return (size + stripe - 1) / stripe * block
+}
+
+// erasureUpload encodes r and streams the i-th shard to the i-th site. It
+// returns the number of bytes read, the outcome per site and the layout of
+// the shards that have been stored.
+func erasureUpload(r io.Reader, filename string, size int64, sites []string, dataShards, parityShards int) (int64, []siteResult, *dao.Erasure, error) {
+	if len(sites) != dataShards+parityShards {
+		return 0, nil, nil, fmt.Errorf("%v sites for %v shards", len(sites), dataShards+parityShards)
+	}
+
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	block := blockSize(size, dataShards)
+	shardLen := int64(-1)
+	if size >= 0 {
+		shardLen = shardSize(size, dataShards, block)
+	}
+	uploads := startUploads(sites, filename, shardLen)
+	w := &fanOutWriter{uploads: uploads, min: dataShards}
+
+	written, stored, err := encodeStripes(r, enc, w, dataShards, parityShards, block)
+	if err == nil && size >= 0 && written != size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	results := finishUploads(uploads, err, filename, stored)
+	if err == errTooFewSites {
+		err = nil
+	}
+
+	erasure := &dao.Erasure{
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		BlockSize:    block,
+		Shards:       make([]string, len(sites)),
+	}
+	for i, result := range results {
+		if result.Error == "" {
+			erasure.Shards[i] = result.Site
+		}
+	}
+
+	return written, results, erasure, err
+}
+
+// encodeStripes reads r stripe by stripe and writes the i-th block of each
+// encoded stripe to the i-th upload of w. It returns the number of bytes read
+// and the number of bytes written to each shard.
+func encodeStripes(r io.Reader, enc reedsolomon.Encoder, w *fanOutWriter, dataShards, parityShards int, block int64) (int64, int64, error) {
+	stripe := make([]byte, int64(dataShards+parityShards)*block)
+	shards := make([][]byte, dataShards+parityShards)
+	for i := range shards {
+		shards[i] = stripe[int64(i)*block : int64(i+1)*block]
+	}
+	data := stripe[:int64(dataShards)*block]
+
+	var written, stored int64
+	for {
+		n, err := io.ReadFull(r, data)
+		if err == io.EOF {
+			return written, stored, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return written, stored, err
+		}
+		written += int64(n)
+		last := err == io.ErrUnexpectedEOF
+
+		// The last stripe is padded with zeros.
+		for i := n; i < len(data); i++ {
+			data[i] = 0
+		}
+		err = enc.Encode(shards)
+		if err != nil {
+			return written, stored, err
+		}
+		err = w.writeEach(shards)
+		if err != nil {
+			return written, stored, err
+		}
+		stored += block
+
+		if last {
+			return written, stored, nil
+		}
+	}
+}
+
+// erasureReader reads an erasure-coded file, reconstructing the blocks of
+// shards that are missing or fail while reading.
+type erasureReader struct {
+	enc      reedsolomon.Encoder
+	erasure  *dao.Erasure
+	filename string
+
+	// shards holds the open shards, nil if a shard is not being read.
+	shards []io.ReadCloser
+	// spare holds the indexes of shards that can still be opened.
+	spare []int
+	// offset is the offset within each shard of the next block.
+	offset int64
+
+	remaining int64
+	// skip is the number of bytes of the next stripe before the offset the
+	// reader was opened at.
+	skip   int64
+	stripe []byte
+	buf    []byte
+}
+
+// newErasureReader opens enough shards of file to read it from offset,
+// preferring data shards as they need no decoding.
+func newErasureReader(username string, file *dao.File, offset int64) (*erasureReader, error) {
+	e := file.Erasure
+	enc, err := reedsolomon.New(e.DataShards, e.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reading starts at the stripe holding offset.
+	stripeSize := int64(e.DataShards) * e.BlockSize
+	first := offset / stripeSize
+	r := &erasureReader{
+		enc:       enc,
+		erasure:   e,
+		filename:  objectName(username, file),
+		shards:    make([]io.ReadCloser, len(e.Shards)),
+		offset:    first * e.BlockSize,
+		remaining: file.Size - first*stripeSize,
+		skip:      offset - first*stripeSize,
+		stripe:    make([]byte, stripeSize),
+	}
+	// Data shards go first as they need no decoding, the best sites first
+	// within data and parity shards.
+	r.spare = append(rankShards(e.Shards[:e.DataShards], 0), rankShards(e.Shards[e.DataShards:], e.DataShards)...)
+
+	for open := 0; open < e.DataShards; open++ {
+		if !r.openSpare() {
+			r.Close()
+			return nil, errTooFewShards
+		}
+	}
+
+	return r, nil
+}
+
+// rankShards returns the indexes of the stored shards, best site first.
+// Indexes start at base.
+func rankShards(shards []string, base int) []int {
+	index := make(map[string]int)
+	var sites []string
+	for i, site := range shards {
+		if site != "" {
+			index[site] = base + i
+			sites = append(sites, site)
+		}
+	}
+
+	var ranked []int
+	for _, site := range registry.rank(sites) {
+		ranked = append(ranked, index[site])
+	}
+
+	return ranked
+}
+
+// sites returns the sites of the shards being read.
+func (r *erasureReader) sites() []string {
+	var sites []string
+	for i, shard := range r.shards {
+		if shard != nil {
+			sites = append(sites, r.erasure.Shards[i])
+		}
+	}
+
+	return sites
+}
+
+// openSpare opens the next spare shard at the current offset.
+func (r *erasureReader) openSpare() bool {
+	for len(r.spare) > 0 {
+		i := r.spare[0]
+		r.spare = r.spare[1:]
+
+		body, err := openObject(r.erasure.Shards[i], r.filename, r.offset)
+		if err != nil {
+			log.WithError(err).Errorf("open shard %v of %v on %v", i, r.filename, r.erasure.Shards[i])
+			continue
+		}
+		r.shards[i] = body
+		return true
+	}
+
+	return false
+}
+
+func (r *erasureReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+
+		err := r.nextStripe()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// nextStripe reads the next stripe into buf.
+func (r *erasureReader) nextStripe() error {
+	e := r.erasure
+	blocks := make([][]byte, len(r.shards))
+
+	for {
+		var wg sync.WaitGroup
+		for i, shard := range r.shards {
+			if shard == nil || blocks[i] != nil {
+				continue
+			}
+
+			wg.Add(1)
+			go func(i int, shard io.ReadCloser) {
+				defer wg.Done()
+				block := make([]byte, e.BlockSize)
+				_, err := io.ReadFull(shard, block)
+				if err != nil {
+					log.WithError(err).Errorf("read shard %v of %v on %v", i, r.filename, e.Shards[i])
+					registry.observe(e.Shards[i], 0, err)
+					shard.Close()
+					r.shards[i] = nil
+					return
+				}
+				blocks[i] = block
+			}(i, shard)
+		}
+		wg.Wait()
+
+		available := 0
+		for _, block := range blocks {
+			if block != nil {
+				available++
+			}
+		}
+		if available >= e.DataShards {
+			break
+		}
+
+		// Replace failed shards before giving up.
+		for missing := e.DataShards - available; missing > 0; missing-- {
+			if !r.openSpare() {
+				return errTooFewShards
+			}
+		}
+	}
+	r.offset += e.BlockSize
+
+	err := r.enc.ReconstructData(blocks)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < e.DataShards; i++ {
+		copy(r.stripe[int64(i)*e.BlockSize:], blocks[i])
+	}
+
+	n := int64(len(r.stripe))
+	if n > r.remaining {
+		n = r.remaining
+	}
+	r.buf = r.stripe[r.skip:n]
+	r.remaining -= n
+	r.skip = 0
+
+	return nil
+}
+
+func (r *erasureReader) Close() error {
+	for i, shard := range r.shards {
+		if shard != nil {
+			shard.Close()
+			r.shards[i] = nil
+		}
+	}
+
+	return nil
+}
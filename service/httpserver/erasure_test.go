@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testDataShards   = 2
+	testParityShards = 2
+	testStripeSize   = testDataShards * maxBlockSize
+)
+
+// uploadErasure encodes content to sites as u/f and returns the file.
+func uploadErasure(t *testing.T, sites []*testSite, content []byte, size int64) *dao.File {
+	written, results, erasure, err := erasureUpload(chunked(content), "u/f", size, siteNames(sites), testDataShards, testParityShards)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), written)
+	require.Len(t, storedSites(results), len(sites))
+
+	return &dao.File{Filename: "f", Size: written, Erasure: erasure}
+}
+
+func readErasure(file *dao.File, offset int64) ([]byte, error) {
+	r, err := newErasureReader("u", file, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+func TestErasureRoundTrip(t *testing.T) {
+	sites, cleanup := newTestSites(t, testDataShards+testParityShards)
+	defer cleanup()
+
+	tests := []struct {
+		name string
+		size int
+		// unknown uploads without the size.
+		unknown bool
+	}{
+		{"empty", 0, false},
+		{"one byte", 1, false},
+		{"stripe less one", testStripeSize - 1, false},
+		{"stripe", testStripeSize, false},
+		{"stripe plus one", testStripeSize + 1, false},
+		{"several stripes", 3*testStripeSize + 5, false},
+		{"unknown size", 2*testStripeSize + 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := testContent(tt.size)
+			size := int64(tt.size)
+			if tt.unknown {
+				size = -1
+			}
+			file := uploadErasure(t, sites, content, size)
+
+			// All shards have the same size, whole blocks of each stripe.
+			e := file.Erasure
+			want := shardSize(file.Size, testDataShards, e.BlockSize)
+			for _, s := range sites {
+				shard, ok := s.object("u/f")
+				require.True(t, ok)
+				require.Equal(t, want, int64(len(shard)))
+			}
+
+			got, err := readErasure(file, 0)
+			require.NoError(t, err)
+			require.Equal(t, content, got)
+
+			if tt.size > 1 {
+				offset := int64(tt.size / 2)
+				got, err = readErasure(file, offset)
+				require.NoError(t, err)
+				require.Equal(t, content[offset:], got)
+			}
+		})
+	}
+}
+
+func TestErasureReconstruct(t *testing.T) {
+	sites, cleanup := newTestSites(t, testDataShards+testParityShards)
+	defer cleanup()
+
+	content := testContent(3*testStripeSize + 5)
+	file := uploadErasure(t, sites, content, int64(len(content)))
+	shards := make([][]byte, len(sites))
+	for i, s := range sites {
+		shards[i], _ = s.object("u/f")
+	}
+
+	// Sites 0 and 1 hold the data shards, 2 and 3 the parity shards.
+	tests := []struct {
+		name string
+		// missing shards are not on their sites.
+		missing []int
+		// truncated shards have lost their second half.
+		truncated []int
+		// failing shards fail after their first block and a bit.
+		failing []int
+		offset  int64
+		wantErr bool
+	}{
+		{name: "data shard missing", missing: []int{0}},
+		{name: "data shards missing", missing: []int{0, 1}},
+		{name: "parity shards missing", missing: []int{2, 3}},
+		{name: "data and parity shard missing", missing: []int{1, 2}},
+		{name: "data shard truncated", truncated: []int{1}},
+		{name: "data shards truncated", truncated: []int{0, 1}},
+		{name: "data shard fails", failing: []int{0}},
+		{name: "data shards fail", failing: []int{0, 1}},
+		{name: "missing and failing", missing: []int{0}, failing: []int{2}},
+		{name: "failing from offset", failing: []int{1}, offset: testStripeSize + 3},
+		{name: "too many missing", missing: []int{0, 1, 2}, wantErr: true},
+		{name: "too many failing", missing: []int{0}, failing: []int{1, 2}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetRegistry(sites)
+			for i, s := range sites {
+				s.setObject("u/f", shards[i])
+				s.setFailAfter(-1)
+			}
+			for _, i := range tt.missing {
+				sites[i].setObject("u/f", nil)
+			}
+			for _, i := range tt.truncated {
+				sites[i].setObject("u/f", shards[i][:len(shards[i])/2])
+			}
+			for _, i := range tt.failing {
+				sites[i].setFailAfter(file.Erasure.BlockSize + 100)
+			}
+
+			got, err := readErasure(file, tt.offset)
+			if tt.wantErr {
+				require.Equal(t, errTooFewShards, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, content[tt.offset:], got)
+		})
+	}
+}
+
+// Shards are not checksummed, a shard corrupt on its site decodes into wrong
+// content that the checksum of the file catches.
+func TestErasureCorruptShard(t *testing.T) {
+	sites, cleanup := newTestSites(t, testDataShards+testParityShards)
+	defer cleanup()
+
+	content := testContent(testStripeSize + 5)
+	file := uploadErasure(t, sites, content, int64(len(content)))
+	sum := sha256.Sum256(content)
+	file.SHA256 = hex.EncodeToString(sum[:])
+
+	shard, _ := sites[0].object("u/f")
+	corrupt := append([]byte(nil), shard...)
+	corrupt[10] ^= 0xff
+	sites[0].setObject("u/f", corrupt)
+
+	r, err := newErasureReader("u", file, 0)
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = ioutil.ReadAll(verifyFile(r, file, "sites"))
+	require.Equal(t, errChecksumMismatch, err)
+}
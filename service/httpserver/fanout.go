@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fanOutBufferSize is the size of chunks written to all sites at once.
+const fanOutBufferSize = 1 << 20
+
+var (
+	errTooFewSites = errors.New("too few sites left")
+	errSiteClosed  = errors.New("site closed the stream")
+)
+
+// siteResult is the outcome of an upload to a single site.
+type siteResult struct {
+	Site  string `json:"site"`
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+// siteUpload is an upload to a single storage site, fed through a pipe.
+type siteUpload struct {
+	site string
+	pw   *io.PipeWriter
+	done chan struct{}
+
+	// werr is the first error writing to the pipe.
+	werr error
+	// md5 hashes what is written to the pipe.
+	md5 hash.Hash
+	// size, etag and err are set once done is closed. etag is the MD5 the
+	// site has computed, or "" if it reports none.
+	size int64
+	etag string
+	err  error
+}
+
+// startSiteUpload starts uploading filename to site, the data is taken from
+// what is written to the returned siteUpload.
+func startSiteUpload(site, filename string, size int64) *siteUpload {
+	return startSiteWrite(site, func(r io.Reader) (int64, string, error) {
+		return uploadToSite(site, r, filename, size)
+	})
+}
+
+// startSiteWrite runs send with what is written to the returned siteUpload,
+// send returns the size and MD5 site has stored.
+func startSiteWrite(site string, send func(r io.Reader) (int64, string, error)) *siteUpload {
+	pr, pw := io.Pipe()
+	u := &siteUpload{
+		site: site,
+		pw:   pw,
+		done: make(chan struct{}),
+		md5:  md5.New(),
+	}
+
+	go func() {
+		defer close(u.done)
+		u.size, u.etag, u.err = send(pr)
+		if u.err != nil {
+			registry.observe(site, 0, u.err)
+		}
+		// Unblock the writer if the site stopped reading early.
+		pr.CloseWithError(errSiteClosed)
+	}()
+
+	return u
+}
+
+// finish ends the stream with err, or EOF if err is nil, and waits for the
+// site to respond.
+func (u *siteUpload) finish(err error) {
+	u.pw.CloseWithError(err)
+	<-u.done
+}
+
+// uploadToSite uploads r to site and returns the size and MD5 the site has
+// stored.
+func uploadToSite(site string, r io.Reader, filename string, size int64) (int64, string, error) {
+	c, err := registry.get(site)
+	if err != nil {
+		return 0, "", err
+	}
+
+	resp, err := c.Upload(r, filename, size)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return 0, "", fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+
+	var created struct {
+		Size int64  `json:"size"`
+		MD5  string `json:"md5"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return created.Size, created.MD5, nil
+}
+
+// fanOutWriter writes to all uploads in parallel. An upload that fails is
+// dropped and the others carry on, writing only fails once fewer than min
+// uploads are left.
+type fanOutWriter struct {
+	uploads []*siteUpload
+	min     int
+}
+
+func (w *fanOutWriter) Write(p []byte) (int, error) {
+	ps := make([][]byte, len(w.uploads))
+	for i := range ps {
+		ps[i] = p
+	}
+
+	err := w.writeEach(ps)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// writeEach writes ps[i] to the i-th upload, all in parallel.
+func (w *fanOutWriter) writeEach(ps [][]byte) error {
+	var wg sync.WaitGroup
+	for i, u := range w.uploads {
+		if u.werr != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(u *siteUpload, p []byte) {
+			defer wg.Done()
+			u.md5.Write(p)
+			_, u.werr = u.pw.Write(p)
+		}(u, ps[i])
+	}
+	wg.Wait()
+
+	alive := 0
+	for _, u := range w.uploads {
+		if u.werr == nil {
+			alive++
+		}
+	}
+	if alive < w.min {
+		return errTooFewSites
+	}
+
+	return nil
+}
+
+// startUploads starts uploading filename to all given sites.
+func startUploads(sites []string, filename string, size int64) []*siteUpload {
+	uploads := make([]*siteUpload, len(sites))
+	for i, site := range sites {
+		uploads[i] = startSiteUpload(site, filename, size)
+	}
+
+	return uploads
+}
+
+// finishUploads ends all uploads with err and returns the outcome per site.
+// A site has stored the file only if it reports exactly want bytes, and the
+// MD5 of what it was sent if it reports one.
+func finishUploads(uploads []*siteUpload, err error, filename string, want int64) []siteResult {
+	results := make([]siteResult, len(uploads))
+	for i, u := range uploads {
+		u.finish(err)
+
+		results[i] = siteResult{Site: u.site, Size: u.size}
+		switch {
+		case u.err != nil:
+			results[i].Error = u.err.Error()
+		case u.werr != nil:
+			results[i].Error = u.werr.Error()
+		case u.size != want:
+			results[i].Error = fmt.Sprintf("stored %v of %v bytes", u.size, want)
+		case u.etag != "" && u.etag != hex.EncodeToString(u.md5.Sum(nil)):
+			results[i].Error = fmt.Sprintf("stored md5 %v, sent %x", u.etag, u.md5.Sum(nil))
+		}
+		if results[i].Error != "" {
+			log.Errorf("upload %v to %v failed: %v", filename, u.site, results[i].Error)
+		}
+	}
+
+	return results
+}
+
+// fanOut streams r to all given sites concurrently, reading it only once.
+// It returns the number of bytes read and the outcome per site.
+func fanOut(r io.Reader, filename string, size int64, sites []string) (int64, []siteResult, error) {
+	uploads := startUploads(sites, filename, size)
+
+	w := &fanOutWriter{uploads: uploads, min: 1}
+	written, err := io.CopyBuffer(w, r, make([]byte, fanOutBufferSize))
+	if err == nil && size >= 0 && written != size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	results := finishUploads(uploads, err, filename, written)
+	if err == errTooFewSites {
+		err = nil
+	}
+
+	return written, results, err
+}
+
+// storedSites returns the sites that have stored the file completely.
+func storedSites(results []siteResult) []string {
+	var sites []string
+	for _, result := range results {
+		if result.Error == "" {
+			sites = append(sites, result.Site)
+		}
+	}
+
+	return sites
+}
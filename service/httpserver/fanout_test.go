@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// chunked reads content without a WriteTo, so that it is copied a buffer at
+// a time.
+func chunked(content []byte) io.Reader {
+	return struct{ io.Reader }{bytes.NewReader(content)}
+}
+
+func TestFanOut(t *testing.T) {
+	sites, cleanup := newTestSites(t, 3)
+	defer cleanup()
+
+	// Larger than the buffer so that sites fail between writes.
+	content := testContent(3*fanOutBufferSize + 100)
+	tests := []struct {
+		name      string
+		failAfter []int64
+		size      int64
+		stored    []string
+	}{
+		{"healthy", []int64{-1, -1, -1}, int64(len(content)), siteNames(sites)},
+		{"unknown size", []int64{-1, -1, -1}, -1, siteNames(sites)},
+		{"one fails at once", []int64{0, -1, -1}, int64(len(content)), siteNames(sites[1:])},
+		{"two fail partway", []int64{-1, 1000, fanOutBufferSize + 1}, int64(len(content)), siteNames(sites[:1])},
+		{"all fail partway", []int64{1000, 2000, 2 * fanOutBufferSize}, int64(len(content)), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, s := range sites {
+				s.setFailAfter(tt.failAfter[i])
+				s.setObject("f", nil)
+			}
+
+			written, results, err := fanOut(chunked(content), "f", tt.size, siteNames(sites))
+			require.NoError(t, err)
+			require.Equal(t, int64(len(content)), written)
+			require.Len(t, results, len(sites))
+			require.Equal(t, tt.stored, storedSites(results))
+			for _, name := range tt.stored {
+				for _, s := range sites {
+					if s.name == name {
+						data, _ := s.object("f")
+						require.Equal(t, content, data)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFanOutShort(t *testing.T) {
+	sites, cleanup := newTestSites(t, 2)
+	defer cleanup()
+
+	content := testContent(1000)
+	_, results, err := fanOut(bytes.NewReader(content), "f", 2000, siteNames(sites))
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+	require.Empty(t, storedSites(results))
+}
+
+// testSend returns a send of startSiteWrite that takes failAfter bytes and
+// fails, or takes everything if failAfter is -1.
+func testSend(failAfter int64) func(io.Reader) (int64, string, error) {
+	return func(r io.Reader) (int64, string, error) {
+		if failAfter < 0 {
+			n, err := io.Copy(ioutil.Discard, r)
+			return n, "", err
+		}
+		n, _ := io.CopyN(ioutil.Discard, r, failAfter)
+		return n, "", errors.New("disk full")
+	}
+}
+
+func TestFanOutWriterMin(t *testing.T) {
+	registry = newSiteRegistry(nil)
+
+	content := testContent(4 * fanOutBufferSize)
+	tests := []struct {
+		name      string
+		failAfter []int64
+		written   int64
+		wantErr   error
+	}{
+		{"all left", []int64{-1, -1, -1}, int64(len(content)), nil},
+		{"min left", []int64{1000, -1, -1}, int64(len(content)), nil},
+		{"below min", []int64{1000, fanOutBufferSize + 1, -1}, fanOutBufferSize, errTooFewSites},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploads := make([]*siteUpload, len(tt.failAfter))
+			for i, failAfter := range tt.failAfter {
+				uploads[i] = startSiteWrite(fmt.Sprintf("site%v", i), testSend(failAfter))
+			}
+
+			w := &fanOutWriter{uploads: uploads, min: 2}
+			written, err := io.CopyBuffer(w, chunked(content), make([]byte, fanOutBufferSize))
+			results := finishUploads(uploads, err, "f", int64(len(content)))
+			require.Equal(t, tt.wantErr, err)
+			require.Equal(t, tt.written, written)
+
+			// An upload ended with an error stores nothing, even on the
+			// sites that were still taking it.
+			for i, result := range results {
+				require.Equal(t, tt.wantErr == nil && tt.failAfter[i] < 0, result.Error == "", result.Site)
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	pb "github.com/Sean-Pearce/jcs/service/scheduler/proto"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// errUploadInterrupted is returned if reading the uploaded file fails.
+	errUploadInterrupted = errors.New("upload interrupted")
+	// errStorageFailed is returned if too few sites have stored a file.
+	errStorageFailed = errors.New("upload to storage backends failed")
+)
+
+// storeFile places a file read from body according to the user's strategy,
+// uploads it and records it. size is -1 if unknown. A file of the same name
+// is replaced once the new one is stored, a directory of the same name or a
+// file in place of a parent directory fails with errPathExists.
+func storeFile(username, filename string, body io.Reader, size int64) (*dao.File, []siteResult, error) {
+	err := checkFilePath(username, filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	strategy, err := d.GetUserStrategy(username)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get %v's strategy: %v", username, err)
+	}
+
+	res, err := reserveQuota("", username, filename, size, strategy)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The reservation is held until the file is recorded.
+	defer res.release()
+	var limited *quotaReader
+	if res != nil {
+		limited = &quotaReader{r: body, count: countFunc(filename, size, strategy), res: res}
+		body = limited
+	}
+
+	file, results, err := placeFile(username, filename, body, size, strategy)
+	if limited != nil && limited.exceeded {
+		if err == nil {
+			removeObjects(file)
+		}
+		return nil, results, errQuotaExceeded
+	}
+	if err != nil {
+		return nil, results, err
+	}
+
+	err = recordFile(username, file)
+	if err != nil {
+		return nil, results, err
+	}
+
+	return file, results, nil
+}
+
+// placeFile uploads a file read from body to the sites the scheduler picks
+// for strategy. The file is stored as a new object and is not recorded.
+func placeFile(username, filename string, body io.Reader, size int64, strategy *dao.Strategy) (*dao.File, []siteResult, error) {
+	strategy = strategy.ForFile(filename, size)
+	sites, err := schedule(username, filename, size, strategy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Every upload gets a new object, so a replaced file stays readable
+	// until the new one is recorded.
+	file := &dao.File{
+		Filename: filename,
+		Object:   newObjectName(username),
+	}
+
+	var (
+		written int64
+		results []siteResult
+	)
+	h := newContentHash()
+	body = io.TeeReader(body, h)
+	if strategy.DataShards > 0 {
+		written, results, file.Erasure, err = erasureUpload(body, file.Object, size, sites, strategy.DataShards, strategy.ParityShards)
+	} else {
+		written, results, err = fanOut(body, file.Object, size, sites)
+	}
+	h.sum(file)
+	file.Size = written
+	file.LastModified = time.Now().Unix()
+	file.Sites = storedSites(results)
+
+	if err != nil {
+		removeObjects(file)
+		return nil, results, fmt.Errorf("%w: %v", errUploadInterrupted, err)
+	}
+
+	return file, results, nil
+}
+
+// storedEnough reports whether a file is on enough sites to be read.
+func storedEnough(file *dao.File) bool {
+	if file.Erasure != nil {
+		return len(file.Sites) >= file.Erasure.DataShards
+	}
+
+	return len(file.Sites) > 0
+}
+
+// recordFile records a stored file, replacing the file of the same name. The
+// objects of file are removed if it can't be recorded.
+func recordFile(username string, file *dao.File) error {
+	if !storedEnough(file) {
+		removeObjects(file)
+		return errStorageFailed
+	}
+
+	old, err := d.GetFileInfo(username, file.Filename)
+	if err == dao.ErrFileNotFound {
+		old = nil
+	} else if err != nil {
+		removeObjects(file)
+		return fmt.Errorf("get file %v of %v: %v", file.Filename, username, err)
+	}
+
+	err = d.PutFile(username, *file)
+	if err != nil {
+		removeObjects(file)
+		return fmt.Errorf("add file %v for %v: %v", file.Filename, username, err)
+	}
+
+	if old != nil {
+		removeObjects(objectFile(username, old))
+	}
+
+	return nil
+}
+
+// schedule asks the scheduler where to place a file.
+func schedule(username, filename string, size int64, strategy *dao.Strategy) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	fileInfo, _ := json.Marshal(map[string]interface{}{
+		"filename": filename,
+		"size":     size,
+	})
+	req := &pb.ScheduleRequest{
+		Strategy: strategy.Name,
+		Sites:    strategy.Sites,
+		FileInfo: string(fileInfo),
+		Replicas: int32(strategy.Replicas),
+		Policy: &pb.Policy{
+			Regions:          strategy.Regions,
+			ForbiddenRegions: strategy.ForbiddenRegions,
+			MaxCostPerGb:     strategy.MaxCostPerGB,
+			MaxLatency:       strategy.MaxLatency,
+		},
+		Usage: registry.siteUsage(),
+	}
+	if strategy.DataShards > 0 {
+		req.Shards = int32(strategy.DataShards + strategy.ParityShards)
+	}
+
+	resp, err := s.Schedule(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("schedule for %v, sites are %v: %v", username, strategy.Sites, err)
+	}
+	for _, site := range resp.Sites {
+		log.Infof("place %v of %v on %v: %v", filename, username, site, resp.Reasons[site])
+	}
+
+	return resp.Sites, nil
+}
+
+// openFile opens a file for reading from offset, it returns the file content
+// and the sites serving it. The checksum of the file is verified if all of it
+// is read.
+func openFile(username string, file *dao.File, offset int64) (io.ReadCloser, string, error) {
+	var (
+		r        io.ReadCloser
+		servedBy string
+	)
+	if file.Erasure != nil {
+		er, err := newErasureReader(username, file, offset)
+		if err != nil {
+			return nil, "", err
+		}
+		r, servedBy = er, strings.Join(er.sites(), ",")
+	} else {
+		rr, err := newReplicaReader(username, file, offset)
+		if err != nil {
+			return nil, "", err
+		}
+		r, servedBy = rr, rr.site
+	}
+
+	if offset == 0 {
+		r = verifyFile(r, file, servedBy)
+		if v, ok := r.(*verifyReader); ok {
+			v.username = username
+			if file.Erasure == nil {
+				v.reopen = otherReplicas(username, file, servedBy)
+			}
+		}
+	}
+	return r, servedBy, nil
+}
+
+// otherReplicas returns a function opening the replicas of file but the one
+// on site from the start, one after the other, best first.
+func otherReplicas(username string, file *dao.File, site string) func() (io.ReadCloser, string, error) {
+	left := excludeSites(registry.rank(file.Sites), []string{site})
+	return func() (io.ReadCloser, string, error) {
+		for len(left) > 0 {
+			replica := *file
+			replica.Sites = left[:1]
+			left = left[1:]
+
+			r, err := newReplicaReader(username, &replica, 0)
+			if err == nil {
+				return r, r.site, nil
+			}
+		}
+
+		return nil, "", errNoReplica
+	}
+}
+
+// fileReader reads a file from any offset. The file is opened on the first
+// read, and opened again at the new offset if a read follows a seek.
+type fileReader struct {
+	username string
+	file     *dao.File
+	offset   int64
+
+	body io.ReadCloser
+	// pos is the offset body is at.
+	pos      int64
+	servedBy string
+}
+
+func newFileReader(username string, file *dao.File) *fileReader {
+	return &fileReader{username: username, file: file}
+}
+
+// open opens the file at the current offset.
+func (r *fileReader) open() error {
+	r.Close()
+
+	body, servedBy, err := openFile(r.username, r.file, r.offset)
+	if err != nil {
+		return err
+	}
+	r.body = body
+	r.pos = r.offset
+	r.servedBy = servedBy
+
+	return nil
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.offset >= r.file.Size {
+		return 0, io.EOF
+	}
+	if r.body == nil || r.pos != r.offset {
+		err := r.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	r.pos = r.offset
+	return n, err
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.file.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *fileReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// serveFile serves a file, answering Range and conditional requests. A
+// plain GET opens the file before responding, so that a file that can't be
+// read gets an error response, which is left to the caller, and the sites
+// serving it are reported in siteHeader.
+func serveFile(c *gin.Context, username string, file *dao.File) error {
+	r := newFileReader(username, file)
+	defer r.Close()
+
+	plain := c.Request.Method == http.MethodGet &&
+		c.GetHeader("Range") == "" &&
+		c.GetHeader("If-None-Match") == "" &&
+		c.GetHeader("If-Modified-Since") == ""
+	if plain {
+		err := r.open()
+		if err != nil {
+			return err
+		}
+		c.Header(siteHeader, r.servedBy)
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("ETag", fileETag(file))
+	if dg := digest(file); dg != "" {
+		c.Header("Digest", dg)
+	}
+	http.ServeContent(c.Writer, c.Request, file.Filename, time.Unix(file.LastModified, 0), r)
+
+	return nil
+}
+
+// fileETag returns the ETag of a file, which is the MD5 of its content. Files
+// stored without checksums get one derived from the stored object, with a
+// part count suffix like multipart S3 ETags so that clients don't take it
+// for the MD5.
+func fileETag(file *dao.File) string {
+	if file.MD5 != "" {
+		return `"` + file.MD5 + `"`
+	}
+
+	sum := md5.Sum([]byte(fmt.Sprintf("%v:%v:%v", file.Object, file.Size, file.LastModified)))
+	return `"` + hex.EncodeToString(sum[:]) + `-1"`
+}
+
+// removeFile deletes a file from all its sites and from the database. The
+// record is kept if any site fails, so that the deletion can be retried.
+func removeFile(username string, file *dao.File) error {
+	failed := removeObjects(objectFile(username, file))
+	if len(failed) > 0 {
+		return fmt.Errorf("delete %v from %v failed", file.Filename, failed)
+	}
+
+	return d.RemoveFile(username, file.Filename)
+}
+
+// removeObjects deletes the object of file from its sites and returns the
+// sites that failed. file.Object must be set.
+func removeObjects(file *dao.File) []string {
+	var failed []string
+	for _, site := range file.Sites {
+		resp, err := deleteFromSite(site, file.Object)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("unexpected status %v", resp.StatusCode)
+			}
+		}
+		if err != nil {
+			log.WithError(err).Errorf("delete %v in %v failed", file.Object, site)
+			failed = append(failed, site)
+		}
+	}
+
+	return failed
+}
+
+// objectFile returns a copy of file with its object name filled in.
+func objectFile(username string, file *dao.File) *dao.File {
+	f := *file
+	f.Object = objectName(username, file)
+	return &f
+}
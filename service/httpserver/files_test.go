@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// serveTestFile serves file of user u for a request with the given method
+// and headers.
+func serveTestFile(t *testing.T, file *dao.File, method string, header map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, "/f", nil)
+	for k, v := range header {
+		c.Request.Header.Set(k, v)
+	}
+
+	require.NoError(t, serveFile(c, "u", file))
+	// gin writes the header of responses without a body once the handler
+	// returns.
+	c.Writer.WriteHeaderNow()
+	return w
+}
+
+func TestServeFile(t *testing.T) {
+	sites, cleanup := newTestSites(t, testDataShards+testParityShards)
+	defer cleanup()
+
+	content := testContent(testStripeSize + 100)
+	sha := sha256.Sum256(content)
+	sum := md5.Sum(content)
+	checksum := func(file *dao.File) *dao.File {
+		file.SHA256 = hex.EncodeToString(sha[:])
+		file.MD5 = hex.EncodeToString(sum[:])
+		return file
+	}
+
+	sites[0].setObject("u/replicated", content)
+	files := map[string]*dao.File{
+		"replicated": checksum(&dao.File{Filename: "replicated", Size: int64(len(content)), Sites: []string{sites[0].name}}),
+		"erasure":    checksum(uploadErasure(t, sites, content, int64(len(content)))),
+	}
+	size := len(content)
+
+	tests := []struct {
+		name       string
+		method     string
+		header     map[string]string
+		wantStatus int
+		wantBody   []byte
+		wantRange  string
+	}{
+		{"plain", http.MethodGet, nil, http.StatusOK, content, ""},
+		{"head", http.MethodHead, nil, http.StatusOK, nil, ""},
+		{"range", http.MethodGet, map[string]string{"Range": "bytes=10-19"}, http.StatusPartialContent, content[10:20], fmt.Sprintf("bytes 10-19/%v", size)},
+		{"range across stripes", http.MethodGet, map[string]string{"Range": fmt.Sprintf("bytes=%v-%v", testStripeSize-5, testStripeSize+4)}, http.StatusPartialContent, content[testStripeSize-5 : testStripeSize+5], fmt.Sprintf("bytes %v-%v/%v", testStripeSize-5, testStripeSize+4, size)},
+		{"suffix range", http.MethodGet, map[string]string{"Range": "bytes=-5"}, http.StatusPartialContent, content[size-5:], fmt.Sprintf("bytes %v-%v/%v", size-5, size-1, size)},
+		{"unsatisfiable range", http.MethodGet, map[string]string{"Range": fmt.Sprintf("bytes=%v-", size)}, http.StatusRequestedRangeNotSatisfiable, nil, ""},
+		{"etag matches", http.MethodGet, map[string]string{"If-None-Match": `"` + hex.EncodeToString(sum[:]) + `"`}, http.StatusNotModified, nil, ""},
+		{"etag differs", http.MethodGet, map[string]string{"If-None-Match": `"other"`}, http.StatusOK, content, ""},
+	}
+	for name, file := range files {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				w := serveTestFile(t, file, tt.method, tt.header)
+				require.Equal(t, tt.wantStatus, w.Code)
+				require.Equal(t, fileETag(file), w.Header().Get("ETag"))
+				if tt.wantBody != nil {
+					require.Equal(t, tt.wantBody, w.Body.Bytes())
+				}
+				if tt.wantRange != "" {
+					require.Equal(t, tt.wantRange, w.Header().Get("Content-Range"))
+				}
+				if tt.wantStatus == http.StatusNotModified || tt.method == http.MethodHead {
+					require.Empty(t, w.Body.Bytes())
+				}
+			})
+		}
+	}
+
+	// A conditional request that is answered without content reads nothing.
+	sites[0].setObject("u/replicated", nil)
+	w := serveTestFile(t, files["replicated"], http.MethodGet, map[string]string{"If-None-Match": fileETag(files["replicated"])})
+	require.Equal(t, http.StatusNotModified, w.Code)
+}
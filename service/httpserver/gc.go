@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	log "github.com/sirupsen/logrus"
+)
+
+// Garbage collection lists the objects on every site and removes those no
+// file or staged part points to. Objects younger than the grace period are
+// left alone, as they may belong to uploads that are not recorded yet.
+
+// GC modes. Dry runs only report orphans, quarantine moves them under
+// quarantinePrefix and delete removes them, along with quarantined objects
+// that have outlived the grace period.
+const (
+	gcDryRun     = "dry-run"
+	gcQuarantine = "quarantine"
+	gcDelete     = "delete"
+)
+
+const (
+	// quarantinePrefix is where quarantined objects are moved to.
+	quarantinePrefix = ".quarantine/"
+	// maxGCReport is the number of orphans listed in the GC status.
+	maxGCReport = 1000
+)
+
+// orphan is an object no record points to.
+type orphan struct {
+	Site         string `json:"site"`
+	Object       string `json:"object"`
+	Size         int64  `json:"size"`
+	LastModified int64  `json:"last_modified"`
+	// Action is what has been done to the orphan, nothing in dry runs.
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// gcStatus is the progress of the current or last GC pass.
+type gcStatus struct {
+	Running  bool   `json:"running"`
+	Mode     string `json:"mode"`
+	Started  int64  `json:"started"`
+	Finished int64  `json:"finished"`
+	// Scanned is the number of objects listed so far.
+	Scanned int   `json:"scanned"`
+	Orphans int   `json:"orphans"`
+	Bytes   int64 `json:"bytes"`
+	Removed int   `json:"removed"`
+	Failed  int   `json:"failed"`
+	// Report holds the first maxGCReport orphans.
+	Report []orphan `json:"report"`
+	// Errors holds the sites that could not be listed.
+	Errors []string `json:"errors"`
+}
+
+// collector runs GC passes one at a time.
+type collector struct {
+	mu      sync.Mutex
+	status  gcStatus
+	trigger chan string
+}
+
+var orphans = &collector{trigger: make(chan string, 1)}
+
+// validGCMode reports whether mode is a GC mode.
+func validGCMode(mode string) bool {
+	return mode == gcDryRun || mode == gcQuarantine || mode == gcDelete
+}
+
+// run starts a pass in mode every interval, and a pass in the mode asked
+// for whenever one is triggered. Passes only run when triggered if interval
+// is 0.
+func (c *collector) run(interval time.Duration, mode string) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		m := mode
+		select {
+		case <-tick:
+		case m = <-c.trigger:
+		}
+		c.pass(m)
+	}
+}
+
+// start triggers a pass in mode, it returns false if one is already running
+// or about to.
+func (c *collector) start(mode string) bool {
+	c.mu.Lock()
+	running := c.status.Running
+	c.mu.Unlock()
+	if running {
+		return false
+	}
+
+	select {
+	case c.trigger <- mode:
+		return true
+	default:
+		return false
+	}
+}
+
+// pass collects the orphans of all sites.
+func (c *collector) pass(mode string) {
+	c.mu.Lock()
+	c.status = gcStatus{
+		Running: true,
+		Mode:    mode,
+		Started: time.Now().Unix(),
+	}
+	c.mu.Unlock()
+	log.Infof("gc pass started, mode %v", mode)
+
+	defer func() {
+		c.mu.Lock()
+		c.status.Running = false
+		c.status.Finished = time.Now().Unix()
+		log.Infof("gc pass finished: %v scanned, %v orphans, %v removed", c.status.Scanned, c.status.Orphans, c.status.Removed)
+		c.mu.Unlock()
+	}()
+
+	// Objects are listed after the records are read, so that an object
+	// recorded in between is young enough to be left alone.
+	known, err := knownObjects()
+	if err != nil {
+		c.siteFailed("", err)
+		return
+	}
+
+	before := time.Now().Add(-*gcGrace).Unix()
+	for _, site := range registry.list() {
+		objects, err := listOnSite(site, "")
+		if err != nil {
+			c.siteFailed(site, err)
+			continue
+		}
+
+		for _, obj := range objects {
+			c.scanned()
+			if known[siteObject{site, obj.Name}] || obj.LastModified > before {
+				continue
+			}
+			if strings.HasPrefix(obj.Name, quarantinePrefix) && mode != gcDelete {
+				continue
+			}
+
+			o := orphan{
+				Site:         site,
+				Object:       obj.Name,
+				Size:         obj.Size,
+				LastModified: obj.LastModified,
+			}
+			err = collect(&o, mode)
+			if err != nil {
+				o.Error = err.Error()
+				log.WithError(err).Errorf("%v orphan %v on %v", mode, obj.Name, site)
+			}
+			c.found(o)
+		}
+	}
+}
+
+// siteObject is an object on a site.
+type siteObject struct {
+	site   string
+	object string
+}
+
+// knownObjects returns the objects files and the staged parts of multipart
+// uploads from before point to.
+func knownObjects() (map[siteObject]bool, error) {
+	known := make(map[siteObject]bool)
+
+	usernames, err := d.GetUsernames()
+	if err != nil {
+		return nil, fmt.Errorf("list users: %v", err)
+	}
+	for _, username := range usernames {
+		files, err := d.GetUserFiles(username)
+		if err != nil {
+			return nil, fmt.Errorf("get %v's files: %v", username, err)
+		}
+		for i := range *files {
+			file := &(*files)[i]
+			for _, site := range file.Sites {
+				known[siteObject{site, objectName(username, file)}] = true
+			}
+		}
+	}
+
+	uploads, err := d.GetAllUploads()
+	if err != nil {
+		return nil, fmt.Errorf("list uploads: %v", err)
+	}
+	for _, upload := range uploads {
+		for _, part := range upload.Parts {
+			if part.Object != "" {
+				known[siteObject{part.Site, part.Object}] = true
+			}
+		}
+	}
+
+	return known, nil
+}
+
+// collect quarantines or deletes an orphan according to mode.
+func collect(o *orphan, mode string) error {
+	switch {
+	case mode == gcDryRun:
+		return nil
+	case mode == gcQuarantine:
+		o.Action = "quarantined"
+		err := copyOnSite(o.Site, o.Object, quarantinePrefix+o.Object)
+		if err != nil {
+			return err
+		}
+	default:
+		o.Action = "deleted"
+	}
+
+	failed := removeObjects(&dao.File{Object: o.Object, Sites: []string{o.Site}})
+	if len(failed) > 0 {
+		return fmt.Errorf("delete %v from %v failed", o.Object, o.Site)
+	}
+
+	return nil
+}
+
+// scanned counts a listed object.
+func (c *collector) scanned() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.status.Scanned++
+}
+
+// found counts an orphan.
+func (c *collector) found(o orphan) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.status.Orphans++
+	c.status.Bytes += o.Size
+	switch {
+	case o.Error != "":
+		c.status.Failed++
+	case o.Action != "":
+		c.status.Removed++
+	}
+	if len(c.status.Report) < maxGCReport {
+		c.status.Report = append(c.status.Report, o)
+	}
+}
+
+// siteFailed records a site that could not be listed, or a failure to read
+// the records if site is "".
+func (c *collector) siteFailed(site string, err error) {
+	if site != "" {
+		err = fmt.Errorf("%v: %v", site, err)
+	}
+	log.WithError(err).Errorln("gc failed")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.status.Errors = append(c.status.Errors, err.Error())
+}
+
+// snapshot returns a copy of the status.
+func (c *collector) snapshot() gcStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := c.status
+	status.Report = append([]orphan{}, c.status.Report...)
+	status.Errors = append([]string{}, c.status.Errors...)
+	return status
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGCKeepsKnownAndYoungObjects(t *testing.T) {
+	const username = "gc-test"
+	sites, cleanup := newTestSites(t, 1)
+	defer cleanup()
+	useTestDao(t, username)
+	require.Nil(t, d.SetUserStrategy(username, dao.Strategy{Sites: siteNames(sites), Replicas: 1}))
+
+	grace := *gcGrace
+	*gcGrace = time.Hour
+	defer func() { *gcGrace = grace }()
+	old := time.Now().Add(-2 * time.Hour)
+	site := sites[0]
+
+	file, _, err := storeFile(username, "f", bytes.NewReader(testContent(100)), 100)
+	require.Nil(t, err)
+	site.setModified(file.Object, old)
+	// Staged parts of multipart uploads from before are still referenced.
+	site.setObject("staged", []byte("part"))
+	site.setModified("staged", old)
+	upload := dao.Upload{
+		ID:       newID(),
+		Username: username,
+		Filename: "g",
+		Created:  time.Now().Unix(),
+		Parts:    []dao.Part{{Number: 1, Size: 4, ETag: "e", Site: site.name, Object: "staged"}},
+	}
+	require.Nil(t, d.CreateUpload(upload))
+	defer d.RemoveUpload(username, upload.ID)
+	site.setObject("young", []byte("young"))
+	site.setObject("orphan", []byte("orphan"))
+	site.setModified("orphan", old)
+
+	c := &collector{trigger: make(chan string, 1)}
+	c.pass(gcQuarantine)
+	status := c.snapshot()
+	require.Empty(t, status.Errors)
+	require.Equal(t, 1, status.Orphans)
+	require.Equal(t, "orphan", status.Report[0].Object)
+
+	for _, name := range []string{file.Object, "staged", "young", quarantinePrefix + "orphan"} {
+		_, ok := site.object(name)
+		require.True(t, ok, name)
+	}
+	_, ok := site.object("orphan")
+	require.False(t, ok)
+}
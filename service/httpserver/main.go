@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"flag"
 	"io/ioutil"
+	"time"
 
 	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/Sean-Pearce/jcs/service/httpserver/token"
 	pb "github.com/Sean-Pearce/jcs/service/scheduler/proto"
 	"github.com/Sean-Pearce/jcs/service/storage/client"
 	"github.com/gin-gonic/gin"
@@ -18,20 +20,35 @@ const (
 )
 
 var (
-	mongoURL      = flag.String("mongo", "mongodb://localhost:27017", "mongodb server address")
-	schedulerAddr = flag.String("sched", "localhost:5001", "scheduler address")
-	port          = flag.String("port", ":5000", "http server port")
-	config        = flag.String("config", "httpserver.json", "httpserver config file")
-	debug         = flag.Bool("debug", false, "debug mode")
-	testMode      = flag.Bool("test", false, "enable test mode")
-	tokenMap      map[string]string
-	clientMap     map[string]*client.StorageClient
-	clientList    []string
-	d             *dao.Dao
-	s             pb.SchedulerClient
+	mongoURL        = flag.String("mongo", "mongodb://localhost:27017", "mongodb server address")
+	schedulerAddr   = flag.String("sched", "localhost:5001", "scheduler address")
+	port            = flag.String("port", ":5000", "http server port")
+	s3Port          = flag.String("s3port", ":5003", "s3 gateway port, empty to disable")
+	config          = flag.String("config", "httpserver.json", "static storage sites config file, optional")
+	storageUser     = flag.String("storage-user", "", "storage account of discovered sites")
+	storagePassword = flag.String("storage-password", "", "storage password of discovered sites")
+	discovery       = flag.Duration("discovery", 10*time.Second, "interval of discovering sites through the scheduler")
+	repairInterval  = flag.Duration("repair", time.Hour, "interval of checking and repairing the redundancy of files, 0 to repair on demand only")
+	gcInterval      = flag.Duration("gc", 0, "interval of collecting orphan objects on the sites, 0 to collect on demand only")
+	gcMode          = flag.String("gc-mode", gcDryRun, "mode of periodic gc passes, dry-run, quarantine or delete")
+	gcGrace         = flag.Duration("gc-grace", 24*time.Hour, "age objects must reach before gc removes them")
+	minReplicas     = flag.Int("min-replicas", 1, "minimum number of copies a strategy may keep of a file")
+	maxReplicas     = flag.Int("max-replicas", 0, "maximum number of copies a strategy may keep of a file, 0 for no limit")
+	quotaMode       = flag.String("quota-mode", quotaLogical, "how files count against quotas, logical for their size or stored for all their replicas and shards")
+	debug           = flag.Bool("debug", false, "debug mode")
+	testMode        = flag.Bool("test", false, "enable test mode")
+	sessionStore    = flag.String("session", "memory", "session token store, memory or mongo")
+	sessionTTL      = flag.Duration("session-ttl", 24*time.Hour, "session token lifetime since last use")
+	uploadTTL       = flag.Duration("upload-ttl", 24*time.Hour, "time after which unused resumable and s3 multipart uploads are aborted, 0 to keep them")
+	tokens          token.Store
+	registry        *siteRegistry
+	d               *dao.Dao
+	s               pb.SchedulerClient
 )
 
-func init() {
+// setup connects to the database and the scheduler, it is not done in init
+// so that tests of the package run without them.
+func setup() {
 	flag.Parse()
 
 	if *debug {
@@ -48,26 +65,36 @@ func init() {
 		err = d.CreateNewUser(dao.User{
 			Username: "admin",
 			Password: "admin",
-			Role:     "admin",
+			Role:     roleAdmin,
 		})
 		if err != nil {
 			log.WithError(err).Warnln("create test user failed")
 		}
 	}
 
-	tokenMap = make(map[string]string)
-	clientMap = make(map[string]*client.StorageClient)
+	switch *sessionStore {
+	case "memory":
+		tokens = token.NewMemoryStore(*sessionTTL)
+	case "mongo":
+		tokens, err = token.NewMongoStore(*mongoURL, "jcs", "token", *sessionTTL)
+		if err != nil {
+			panic(err)
+		}
+	default:
+		log.Fatalf("unknown session store %v", *sessionStore)
+	}
 
 	var clients []client.StorageClient
 	data, err := ioutil.ReadFile(*config)
 	if err != nil {
-		panic(err)
-	}
-	json.Unmarshal(data, &clients)
-	for i := range clients {
-		clientMap[clients[i].Name] = &clients[i]
-		clientList = append(clientList, clients[i].Name)
+		log.WithError(err).Warnln("no static sites, relying on discovery")
+	} else {
+		err = json.Unmarshal(data, &clients)
+		if err != nil {
+			panic(err)
+		}
 	}
+	registry = newSiteRegistry(clients)
 
 	conn, err := grpc.Dial(*schedulerAddr, grpc.WithInsecure())
 	if err != nil {
@@ -78,8 +105,35 @@ func init() {
 }
 
 func main() {
+	setup()
 	log.Infoln("Starting httpserver", version)
 
+	go discoverSites(*discovery)
+	if !validGCMode(*gcMode) {
+		log.Fatalf("unknown gc mode %v", *gcMode)
+	}
+	if !validQuotaMode(*quotaMode) {
+		log.Fatalf("unknown quota mode %v", *quotaMode)
+	}
+
+	// Files embedded in user documents are moved to their own collection
+	// while the server runs, they are moved on access meanwhile.
+	go func() {
+		err := d.MigrateFiles()
+		if err != nil {
+			log.WithError(err).Errorln("migrate files")
+		}
+	}()
+	go repairs.run(*repairInterval)
+	go orphans.run(*gcInterval, *gcMode)
+	go expireUploads(*uploadTTL)
+
+	if *s3Port != "" {
+		go func() {
+			log.Fatalln(s3Router().Run(*s3Port))
+		}()
+	}
+
 	r := gin.Default()
 	r.POST("/api/user/login", login)
 
@@ -88,12 +142,42 @@ func main() {
 	r.GET("/api/user/info", info)
 	r.GET("/api/user/strategy", getStrategy)
 	r.POST("/api/user/strategy", setStrategy)
+	r.GET("/api/user/strategy/migration", getMigration)
 	r.POST("/api/user/logout", logout)
+	r.POST("/api/user/password", changePassword)
+	r.POST("/api/user/password/reset", adminOnly(), resetPassword)
+	r.GET("/api/user/keys", getKeys)
+	r.POST("/api/user/keys", createKeys)
 
 	r.GET("/api/storage/list", list)
 	r.GET("/api/storage/download", download)
 	r.POST("/api/storage/upload", upload)
-	r.DELETE("api/storage/delete/:filename", deleteFile)
+	r.DELETE("/api/storage/delete/*filename", deleteFile)
+	r.POST("/api/storage/dirs", createDir)
+	r.DELETE("/api/storage/dirs", deleteDir)
+	r.POST("/api/storage/move", move)
+	r.POST("/api/storage/uploads", createUpload)
+	r.GET("/api/storage/uploads", listUploads)
+	r.GET("/api/storage/uploads/:id", uploadStatus)
+	r.PUT("/api/storage/uploads/:id", putUploadChunk)
+	r.POST("/api/storage/uploads/:id/complete", completeUpload)
+	r.DELETE("/api/storage/uploads/:id", abortUpload)
+
+	r.GET("/api/admin/repair", adminOnly(), getRepairStatus)
+	r.POST("/api/admin/repair", adminOnly(), startRepair)
+	r.GET("/api/admin/gc", adminOnly(), getGCStatus)
+	r.POST("/api/admin/gc", adminOnly(), startGC)
+	r.GET("/api/admin/sites", adminOnly(), getSiteStats)
+	r.GET("/api/admin/quotas", adminOnly(), getQuotas)
+	r.PUT("/api/admin/quotas/roles/:role", adminOnly(), setRoleQuota)
+	r.PUT("/api/admin/quotas/users/:username", adminOnly(), setUserQuota)
+	r.DELETE("/api/admin/quotas/users/:username", adminOnly(), setUserQuota)
+	r.GET("/api/admin/users", adminOnly(), listUsers)
+	r.POST("/api/admin/users", adminOnly(), createUser)
+	r.PUT("/api/admin/users/:username/role", adminOnly(), setUserRole)
+	r.PUT("/api/admin/users/:username/disabled", adminOnly(), setUserDisabled)
+	r.DELETE("/api/admin/users/:username/disabled", adminOnly(), setUserDisabled)
+	r.DELETE("/api/admin/users/:username", adminOnly(), deleteUser)
 
 	r.Run(*port)
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	log "github.com/sirupsen/logrus"
+)
+
+// A migration moves the files of a user to the sites of the user's current
+// strategy. Replicated files are copied to the sites they are missing on and
+// removed from the sites dropped, erasure-coded files have their shards moved
+// one by one. Files whose layout changes, e.g. from replicas to erasure
+// coding, are stored anew.
+
+// Migration states of a file.
+const (
+	migrationPending   = "pending"
+	migrationMoving    = "moving"
+	migrationMoved     = "moved"
+	migrationUnchanged = "unchanged"
+	migrationFailed    = "failed"
+)
+
+// migration is the progress of moving the files of a user.
+type migration struct {
+	Running  bool  `json:"running"`
+	Started  int64 `json:"started"`
+	Finished int64 `json:"finished"`
+	Total    int   `json:"total"`
+	Moved    int   `json:"moved"`
+	Failed   int   `json:"failed"`
+	// Files holds the state of each file.
+	Files []migrationFile `json:"files"`
+
+	// stop is closed to stop the migration after the current file, done is
+	// closed once it has stopped.
+	stop chan struct{}
+	done chan struct{}
+}
+
+// migrationFile is the state of a file being migrated.
+type migrationFile struct {
+	Filename string   `json:"filename"`
+	State    string   `json:"state"`
+	Sites    []string `json:"sites,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// migrator holds the latest migration of each user.
+type migrator struct {
+	mu   sync.Mutex
+	jobs map[string]*migration
+}
+
+var migrations = &migrator{jobs: make(map[string]*migration)}
+
+// start starts migrating the files of a user. A migration already running
+// for the user is stopped, the new one goes on once it has.
+func (m *migrator) start(username string) {
+	job := &migration{
+		Running: true,
+		Started: time.Now().Unix(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	prev := m.jobs[username]
+	m.jobs[username] = job
+	m.mu.Unlock()
+
+	go func() {
+		defer close(job.done)
+		if prev != nil {
+			close(prev.stop)
+			<-prev.done
+		}
+		m.run(username, job)
+	}()
+}
+
+// run migrates the files of a user.
+func (m *migrator) run(username string, job *migration) {
+	defer func() {
+		m.mu.Lock()
+		job.Running = false
+		job.Finished = time.Now().Unix()
+		m.mu.Unlock()
+	}()
+
+	strategy, err := d.GetUserStrategy(username)
+	if err != nil {
+		log.WithError(err).Errorf("get %v's strategy for migration", username)
+		return
+	}
+	files, err := d.GetUserFiles(username)
+	if err != nil {
+		log.WithError(err).Errorf("get %v's files for migration", username)
+		return
+	}
+
+	m.mu.Lock()
+	job.Total = len(*files)
+	job.Files = make([]migrationFile, len(*files))
+	for i, file := range *files {
+		job.Files[i] = migrationFile{Filename: file.Filename, State: migrationPending}
+	}
+	m.mu.Unlock()
+
+	for i := range *files {
+		select {
+		case <-job.stop:
+			return
+		default:
+		}
+
+		file := &(*files)[i]
+		m.update(job, i, migrationFile{Filename: file.Filename, State: migrationMoving})
+		moved, err := migrateFile(username, strategy, file)
+		state := migrationFile{Filename: file.Filename, State: migrationUnchanged, Sites: moved.Sites}
+		switch {
+		case err != nil:
+			state.State = migrationFailed
+			state.Error = err.Error()
+			log.WithError(err).Errorf("migrate %v of %v", file.Filename, username)
+		case moved != file:
+			state.State = migrationMoved
+		}
+		m.update(job, i, state)
+	}
+}
+
+// update sets the state of the i-th file of job.
+func (m *migrator) update(job *migration, i int, state migrationFile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job.Files[i] = state
+	switch state.State {
+	case migrationMoved:
+		job.Moved++
+	case migrationFailed:
+		job.Failed++
+	}
+}
+
+// get returns a copy of the latest migration of a user, or nil if there is
+// none.
+func (m *migrator) get(username string) *migration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[username]
+	if !ok {
+		return nil
+	}
+
+	snapshot := *job
+	snapshot.Files = append([]migrationFile{}, job.Files...)
+	return &snapshot
+}
+
+// migrateFile moves a file to the sites strategy places it on. It returns
+// the file as it is now, which is file itself if nothing has changed.
+func migrateFile(username string, strategy *dao.Strategy, file *dao.File) (*dao.File, error) {
+	strategy = strategy.ForFile(file.Filename, file.Size)
+	switch {
+	case file.Erasure == nil && strategy.DataShards == 0:
+		return moveReplicas(username, strategy, file)
+	case file.Erasure != nil && strategy.DataShards == file.Erasure.DataShards && strategy.ParityShards == file.Erasure.ParityShards:
+		return moveShards(username, strategy, file)
+	default:
+		return rewriteFile(username, strategy, file)
+	}
+}
+
+// moveReplicas copies a replicated file to the scheduled sites it is not on
+// yet, then removes it from the sites that are not scheduled. Nothing is
+// removed unless all copies have been made.
+func moveReplicas(username string, strategy *dao.Strategy, file *dao.File) (*dao.File, error) {
+	scheduled, err := schedule(username, file.Filename, file.Size, strategy)
+	if err != nil {
+		return file, err
+	}
+
+	added := excludeSites(scheduled, file.Sites)
+	dropped := excludeSites(file.Sites, scheduled)
+	if len(added) == 0 && len(dropped) == 0 {
+		return file, nil
+	}
+
+	object := objectName(username, file)
+	var stored []string
+	if len(added) > 0 {
+		r, err := newReplicaReader(username, file, 0)
+		if err != nil {
+			return file, err
+		}
+		_, results, err := fanOut(verifyFile(r, file, r.site), object, file.Size, added)
+		r.Close()
+		if err != nil {
+			return file, err
+		}
+		stored = storedSites(results)
+	}
+
+	moved := *file
+	moved.Sites = append(excludeSites(file.Sites, dropped), stored...)
+	if len(stored) < len(added) {
+		moved.Sites = append(moved.Sites, dropped...)
+		dropped = nil
+		err = fmt.Errorf("copied to %v of %v sites", len(stored), len(added))
+	}
+	if len(stored) == 0 && len(dropped) == 0 {
+		return file, err
+	}
+
+	uerr := d.UpdateFileSites(username, *file, moved)
+	if uerr != nil {
+		return file, uerr
+	}
+	removeObjects(&dao.File{Object: object, Sites: dropped})
+
+	return &moved, err
+}
+
+// moveShards moves the shards of an erasure-coded file that are on sites
+// the strategy no longer places it on to sites it does.
+func moveShards(username string, strategy *dao.Strategy, file *dao.File) (*dao.File, error) {
+	e := file.Erasure
+	scheduled, err := schedule(username, file.Filename, file.Size, strategy)
+	if err != nil {
+		return file, err
+	}
+
+	free := excludeSites(scheduled, e.Shards)
+	object := objectName(username, file)
+	size := shardSize(file.Size, e.DataShards, e.BlockSize)
+
+	moved := *file
+	moved.Erasure = &dao.Erasure{
+		DataShards:   e.DataShards,
+		ParityShards: e.ParityShards,
+		BlockSize:    e.BlockSize,
+		Shards:       append([]string{}, e.Shards...),
+	}
+	var (
+		dropped []string
+		failed  int
+	)
+	for i, site := range e.Shards {
+		if site == "" || len(excludeSites([]string{site}, scheduled)) == 0 || len(free) == 0 {
+			continue
+		}
+
+		to := free[0]
+		err = copyObject(site, to, object, size)
+		if err != nil {
+			log.WithError(err).Errorf("move shard %v of %v from %v to %v", i, object, site, to)
+			failed++
+			continue
+		}
+		free = free[1:]
+		moved.Erasure.Shards[i] = to
+		dropped = append(dropped, site)
+	}
+	if len(dropped) == 0 {
+		if failed > 0 {
+			return file, fmt.Errorf("moving %v shards failed", failed)
+		}
+		return file, nil
+	}
+
+	moved.Sites = nil
+	for _, site := range moved.Erasure.Shards {
+		if site != "" {
+			moved.Sites = append(moved.Sites, site)
+		}
+	}
+	err = d.UpdateFileSites(username, *file, moved)
+	if err != nil {
+		return file, err
+	}
+	removeObjects(&dao.File{Object: object, Sites: dropped})
+
+	if failed > 0 {
+		return &moved, fmt.Errorf("moving %v shards failed", failed)
+	}
+	return &moved, nil
+}
+
+// copyObject copies an object of size bytes from one site to another.
+func copyObject(from, to, object string, size int64) error {
+	r, err := openObject(from, object, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	stored, _, err := uploadToSite(to, r, object, size)
+	if err != nil {
+		return err
+	}
+	if stored != size {
+		removeObjects(&dao.File{Object: object, Sites: []string{to}})
+		return fmt.Errorf("stored %v of %v bytes", stored, size)
+	}
+
+	return nil
+}
+
+// rewriteFile stores a file anew according to strategy, then removes the
+// old objects.
+func rewriteFile(username string, strategy *dao.Strategy, file *dao.File) (*dao.File, error) {
+	r, _, err := openFile(username, file, 0)
+	if err != nil {
+		return file, err
+	}
+	defer r.Close()
+
+	moved, _, err := placeFile(username, file.Filename, r, file.Size, strategy)
+	if err != nil {
+		return file, err
+	}
+	if moved.SHA256 != file.SHA256 && file.SHA256 != "" {
+		removeObjects(moved)
+		return file, errChecksumMismatch
+	}
+	if !storedEnough(moved) {
+		removeObjects(moved)
+		return file, errStorageFailed
+	}
+	moved.LastModified = file.LastModified
+
+	err = d.ReplaceFile(username, *file, *moved)
+	if err != nil {
+		removeObjects(moved)
+		return file, err
+	}
+	removeObjects(objectFile(username, file))
+
+	return moved, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateFileLayout(t *testing.T) {
+	const username = "migrate-test"
+	sites, cleanup := newTestSites(t, 3)
+	defer cleanup()
+	useTestDao(t, username)
+	require.Nil(t, d.SetUserStrategy(username, dao.Strategy{Sites: siteNames(sites), Replicas: 2}))
+
+	content := testContent(2*maxBlockSize + 100)
+	file, _, err := storeFile(username, "f", bytes.NewReader(content), int64(len(content)))
+	require.Nil(t, err)
+	require.Nil(t, file.Erasure)
+
+	// Replicas to erasure coding stores the file anew.
+	strategy := &dao.Strategy{Sites: siteNames(sites), DataShards: 2, ParityShards: 1}
+	moved, err := migrateFile(username, strategy, file)
+	require.Nil(t, err)
+	require.NotNil(t, moved.Erasure)
+	require.Equal(t, siteNames(sites), moved.Erasure.Shards)
+	require.NotEqual(t, file.Object, moved.Object)
+	require.Equal(t, file.SHA256, moved.SHA256)
+	require.Equal(t, file.LastModified, moved.LastModified)
+	for _, site := range sites {
+		_, ok := site.object(file.Object)
+		require.False(t, ok, site.name)
+		_, ok = site.object(moved.Object)
+		require.True(t, ok, site.name)
+	}
+
+	recorded, err := d.GetFileInfo(username, "f")
+	require.Nil(t, err)
+	require.Equal(t, moved, recorded)
+	r, _, err := openFile(username, recorded, 0)
+	require.Nil(t, err)
+	read, err := ioutil.ReadAll(r)
+	r.Close()
+	require.Nil(t, err)
+	require.Equal(t, content, read)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	log "github.com/sirupsen/logrus"
+)
+
+// Quota modes, how the bytes of a file count against a quota.
+const (
+	// quotaLogical counts the size of a file.
+	quotaLogical = "logical"
+	// quotaStored counts what a file takes up on its sites, all of its
+	// replicas or shards.
+	quotaStored = "stored"
+)
+
+// errQuotaExceeded is returned if a file would take a user beyond quota.
+var errQuotaExceeded = errors.New("quota exceeded")
+
+func validQuotaMode(mode string) bool {
+	return mode == quotaLogical || mode == quotaStored
+}
+
+// countedBytes returns the bytes of usage that count against a quota.
+func countedBytes(usage *dao.Usage) int64 {
+	if *quotaMode == quotaStored {
+		return usage.StoredBytes
+	}
+
+	return usage.Bytes
+}
+
+// storedSize estimates what a file of given size takes up on the sites it
+// is placed on under strategy.
+func storedSize(strategy *dao.Strategy, size int64) int64 {
+	if strategy.DataShards > 0 {
+		shard := (size + int64(strategy.DataShards) - 1) / int64(strategy.DataShards)
+		return shard * int64(strategy.DataShards+strategy.ParityShards)
+	}
+
+	return size * int64(replicaCount(strategy))
+}
+
+// fileBytes returns the bytes of a stored file that count against a quota.
+func fileBytes(file *dao.File) int64 {
+	if *quotaMode == quotaLogical {
+		return file.Size
+	}
+	if file.Erasure != nil {
+		shard := (file.Size + int64(file.Erasure.DataShards) - 1) / int64(file.Erasure.DataShards)
+		return shard * int64(len(file.Sites))
+	}
+
+	return file.Size * int64(len(file.Sites))
+}
+
+// Reservations of quota last reservationTTL unless they are renewed. A
+// reservation for a body of unknown size grows by reservationStep at least,
+// so that it isn't grown on every read.
+const (
+	reservationTTL  = 24 * time.Hour
+	reservationStep = 8 << 20
+)
+
+// A reservation holds quota for a file while it is being stored, so that
+// uploads running at the same time cannot together take a user beyond quota.
+// Quota is reserved first, then the usage and all reservations of the user
+// are checked, and what has been reserved is given back if they are beyond
+// quota. Of two uploads racing each sees the other, as a reservation is
+// released only once its file is recorded.
+type reservation struct {
+	id       string
+	username string
+	filename string
+	// bytes is what has been reserved through this reservation.
+	bytes   int64
+	renewed time.Time
+}
+
+// reserveQuota reserves quota for a file of given size stored under
+// strategy, the file of the same name, if any, is taken as replaced. A file
+// of unknown size, -1, has no bytes reserved up front. A new reservation is
+// made if id is empty. It returns nil if the user has no quota.
+func reserveQuota(id, username, filename string, size int64, strategy *dao.Strategy) (*reservation, error) {
+	quota, err := d.GetUserQuota(username)
+	if err != nil {
+		return nil, fmt.Errorf("get %v's quota: %v", username, err)
+	}
+	if quota.MaxBytes == 0 && quota.MaxFiles == 0 {
+		return nil, nil
+	}
+
+	if id == "" {
+		id = newID()
+	}
+	r := &reservation{id: id, username: username, filename: filename}
+	var bytes int64
+	if size > 0 {
+		bytes = countFunc(filename, size, strategy)(size)
+	}
+	err = r.add(bytes)
+	if err != nil {
+		r.release()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// openReservation returns the reservation of given id made for a file of
+// given user, so that it can grow. Nothing has been reserved through it. It
+// returns nil if the user has no quota.
+func openReservation(id, username, filename string) (*reservation, error) {
+	quota, err := d.GetUserQuota(username)
+	if err != nil {
+		return nil, fmt.Errorf("get %v's quota: %v", username, err)
+	}
+	if quota.MaxBytes == 0 && quota.MaxFiles == 0 {
+		return nil, nil
+	}
+
+	return &reservation{id: id, username: username, filename: filename}, nil
+}
+
+// add reserves n more bytes. It fails with errQuotaExceeded, the bytes given
+// back, if the user goes beyond quota.
+func (r *reservation) add(n int64) error {
+	now := time.Now()
+	err := d.Reserve(r.username, r.id, n, now.Add(reservationTTL))
+	if err != nil {
+		return fmt.Errorf("reserve quota of %v: %v", r.username, err)
+	}
+	r.bytes += n
+	r.renewed = now
+
+	err = r.check()
+	if err != nil {
+		r.shrink(n)
+	}
+	return err
+}
+
+// check returns errQuotaExceeded if the usage and the reservations of the
+// user are beyond quota. The reservations are read before the usage, so
+// that a file recorded and released in between is seen.
+func (r *reservation) check() error {
+	quota, err := d.GetUserQuota(r.username)
+	if err != nil {
+		return fmt.Errorf("get %v's quota: %v", r.username, err)
+	}
+	reservedFiles, reservedBytes, err := d.GetReserved(r.username, time.Now())
+	if err != nil {
+		return fmt.Errorf("get %v's reservations: %v", r.username, err)
+	}
+	usage, err := d.GetUserUsage(r.username)
+	if err != nil {
+		return fmt.Errorf("get %v's usage: %v", r.username, err)
+	}
+	files, used := usage.Files, countedBytes(usage)
+	old, err := d.GetFileInfo(r.username, r.filename)
+	if err == nil {
+		files--
+		used -= fileBytes(old)
+	} else if err != dao.ErrFileNotFound {
+		return fmt.Errorf("get file %v of %v: %v", r.filename, r.username, err)
+	}
+
+	if quota.MaxFiles > 0 && files+reservedFiles > quota.MaxFiles {
+		return errQuotaExceeded
+	}
+	if quota.MaxBytes > 0 && used+reservedBytes > quota.MaxBytes {
+		return errQuotaExceeded
+	}
+
+	return nil
+}
+
+// cover grows the reservation to bytes unless it holds that much already,
+// and renews it if it is about to expire.
+func (r *reservation) cover(bytes int64) error {
+	if bytes <= r.bytes {
+		if time.Since(r.renewed) < reservationTTL/2 {
+			return nil
+		}
+		return r.renew()
+	}
+
+	need := bytes - r.bytes
+	if need < reservationStep {
+		err := r.add(reservationStep)
+		if err != errQuotaExceeded {
+			return err
+		}
+	}
+	return r.add(need)
+}
+
+// renew has the reservation expire reservationTTL from now.
+func (r *reservation) renew() error {
+	now := time.Now()
+	err := d.Reserve(r.username, r.id, 0, now.Add(reservationTTL))
+	if err != nil {
+		return fmt.Errorf("renew quota reservation of %v: %v", r.username, err)
+	}
+	r.renewed = now
+
+	return nil
+}
+
+// shrink gives back n bytes of the reservation, failures are only logged as
+// the reservation expires anyway.
+func (r *reservation) shrink(n int64) {
+	if n == 0 {
+		return
+	}
+
+	err := d.Reserve(r.username, r.id, -n, r.renewed.Add(reservationTTL))
+	if err != nil {
+		log.WithError(err).Errorf("give back quota reserved for %v", r.username)
+		return
+	}
+	r.bytes -= n
+}
+
+// release removes the reservation, which is nil if there is none. Failures
+// are only logged as the reservation expires anyway.
+func (r *reservation) release() {
+	if r == nil {
+		return
+	}
+
+	err := d.RemoveReservation(r.username, r.id)
+	if err != nil {
+		log.WithError(err).Errorf("release quota reserved for %v", r.username)
+	}
+}
+
+// countFunc returns the function giving the bytes n bytes of a file of given
+// size count for under strategy.
+func countFunc(filename string, size int64, strategy *dao.Strategy) func(n int64) int64 {
+	if *quotaMode != quotaStored {
+		return func(n int64) int64 { return n }
+	}
+
+	strategy = strategy.ForFile(filename, size)
+	return func(n int64) int64 { return storedSize(strategy, n) }
+}
+
+// quotaReader grows res as bytes are read, it fails with errQuotaExceeded
+// once they count for more than the quota of the user allows, so that a
+// body of unknown size cannot go beyond quota.
+type quotaReader struct {
+	r     io.Reader
+	count func(n int64) int64
+	res   *reservation
+	// n is the number of bytes read.
+	n        int64
+	exceeded bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.n += int64(n)
+	if cerr := q.res.cover(q.count(q.n)); cerr != nil {
+		q.exceeded = cerr == errQuotaExceeded
+		return n, cerr
+	}
+
+	return n, err
+}
+
+// validateQuota checks the limits of a quota, it returns the problems found.
+func validateQuota(quota *dao.Quota) []fieldError {
+	var errs []fieldError
+	if quota.MaxBytes < 0 {
+		errs = append(errs, fieldError{"max_bytes", "must not be negative"})
+	}
+	if quota.MaxFiles < 0 {
+		errs = append(errs, fieldError{"max_files", "must not be negative"})
+	}
+
+	return errs
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReserveQuota(t *testing.T) {
+	const username = "quota-test"
+	useTestDao(t, username)
+	require.Nil(t, d.SetUserQuota(username, &dao.Quota{MaxBytes: 100, MaxFiles: 2}))
+	strategy := &dao.Strategy{}
+
+	a, err := reserveQuota("", username, "a", 60, strategy)
+	require.Nil(t, err)
+	_, err = reserveQuota("", username, "b", 60, strategy)
+	require.Equal(t, errQuotaExceeded, err)
+
+	// A file of unknown size grows its reservation as far as the quota
+	// allows.
+	b, err := reserveQuota("", username, "b", -1, strategy)
+	require.Nil(t, err)
+	require.Nil(t, b.cover(40))
+	require.Equal(t, int64(40), b.bytes)
+	require.Equal(t, errQuotaExceeded, b.cover(41))
+	require.Equal(t, int64(40), b.bytes)
+
+	// Every reservation counts as a file.
+	_, err = reserveQuota("", username, "c", 0, strategy)
+	require.Equal(t, errQuotaExceeded, err)
+
+	a.release()
+	c, err := reserveQuota("", username, "c", 60, strategy)
+	require.Nil(t, err)
+	b.release()
+	c.release()
+
+	// A body read through a reservation fails once it is beyond quota.
+	res, err := reserveQuota("", username, "d", -1, strategy)
+	require.Nil(t, err)
+	limited := &quotaReader{r: bytes.NewReader(make([]byte, 150)), count: func(n int64) int64 { return n }, res: res}
+	_, err = ioutil.ReadAll(limited)
+	require.Equal(t, errQuotaExceeded, err)
+	require.True(t, limited.exceeded)
+	res.release()
+
+	// Reservations are not held for users without a quota.
+	require.Nil(t, d.SetUserQuota(username, &dao.Quota{}))
+	res, err = reserveQuota("", username, "e", 1000, strategy)
+	require.Nil(t, err)
+	require.Nil(t, res)
+}
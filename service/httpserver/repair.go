@@ -0,0 +1,512 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/klauspost/reedsolomon"
+	log "github.com/sirupsen/logrus"
+)
+
+// The reconciler walks all files, checks which of their sites still hold
+// them and copies them again where copies or shards are lost, so that files
+// keep the redundancy their owners' strategies ask for.
+
+// maxRepairErrors is the number of failures kept in the repair status.
+const maxRepairErrors = 100
+
+// repairStatus is the progress of the current or last repair pass.
+type repairStatus struct {
+	Running  bool  `json:"running"`
+	Started  int64 `json:"started"`
+	Finished int64 `json:"finished"`
+	// Checked is the number of files checked so far, each of which is
+	// healthy, repaired or failed.
+	Checked  int `json:"checked"`
+	Healthy  int `json:"healthy"`
+	Repaired int `json:"repaired"`
+	Failed   int `json:"failed"`
+	// Errors holds the first maxRepairErrors failures.
+	Errors []repairError `json:"errors"`
+}
+
+// repairError is a file that could not be checked or repaired.
+type repairError struct {
+	Username string `json:"username"`
+	Filename string `json:"filename,omitempty"`
+	Error    string `json:"error"`
+}
+
+// reconciler runs repair passes one at a time.
+type reconciler struct {
+	mu      sync.Mutex
+	status  repairStatus
+	trigger chan struct{}
+	// suspects are the sites of replicated files that served content not
+	// matching the checksum, by user and file. They are taken as lost by
+	// the next repair of the file, as the size and MD5 they report may not
+	// tell.
+	suspects map[string]map[string]map[string]bool
+}
+
+var repairs = &reconciler{
+	trigger:  make(chan struct{}, 1),
+	suspects: make(map[string]map[string]map[string]bool),
+}
+
+// run starts a pass every interval and whenever one is triggered. Passes
+// only run when triggered if interval is 0.
+func (r *reconciler) run(interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+		case <-r.trigger:
+		}
+		r.pass()
+	}
+}
+
+// start triggers a pass, it returns false if one is already running or
+// about to.
+func (r *reconciler) start() bool {
+	r.mu.Lock()
+	running := r.status.Running
+	r.mu.Unlock()
+	if running {
+		return false
+	}
+
+	select {
+	case r.trigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// pass checks and repairs the files of all users.
+func (r *reconciler) pass() {
+	r.mu.Lock()
+	r.status = repairStatus{
+		Running: true,
+		Started: time.Now().Unix(),
+	}
+	r.mu.Unlock()
+	log.Infoln("repair pass started")
+
+	defer func() {
+		r.mu.Lock()
+		r.status.Running = false
+		r.status.Finished = time.Now().Unix()
+		log.Infof("repair pass finished: %v checked, %v repaired, %v failed", r.status.Checked, r.status.Repaired, r.status.Failed)
+		r.mu.Unlock()
+	}()
+
+	usernames, err := d.GetUsernames()
+	if err != nil {
+		log.WithError(err).Errorln("list users for repair")
+		return
+	}
+
+	for _, username := range usernames {
+		strategy, err := d.GetUserStrategy(username)
+		if err != nil {
+			r.fail(username, "", err)
+			continue
+		}
+		files, err := d.GetUserFiles(username)
+		if err != nil {
+			r.fail(username, "", err)
+			continue
+		}
+
+		for i := range *files {
+			file := &(*files)[i]
+			repaired, err := repairFile(username, strategy, file)
+			r.record(username, file.Filename, repaired, err)
+		}
+	}
+}
+
+// record counts a checked file.
+func (r *reconciler) record(username, filename string, repaired bool, err error) {
+	if err != nil {
+		r.fail(username, filename, err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status.Checked++
+	if repaired {
+		r.status.Repaired++
+	} else {
+		r.status.Healthy++
+	}
+}
+
+// fail counts a file that failed, an empty filename stands for all files of
+// the user.
+func (r *reconciler) fail(username, filename string, err error) {
+	log.WithError(err).Errorf("repair %v of %v", filename, username)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if filename != "" {
+		r.status.Checked++
+	}
+	r.status.Failed++
+	if len(r.status.Errors) < maxRepairErrors {
+		r.status.Errors = append(r.status.Errors, repairError{
+			Username: username,
+			Filename: filename,
+			Error:    err.Error(),
+		})
+	}
+}
+
+// snapshot returns a copy of the status.
+func (r *reconciler) snapshot() repairStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status
+	status.Errors = append([]repairError{}, r.status.Errors...)
+	return status
+}
+
+// suspect queues the copy of a file on site for repair.
+func (r *reconciler) suspect(username, filename, site string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files, ok := r.suspects[username]
+	if !ok {
+		files = make(map[string]map[string]bool)
+		r.suspects[username] = files
+	}
+	if files[filename] == nil {
+		files[filename] = make(map[string]bool)
+	}
+	files[filename][site] = true
+}
+
+// isSuspect reports whether the copy of a file on site is queued for repair.
+func (r *reconciler) isSuspect(username, filename, site string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.suspects[username][filename][site]
+}
+
+// cleared drops the copies of a file on sites from the queue once they have
+// been written again.
+func (r *reconciler) cleared(username, filename string, sites []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files := r.suspects[username]
+	for _, site := range sites {
+		delete(files[filename], site)
+	}
+	if len(files[filename]) == 0 {
+		delete(files, filename)
+	}
+	if len(files) == 0 {
+		delete(r.suspects, username)
+	}
+}
+
+// siteState is the state of a copy or shard on a site.
+type siteState int
+
+const (
+	siteOK siteState = iota
+	// siteMissing is a site that is up but lacks the object, or holds a
+	// damaged one.
+	siteMissing
+	// siteUnreachable is a site that can't tell.
+	siteUnreachable
+)
+
+// checkObject checks that site holds object of size bytes. The MD5 is
+// checked as well if it is known and the site reports an ETag that is one.
+func checkObject(site, object string, size int64, md5 string) siteState {
+	info, err := statOnSite(site, object)
+	if err == errObjectNotFound {
+		return siteMissing
+	}
+	if err != nil {
+		log.WithError(err).Warnf("stat %v on %v", object, site)
+		return siteUnreachable
+	}
+
+	etag := strings.Trim(info.ETag, `"`)
+	if info.Size != size || md5 != "" && !strings.Contains(etag, "-") && etag != md5 {
+		log.Errorf("%v on %v has size %v and etag %v, want %v and %v", object, site, info.Size, etag, size, md5)
+		return siteMissing
+	}
+
+	return siteOK
+}
+
+// repairFile restores the redundancy of a file. It returns whether the file
+// had to be repaired, and an error if it is still short of copies or shards.
+func repairFile(username string, strategy *dao.Strategy, file *dao.File) (bool, error) {
+	strategy = strategy.ForFile(file.Filename, file.Size)
+	if file.Erasure != nil {
+		return repairShards(username, strategy, file)
+	}
+
+	return repairReplicas(username, strategy, file)
+}
+
+// repairReplicas copies a replicated file to the sites it has been lost on,
+// and to new sites of the strategy until there are as many copies as the
+// strategy places. Unreachable sites are dropped once there are enough
+// copies without them.
+func repairReplicas(username string, strategy *dao.Strategy, file *dao.File) (bool, error) {
+	object := objectName(username, file)
+
+	var ok, missing, unreachable []string
+	for _, site := range file.Sites {
+		state := checkObject(site, object, file.Size, file.MD5)
+		if state == siteOK && repairs.isSuspect(username, file.Filename, site) {
+			state = siteMissing
+		}
+		switch state {
+		case siteOK:
+			ok = append(ok, site)
+		case siteMissing:
+			missing = append(missing, site)
+		case siteUnreachable:
+			unreachable = append(unreachable, site)
+		}
+	}
+
+	want := len(file.Sites)
+	var spare []string
+	scheduled, err := schedule(username, file.Filename, file.Size, strategy)
+	if err != nil {
+		log.WithError(err).Warnf("schedule repair of %v of %v", file.Filename, username)
+	} else {
+		want = len(scheduled)
+		spare = excludeSites(scheduled, file.Sites)
+	}
+
+	targets := missing
+	for _, site := range spare {
+		if len(ok)+len(targets) >= want {
+			break
+		}
+		targets = append(targets, site)
+	}
+	if len(targets) == 0 && (len(unreachable) == 0 || len(ok) < want) {
+		if len(ok) < want {
+			return false, fmt.Errorf("%v of %v copies intact", len(ok), want)
+		}
+		return false, nil
+	}
+	if len(ok) == 0 {
+		return false, fmt.Errorf("no intact copy left")
+	}
+
+	var stored []string
+	if len(targets) > 0 {
+		src := *file
+		src.Sites = ok
+		r, err := newReplicaReader(username, &src, 0)
+		if err != nil {
+			return false, err
+		}
+		_, results, err := fanOut(verifyFile(r, file, r.site), object, file.Size, targets)
+		r.Close()
+		if err != nil {
+			return false, err
+		}
+		stored = storedSites(results)
+		repairs.cleared(username, file.Filename, stored)
+	}
+
+	repaired := *file
+	repaired.Sites = append(ok, stored...)
+	if len(repaired.Sites) < want {
+		repaired.Sites = append(repaired.Sites, unreachable...)
+	}
+	err = d.UpdateFileSites(username, *file, repaired)
+	if err != nil {
+		return false, err
+	}
+	log.Infof("repaired %v of %v, sites are %v", file.Filename, username, repaired.Sites)
+
+	if len(ok)+len(stored) < want {
+		return true, fmt.Errorf("%v of %v copies intact", len(ok)+len(stored), want)
+	}
+	return true, nil
+}
+
+// repairShards rebuilds the lost shards of an erasure-coded file from the
+// others. A shard is rebuilt on its site if the site is up, and on a site of
+// the strategy that holds no other shard otherwise.
+func repairShards(username string, strategy *dao.Strategy, file *dao.File) (bool, error) {
+	e := file.Erasure
+	object := objectName(username, file)
+	size := shardSize(file.Size, e.DataShards, e.BlockSize)
+
+	states := make([]siteState, len(e.Shards))
+	intact := 0
+	for i, site := range e.Shards {
+		if site == "" {
+			states[i] = siteUnreachable
+			continue
+		}
+		states[i] = checkObject(site, object, size, "")
+		if states[i] == siteOK {
+			intact++
+		}
+	}
+	if intact == len(e.Shards) {
+		return false, nil
+	}
+	if intact < e.DataShards {
+		return false, fmt.Errorf("%v of %v shards intact, %v needed", intact, len(e.Shards), e.DataShards)
+	}
+
+	used := make(map[string]bool)
+	for _, site := range e.Shards {
+		used[site] = true
+	}
+	candidates := strategy.Sites
+	if len(candidates) == 0 {
+		candidates = registry.list()
+	}
+	candidates = registry.rank(candidates)
+
+	targets := make([]string, len(e.Shards))
+	for i, state := range states {
+		switch state {
+		case siteMissing:
+			targets[i] = e.Shards[i]
+		case siteUnreachable:
+			for _, site := range candidates {
+				if !used[site] {
+					targets[i] = site
+					used[site] = true
+					break
+				}
+			}
+		}
+	}
+
+	// Only intact shards are read, lost ones are reconstructed.
+	src := *file
+	src.Erasure = &dao.Erasure{
+		DataShards:   e.DataShards,
+		ParityShards: e.ParityShards,
+		BlockSize:    e.BlockSize,
+		Shards:       make([]string, len(e.Shards)),
+	}
+	for i, state := range states {
+		if state == siteOK {
+			src.Erasure.Shards[i] = e.Shards[i]
+		}
+	}
+
+	w := &fanOutWriter{uploads: make([]*siteUpload, len(e.Shards)), min: 1}
+	var (
+		uploads []*siteUpload
+		rebuilt []int
+	)
+	for i, target := range targets {
+		if target == "" {
+			w.uploads[i] = &siteUpload{werr: errSiteClosed}
+			continue
+		}
+		w.uploads[i] = startSiteUpload(target, object, size)
+		uploads = append(uploads, w.uploads[i])
+		rebuilt = append(rebuilt, i)
+	}
+	if len(uploads) == 0 {
+		return false, fmt.Errorf("%v of %v shards intact, no site to rebuild on", intact, len(e.Shards))
+	}
+
+	enc, err := reedsolomon.New(e.DataShards, e.ParityShards)
+	if err != nil {
+		return false, err
+	}
+	r, err := newErasureReader(username, &src, 0)
+	if err == nil {
+		var stored int64
+		_, stored, err = encodeStripes(verifyFile(r, file, strings.Join(r.sites(), ",")), enc, w, e.DataShards, e.ParityShards, e.BlockSize)
+		r.Close()
+		if err == nil && stored != size {
+			err = fmt.Errorf("rebuilt %v of %v bytes", stored, size)
+		}
+	}
+	results := finishUploads(uploads, err, object, size)
+	if err != nil && err != errTooFewSites {
+		return false, err
+	}
+
+	repaired := *file
+	repaired.Erasure = &dao.Erasure{
+		DataShards:   e.DataShards,
+		ParityShards: e.ParityShards,
+		BlockSize:    e.BlockSize,
+		Shards:       append([]string{}, e.Shards...),
+	}
+	for j, i := range rebuilt {
+		switch {
+		case results[j].Error == "":
+			repaired.Erasure.Shards[i] = targets[i]
+			intact++
+		case states[i] == siteMissing:
+			repaired.Erasure.Shards[i] = ""
+		}
+	}
+	repaired.Sites = nil
+	for _, site := range repaired.Erasure.Shards {
+		if site != "" {
+			repaired.Sites = append(repaired.Sites, site)
+		}
+	}
+	err = d.UpdateFileSites(username, *file, repaired)
+	if err != nil {
+		return false, err
+	}
+	log.Infof("repaired %v of %v, shards are %v", file.Filename, username, repaired.Erasure.Shards)
+
+	if intact < len(e.Shards) {
+		return true, fmt.Errorf("%v of %v shards intact", intact, len(e.Shards))
+	}
+	return true, nil
+}
+
+// excludeSites returns the sites not in exclude.
+func excludeSites(sites, exclude []string) []string {
+	excluded := make(map[string]bool)
+	for _, site := range exclude {
+		excluded[site] = true
+	}
+
+	var left []string
+	for _, site := range sites {
+		if !excluded[site] {
+			left = append(left, site)
+		}
+	}
+
+	return left
+}
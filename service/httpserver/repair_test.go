@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepairFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy dao.Strategy
+		// lost is the site whose copy or shard is deleted.
+		lost int
+	}{
+		{"missing replica", dao.Strategy{Replicas: 2}, 1},
+		{"lost shard", dao.Strategy{DataShards: 2, ParityShards: 1}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const username = "repair-test"
+			sites, cleanup := newTestSites(t, 3)
+			defer cleanup()
+			useTestDao(t, username)
+			strategy := tt.strategy
+			strategy.Sites = siteNames(sites)
+			require.Nil(t, d.SetUserStrategy(username, strategy))
+
+			content := testContent(3*maxBlockSize + 100)
+			file, _, err := storeFile(username, "f", bytes.NewReader(content), int64(len(content)))
+			require.Nil(t, err)
+			lost := sites[tt.lost]
+			stored, ok := lost.object(file.Object)
+			require.True(t, ok)
+			lost.setObject(file.Object, nil)
+
+			repaired, err := repairFile(username, &strategy, file)
+			require.Nil(t, err)
+			require.True(t, repaired)
+			rebuilt, ok := lost.object(file.Object)
+			require.True(t, ok)
+			require.Equal(t, stored, rebuilt)
+
+			file, err = d.GetFileInfo(username, "f")
+			require.Nil(t, err)
+			repaired, err = repairFile(username, &strategy, file)
+			require.Nil(t, err)
+			require.False(t, repaired)
+
+			r, _, err := openFile(username, file, 0)
+			require.Nil(t, err)
+			read, err := ioutil.ReadAll(r)
+			r.Close()
+			require.Nil(t, err)
+			require.Equal(t, content, read)
+		})
+	}
+}
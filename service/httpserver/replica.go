@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"io"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	log "github.com/sirupsen/logrus"
+)
+
+// siteHeader is the response header naming the sites serving a download.
+const siteHeader = "X-JCS-Site"
+
+var errNoReplica = errors.New("no replica available")
+
+// replicaReader reads a replicated file from the best site, failing over to
+// the next replica if a site fails, even in the middle of the file.
+type replicaReader struct {
+	filename string
+	size     int64
+	// sites are the replicas not tried yet, best first.
+	sites []string
+
+	site   string
+	body   io.ReadCloser
+	offset int64
+}
+
+// newReplicaReader opens the best available replica of file at offset.
+func newReplicaReader(username string, file *dao.File, offset int64) (*replicaReader, error) {
+	r := &replicaReader{
+		filename: objectName(username, file),
+		size:     file.Size,
+		sites:    registry.rank(file.Sites),
+		offset:   offset,
+	}
+
+	err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// next opens the next replica at the current offset.
+func (r *replicaReader) next() error {
+	for len(r.sites) > 0 {
+		site := r.sites[0]
+		r.sites = r.sites[1:]
+
+		body, err := openObject(site, r.filename, r.offset)
+		if err != nil {
+			log.WithError(err).Errorf("open %v on %v", r.filename, site)
+			continue
+		}
+
+		if r.site != "" {
+			log.Warnf("download %v fails over from %v to %v at %v", r.filename, r.site, site, r.offset)
+		}
+		r.site = site
+		r.body = body
+		return nil
+	}
+
+	return errNoReplica
+}
+
+func (r *replicaReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF && r.offset < r.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		log.WithError(err).Errorf("read %v from %v at %v", r.filename, r.site, r.offset)
+		registry.observe(r.site, 0, err)
+		r.body.Close()
+		if r.next() != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *replicaReader) Close() error {
+	return r.body.Close()
+}
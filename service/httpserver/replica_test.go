@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicaReaderFailover(t *testing.T) {
+	sites, cleanup := newTestSites(t, 3)
+	defer cleanup()
+
+	content := testContent(100000)
+	for _, s := range sites {
+		s.setObject("u/f", content)
+	}
+	file := &dao.File{Filename: "f", Size: int64(len(content)), Sites: siteNames(sites)}
+
+	tests := []struct {
+		name      string
+		failAfter []int64
+		offset    int64
+		wantErr   bool
+	}{
+		{"healthy", []int64{-1, -1, -1}, 0, false},
+		{"first fails partway", []int64{1000, -1, -1}, 0, false},
+		{"two fail partway", []int64{1000, 50000, -1}, 0, false},
+		{"first fails before offset", []int64{1000, -1, -1}, 20000, false},
+		{"from offset", []int64{30000, 70000, -1}, 20000, false},
+		{"all fail partway", []int64{1000, 2000, 3000}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, s := range sites {
+				s.setFailAfter(tt.failAfter[i])
+			}
+			// Failures of earlier cases must not reorder the sites.
+			resetRegistry(sites)
+
+			r, err := newReplicaReader("u", file, tt.offset)
+			if err != nil {
+				require.True(t, tt.wantErr)
+				return
+			}
+			got, err := ioutil.ReadAll(r)
+			require.NoError(t, r.Close())
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, content[tt.offset:], got)
+		})
+	}
+}
+
+func TestReplicaReaderMissing(t *testing.T) {
+	sites, cleanup := newTestSites(t, 2)
+	defer cleanup()
+
+	content := testContent(1000)
+	sites[1].setObject("u/f", content)
+	file := &dao.File{Filename: "f", Size: int64(len(content)), Sites: siteNames(sites)}
+
+	r, err := newReplicaReader("u", file, 0)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+	require.Equal(t, sites[1].name, r.site)
+
+	sites[1].setObject("u/f", nil)
+	_, err = newReplicaReader("u", file, 0)
+	require.Equal(t, errNoReplica, err)
+}
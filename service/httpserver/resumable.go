@@ -0,0 +1,603 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/Sean-Pearce/jcs/service/storage/client"
+	"github.com/klauspost/reedsolomon"
+	log "github.com/sirupsen/logrus"
+)
+
+// Resumable uploads receive a file in chunks. Each chunk becomes a part of a
+// multipart upload on every site the file goes to, so that a failed chunk
+// is all that needs to be sent again.
+
+// sessionChunkSize is the size of chunks of replicated files. Erasure-coded
+// files take chunks of DataShards times this, so that every shard gets parts
+// of this size. It is a multiple of maxBlockSize and above the 5 MiB that
+// multipart uploads require of all but the last part.
+const sessionChunkSize = 8 << 20
+
+// sessionLeaseTTL is how long a request may work on an upload session before
+// another may take it over.
+const sessionLeaseTTL = 15 * time.Minute
+
+// uploadSweepInterval is the interval of aborting upload sessions and
+// multipart uploads that have not been used for longer than their TTL.
+const uploadSweepInterval = time.Hour
+
+var (
+	// errOffsetMismatch is returned if a chunk is not at the offset the
+	// session is at.
+	errOffsetMismatch = errors.New("offset mismatch")
+	// errChunkSize is returned if a chunk is not of the size of the session.
+	errChunkSize = errors.New("invalid chunk size")
+	// errSessionIncomplete is returned if a session is completed before the
+	// whole file is received.
+	errSessionIncomplete = errors.New("upload session incomplete")
+)
+
+// createSession schedules a file of given size and starts multipart uploads
+// on its sites.
+func createSession(username, filename string, size int64) (*dao.UploadSession, error) {
+	err := checkFilePath(username, filename)
+	if err != nil {
+		return nil, err
+	}
+	strategy, err := d.GetUserStrategy(username)
+	if err != nil {
+		return nil, fmt.Errorf("get %v's strategy: %v", username, err)
+	}
+	// The quota is reserved for the session until it is completed or
+	// aborted.
+	id := newID()
+	res, err := reserveQuota(id, username, filename, size, strategy)
+	if err != nil {
+		return nil, err
+	}
+	created := false
+	defer func() {
+		if !created {
+			res.release()
+		}
+	}()
+	strategy = strategy.ForFile(filename, size)
+
+	sites, err := schedule(username, filename, size, strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	session := &dao.UploadSession{
+		ID:        id,
+		Username:  username,
+		Filename:  filename,
+		Object:    newObjectName(username),
+		Size:      size,
+		ChunkSize: sessionChunkSize,
+		Created:   now,
+		Updated:   now,
+	}
+	if strategy.DataShards > 0 {
+		if len(sites) != strategy.DataShards+strategy.ParityShards {
+			return nil, fmt.Errorf("%v sites for %v shards", len(sites), strategy.DataShards+strategy.ParityShards)
+		}
+		session.ChunkSize *= int64(strategy.DataShards)
+		session.Erasure = &dao.Erasure{
+			DataShards:   strategy.DataShards,
+			ParityShards: strategy.ParityShards,
+			BlockSize:    blockSize(size, strategy.DataShards),
+			Shards:       sites,
+		}
+	}
+
+	session.Targets = startTargets(sites, session.Object)
+	if liveTargets(session.Targets) < minTargets(session.Erasure) {
+		abortTargets(session.Targets, session.Object)
+		return nil, errStorageFailed
+	}
+
+	err = d.CreateUploadSession(*session)
+	if err != nil {
+		abortTargets(session.Targets, session.Object)
+		return nil, fmt.Errorf("create upload session for %v: %v", username, err)
+	}
+	created = true
+
+	return session, nil
+}
+
+// startTargets starts multipart uploads of object on sites. Sites that fail
+// to start one are marked as failed.
+func startTargets(sites []string, object string) []dao.Target {
+	targets := make([]dao.Target, len(sites))
+	for i, site := range sites {
+		var err error
+		targets[i].Site = site
+		targets[i].UploadID, err = initMultipartOnSite(site, object)
+		if err != nil {
+			log.WithError(err).Errorf("init upload of %v on %v", object, site)
+			targets[i].Failed = true
+		}
+	}
+
+	return targets
+}
+
+// liveTargets returns the number of targets that have not failed.
+func liveTargets(targets []dao.Target) int {
+	live := 0
+	for _, target := range targets {
+		if !target.Failed {
+			live++
+		}
+	}
+
+	return live
+}
+
+// minTargets returns the number of targets an upload needs to go on.
+func minTargets(e *dao.Erasure) int {
+	if e != nil {
+		return e.DataShards
+	}
+
+	return 1
+}
+
+// putChunk uploads the chunk of session at offset, which must be the offset
+// the session is at. length is the length of the chunk. The session is
+// leased while the chunk is uploaded, so that a chunk sent twice at the same
+// time is uploaded once.
+func putChunk(session *dao.UploadSession, offset int64, body io.Reader, length int64) error {
+	if offset != session.Offset {
+		return errOffsetMismatch
+	}
+
+	want := session.ChunkSize
+	if session.Size-offset < want {
+		want = session.Size - offset
+	}
+	if want == 0 || length != want {
+		return errChunkSize
+	}
+
+	err := leaseSession(session)
+	if err != nil {
+		return err
+	}
+	err = uploadChunk(session, offset, body, length)
+
+	// Failed targets are recorded even if the chunk is lost.
+	session.Updated = time.Now().Unix()
+	uerr := d.UpdateUploadSession(*session)
+	if uerr != nil {
+		return uerr
+	}
+
+	return err
+}
+
+// uploadChunk uploads a chunk of length bytes at offset to the targets of
+// session and moves the session on past it. Targets that fail are marked as
+// failed.
+func uploadChunk(session *dao.UploadSession, offset int64, body io.Reader, length int64) error {
+	err := sessionReservation(session).renew()
+	if err != nil {
+		return err
+	}
+	h, err := sessionHash(session)
+	if err != nil {
+		return fmt.Errorf("restore hash of session %v: %v", session.ID, err)
+	}
+	body = io.TeeReader(io.LimitReader(body, length), h)
+
+	number := int(offset/session.ChunkSize) + 1
+	etags, err := putPart(session.Targets, session.Object, session.Erasure, number, body, length)
+	if err != nil && err != errStorageFailed {
+		return err
+	}
+	for i, etag := range etags {
+		if etag != "" {
+			target := &session.Targets[i]
+			target.Parts = putTargetPart(target.Parts, dao.TargetPart{Number: number, ETag: etag})
+		}
+	}
+
+	if err == nil {
+		err = h.save(session)
+	}
+	if err == nil {
+		session.Offset += length
+	}
+
+	return err
+}
+
+// putPart uploads length bytes of body as part number of the multipart
+// uploads of object on targets, erasure coded if e is set. It returns the
+// etag of the part on each target, "" for targets that have failed. Targets
+// that fail are marked as failed and their uploads aborted.
+func putPart(targets []dao.Target, object string, e *dao.Erasure, number int, body io.Reader, length int64) ([]string, error) {
+	body = io.LimitReader(body, length)
+	partSize := length
+	if e != nil {
+		partSize = shardSize(length, e.DataShards, e.BlockSize)
+	}
+
+	etags := make([]string, len(targets))
+	uploads := make([]*siteUpload, 0, len(targets))
+	live := make([]int, 0, len(targets))
+	for i, target := range targets {
+		if target.Failed {
+			continue
+		}
+
+		i, target := i, target
+		uploads = append(uploads, startSiteWrite(target.Site, func(r io.Reader) (int64, string, error) {
+			var (
+				size int64
+				err  error
+			)
+			etags[i], size, err = uploadPartToSite(target.Site, r, object, target.UploadID, number, partSize)
+			return size, etags[i], err
+		}))
+		live = append(live, i)
+	}
+
+	var (
+		written int64
+		err     error
+	)
+	if e != nil {
+		// Failed shards are fed nothing, they are left out of writes.
+		w := &fanOutWriter{uploads: make([]*siteUpload, len(targets)), min: e.DataShards}
+		for j, i := range live {
+			w.uploads[i] = uploads[j]
+		}
+		for i := range w.uploads {
+			if w.uploads[i] == nil {
+				w.uploads[i] = &siteUpload{werr: errSiteClosed}
+			}
+		}
+
+		var enc reedsolomon.Encoder
+		enc, err = reedsolomon.New(e.DataShards, e.ParityShards)
+		if err == nil {
+			written, _, err = encodeStripes(body, enc, w, e.DataShards, e.ParityShards, e.BlockSize)
+		}
+	} else {
+		w := &fanOutWriter{uploads: uploads, min: 1}
+		written, err = io.CopyBuffer(w, body, make([]byte, fanOutBufferSize))
+	}
+	if err == nil && written != length {
+		err = io.ErrUnexpectedEOF
+	}
+
+	results := finishUploads(uploads, err, object, partSize)
+	if err != nil && err != errTooFewSites {
+		return nil, fmt.Errorf("%w: %v", errUploadInterrupted, err)
+	}
+
+	for j, i := range live {
+		if results[j].Error != "" {
+			targets[i].Failed = true
+			etags[i] = ""
+			abortMultipartOnSite(targets[i].Site, object, targets[i].UploadID)
+		}
+	}
+	if liveTargets(targets) < minTargets(e) {
+		return etags, errStorageFailed
+	}
+
+	return etags, nil
+}
+
+// leaseSession takes the lease of session as it has been read, so that no
+// other request works on it until the lease is given up or expires.
+func leaseSession(session *dao.UploadSession) error {
+	now := time.Now()
+	session.Lease = newID()
+	session.LeaseExpires = now.Add(sessionLeaseTTL).Unix()
+	return d.LeaseUploadSession(*session, now.Unix())
+}
+
+// putTargetPart adds a part to parts, replacing a part of the same number.
+func putTargetPart(parts []dao.TargetPart, part dao.TargetPart) []dao.TargetPart {
+	for i := range parts {
+		if parts[i].Number == part.Number {
+			parts[i] = part
+			return parts
+		}
+	}
+
+	return append(parts, part)
+}
+
+// completeSession completes the multipart uploads of session and records the
+// file. The session is removed once the uploads are completed, whether the
+// file is recorded or not.
+func completeSession(session *dao.UploadSession) (*dao.File, error) {
+	if session.Offset != session.Size {
+		return nil, errSessionIncomplete
+	}
+
+	file := &dao.File{
+		Filename:     session.Filename,
+		Size:         session.Size,
+		LastModified: time.Now().Unix(),
+		Object:       session.Object,
+	}
+	h, err := sessionHash(session)
+	if err != nil {
+		return nil, fmt.Errorf("restore hash of session %v: %v", session.ID, err)
+	}
+	h.sum(file)
+
+	err = leaseSession(session)
+	if err != nil {
+		return nil, err
+	}
+	if session.Size == 0 {
+		// Multipart uploads need a part, an empty file is stored as usual
+		// and reserves quota of its own.
+		sessionReservation(session).release()
+		f, _, err := storeFile(session.Username, session.Filename, strings.NewReader(""), 0)
+		if err != nil {
+			// The session can be completed again.
+			session.Updated = time.Now().Unix()
+			if uerr := d.UpdateUploadSession(*session); uerr != nil {
+				log.WithError(uerr).Errorf("give up lease of session %v", session.ID)
+			}
+			return nil, err
+		}
+		return f, removeSession(session)
+	}
+
+	want := session.Size
+	if e := session.Erasure; e != nil {
+		want = shardSize(session.Size, e.DataShards, e.BlockSize)
+		file.Erasure = &dao.Erasure{
+			DataShards:   e.DataShards,
+			ParityShards: e.ParityShards,
+			BlockSize:    e.BlockSize,
+			Shards:       make([]string, len(e.Shards)),
+		}
+	}
+
+	parts := make([][]dao.TargetPart, len(session.Targets))
+	for i, target := range session.Targets {
+		parts[i] = target.Parts
+	}
+	completeTargets(file, session.Targets, parts, want)
+
+	// The targets are done with, recordFile removes their objects if the
+	// file is not recorded.
+	err = recordFile(session.Username, file)
+	rerr := removeSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, rerr
+}
+
+// completeTargets completes the multipart uploads of file.Object on the
+// live targets from the given parts of each and adds the sites they succeed
+// on to file. Every target has to end up with want bytes, the uploads of
+// targets that fail are aborted.
+func completeTargets(file *dao.File, targets []dao.Target, parts [][]dao.TargetPart, want int64) {
+	for i, target := range targets {
+		if target.Failed {
+			continue
+		}
+
+		size, err := completeMultipartOnSite(target.Site, file.Object, target.UploadID, parts[i])
+		if err == nil && size != want {
+			err = fmt.Errorf("stored %v of %v bytes", size, want)
+		}
+		if err != nil {
+			log.WithError(err).Errorf("complete upload of %v on %v", file.Object, target.Site)
+			abortMultipartOnSite(target.Site, file.Object, target.UploadID)
+			continue
+		}
+
+		file.Sites = append(file.Sites, target.Site)
+		if file.Erasure != nil {
+			file.Erasure.Shards[i] = target.Site
+		}
+	}
+}
+
+// abortSession aborts the multipart uploads of session and removes it. It
+// fails with dao.ErrSessionChanged if the session has been used since it
+// was read.
+func abortSession(session *dao.UploadSession) error {
+	err := leaseSession(session)
+	if err != nil {
+		return err
+	}
+
+	return removeSession(session)
+}
+
+// removeSession aborts the multipart uploads of the live targets of a leased
+// session and removes it and its quota reservation.
+func removeSession(session *dao.UploadSession) error {
+	abortTargets(session.Targets, session.Object)
+	sessionReservation(session).release()
+	return d.RemoveUploadSession(session.Username, session.ID)
+}
+
+// expireUploads aborts the upload sessions and multipart uploads that have
+// not been used for ttl, every uploadSweepInterval.
+func expireUploads(ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		before := time.Now().Add(-ttl)
+		sweepSessions(before)
+		sweepUploads(before)
+	}
+}
+
+// sweepSessions aborts the upload sessions that have not been updated since
+// before. Sessions used since they have been read are left alone.
+func sweepSessions(before time.Time) {
+	sessions, err := d.GetStaleUploadSessions(before.Unix())
+	if err != nil {
+		log.WithError(err).Errorln("get stale upload sessions")
+		return
+	}
+
+	for i := range sessions {
+		session := &sessions[i]
+		err = abortSession(session)
+		switch {
+		case err == dao.ErrSessionChanged:
+		case err != nil:
+			log.WithError(err).Errorf("abort upload session %v of %v", session.ID, session.Username)
+		default:
+			log.Infof("aborted upload session %v of %v unused since %v", session.ID, session.Username, time.Unix(session.Updated, 0))
+		}
+	}
+}
+
+// sessionReservation returns the quota reservation of session, which holds
+// the quota of the file until the session is completed or aborted.
+func sessionReservation(session *dao.UploadSession) *reservation {
+	return &reservation{id: session.ID, username: session.Username, filename: session.Filename}
+}
+
+// abortTargets aborts the multipart uploads of object on the live targets.
+func abortTargets(targets []dao.Target, object string) {
+	for _, target := range targets {
+		if !target.Failed {
+			abortMultipartOnSite(target.Site, object, target.UploadID)
+		}
+	}
+}
+
+// initMultipartOnSite starts a multipart upload of filename on site and
+// returns its upload id.
+func initMultipartOnSite(site, filename string) (string, error) {
+	c, err := registry.get(site)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.InitMultipart(filename)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+
+	var created struct {
+		UploadID string `json:"upload_id"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	if err != nil {
+		return "", err
+	}
+
+	return created.UploadID, nil
+}
+
+// uploadPartToSite uploads a part of size bytes to site and returns its etag
+// and the size the site has stored.
+func uploadPartToSite(site string, r io.Reader, filename, uploadID string, number int, size int64) (string, int64, error) {
+	c, err := registry.get(site)
+	if err != nil {
+		return "", 0, err
+	}
+
+	resp, err := c.UploadPart(r, filename, uploadID, number, size)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", 0, fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+
+	var created struct {
+		ETag string `json:"etag"`
+		Size int64  `json:"size"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return created.ETag, created.Size, nil
+}
+
+// completeMultipartOnSite completes a multipart upload on site and returns
+// the size of the object.
+func completeMultipartOnSite(site, filename, uploadID string, parts []dao.TargetPart) (int64, error) {
+	c, err := registry.get(site)
+	if err != nil {
+		return 0, err
+	}
+
+	completed := make([]client.CompletedPart, len(parts))
+	for i, part := range parts {
+		completed[i] = client.CompletedPart{PartNumber: part.Number, ETag: part.ETag}
+	}
+
+	resp, err := c.CompleteMultipart(filename, uploadID, completed)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return 0, fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+
+	var created struct {
+		Size int64 `json:"size"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	if err != nil {
+		return 0, err
+	}
+
+	return created.Size, nil
+}
+
+// abortMultipartOnSite aborts a multipart upload on site, failures are only
+// logged as the parts are garbage anyway.
+func abortMultipartOnSite(site, filename, uploadID string) {
+	c, err := registry.get(site)
+	if err == nil {
+		var resp *http.Response
+		resp, err = c.AbortMultipart(filename, uploadID)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("unexpected status %v", resp.StatusCode)
+			}
+		}
+	}
+	if err != nil {
+		log.WithError(err).Errorf("abort upload of %v on %v", filename, site)
+	}
+}
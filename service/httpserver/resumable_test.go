@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSessionUser creates the user username storing two replicas on
+// sites, with a quota so that sessions hold reservations.
+func newTestSessionUser(t *testing.T, username string, sites []*testSite) {
+	useTestDao(t, username)
+	require.Nil(t, d.SetUserStrategy(username, dao.Strategy{Sites: siteNames(sites), Replicas: 2}))
+	require.Nil(t, d.SetUserQuota(username, &dao.Quota{MaxBytes: 1 << 30}))
+}
+
+// requireReserved checks the number of reservations of a user and the bytes
+// they hold.
+func requireReserved(t *testing.T, username string, files, bytes int64) {
+	reservedFiles, reservedBytes, err := d.GetReserved(username, time.Now())
+	require.Nil(t, err)
+	require.Equal(t, []int64{files, bytes}, []int64{reservedFiles, reservedBytes})
+}
+
+func TestResumableUpload(t *testing.T) {
+	const username = "resumable-test"
+	sites, cleanup := newTestSites(t, 2)
+	defer cleanup()
+	newTestSessionUser(t, username, sites)
+
+	content := testContent(sessionChunkSize + 100)
+	session, err := createSession(username, "f", int64(len(content)))
+	require.Nil(t, err)
+	for _, site := range sites {
+		require.Equal(t, 1, site.pendingUploads())
+	}
+	requireReserved(t, username, 1, int64(len(content)))
+
+	chunk := func(offset, length int64) error {
+		return putChunk(session, offset, bytes.NewReader(content[offset:offset+length]), length)
+	}
+	require.Equal(t, errOffsetMismatch, chunk(100, sessionChunkSize))
+	require.Equal(t, errChunkSize, chunk(0, 100))
+
+	// Nothing is uploaded while another request holds the session.
+	held := *session
+	require.Nil(t, leaseSession(&held))
+	require.Equal(t, dao.ErrSessionChanged, chunk(0, sessionChunkSize))
+	for _, site := range sites {
+		require.Equal(t, 0, site.partCount())
+	}
+
+	// Nor is anything uploaded for a session that has been used since it
+	// was read.
+	held.Updated++
+	require.Nil(t, d.UpdateUploadSession(held))
+	require.Equal(t, dao.ErrSessionChanged, chunk(0, sessionChunkSize))
+	for _, site := range sites {
+		require.Equal(t, 0, site.partCount())
+	}
+
+	session, err = d.GetUploadSession(username, session.ID)
+	require.Nil(t, err)
+	require.Nil(t, chunk(0, sessionChunkSize))
+	require.Equal(t, int64(sessionChunkSize), session.Offset)
+	stored, err := d.GetUploadSession(username, session.ID)
+	require.Nil(t, err)
+	require.Equal(t, session.Offset, stored.Offset)
+	require.Empty(t, stored.Lease)
+	_, err = completeSession(session)
+	require.Equal(t, errSessionIncomplete, err)
+
+	require.Nil(t, chunk(sessionChunkSize, 100))
+	file, err := completeSession(session)
+	require.Nil(t, err)
+	sum := sha256.Sum256(content)
+	require.Equal(t, hex.EncodeToString(sum[:]), file.SHA256)
+	require.Equal(t, siteNames(sites), file.Sites)
+	for _, site := range sites {
+		data, ok := site.object(file.Object)
+		require.True(t, ok)
+		require.Equal(t, content, data)
+		require.Equal(t, 0, site.pendingUploads())
+	}
+
+	recorded, err := d.GetFileInfo(username, "f")
+	require.Nil(t, err)
+	require.Equal(t, *file, *recorded)
+	_, err = d.GetUploadSession(username, session.ID)
+	require.NotNil(t, err)
+	requireReserved(t, username, 0, 0)
+}
+
+func TestAbortSession(t *testing.T) {
+	const username = "resumable-abort-test"
+	sites, cleanup := newTestSites(t, 2)
+	defer cleanup()
+	newTestSessionUser(t, username, sites)
+
+	content := testContent(2 * sessionChunkSize)
+	session, err := createSession(username, "f", int64(len(content)))
+	require.Nil(t, err)
+	require.Nil(t, putChunk(session, 0, bytes.NewReader(content[:sessionChunkSize]), sessionChunkSize))
+
+	// A session in use is not aborted.
+	held := *session
+	require.Nil(t, leaseSession(&held))
+	require.Equal(t, dao.ErrSessionChanged, abortSession(session))
+	held.Updated++
+	require.Nil(t, d.UpdateUploadSession(held))
+
+	session, err = d.GetUploadSession(username, session.ID)
+	require.Nil(t, err)
+	require.Nil(t, abortSession(session))
+	for _, site := range sites {
+		require.Equal(t, 0, site.pendingUploads())
+	}
+	_, err = d.GetUploadSession(username, session.ID)
+	require.NotNil(t, err)
+	requireReserved(t, username, 0, 0)
+}
+
+func TestSweepSessions(t *testing.T) {
+	const username = "resumable-sweep-test"
+	sites, cleanup := newTestSites(t, 2)
+	defer cleanup()
+	newTestSessionUser(t, username, sites)
+
+	stale, err := createSession(username, "stale", 100)
+	require.Nil(t, err)
+	require.Nil(t, leaseSession(stale))
+	stale.Updated = time.Now().Add(-2 * time.Hour).Unix()
+	require.Nil(t, d.UpdateUploadSession(*stale))
+	fresh, err := createSession(username, "fresh", 100)
+	require.Nil(t, err)
+
+	sweepSessions(time.Now().Add(-time.Hour))
+	_, err = d.GetUploadSession(username, stale.ID)
+	require.NotNil(t, err)
+	_, err = d.GetUploadSession(username, fresh.ID)
+	require.Nil(t, err)
+	for _, site := range sites {
+		require.Equal(t, 1, site.pendingUploads())
+	}
+	requireReserved(t, username, 1, 100)
+
+	// A session a request is working on is left alone.
+	held := *fresh
+	require.Nil(t, leaseSession(&held))
+	sweepSessions(time.Now().Add(time.Hour))
+	_, err = d.GetUploadSession(username, fresh.ID)
+	require.Nil(t, err)
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// The S3 gateway serves path-style requests, each user owns a single bucket
+// named after the user.
+
+const (
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+	// maxS3Keys is the most keys returned by a listing.
+	maxS3Keys = 1000
+	// maxS3XMLSize limits the size of XML request bodies.
+	maxS3XMLSize = 1 << 20
+)
+
+// s3Error is an error returned to S3 clients.
+type s3Error struct {
+	Code    string
+	Status  int
+	Message string
+}
+
+var (
+	errS3AccessDenied       = &s3Error{"AccessDenied", http.StatusForbidden, "Access Denied."}
+	errS3NoSuchBucket       = &s3Error{"NoSuchBucket", http.StatusNotFound, "The specified bucket does not exist."}
+	errS3NoSuchKey          = &s3Error{"NoSuchKey", http.StatusNotFound, "The specified key does not exist."}
+	errS3NoSuchUpload       = &s3Error{"NoSuchUpload", http.StatusNotFound, "The specified multipart upload does not exist."}
+	errS3InvalidPart        = &s3Error{"InvalidPart", http.StatusBadRequest, "One or more of the specified parts could not be found."}
+	errS3InvalidPartOrder   = &s3Error{"InvalidPartOrder", http.StatusBadRequest, "The list of parts was not in ascending order."}
+	errS3InvalidArgument    = &s3Error{"InvalidArgument", http.StatusBadRequest, "Invalid argument."}
+	errS3EntityTooSmall     = &s3Error{"EntityTooSmall", http.StatusBadRequest, "Your proposed upload is smaller than the minimum allowed object size."}
+	errS3MissingLength      = &s3Error{"MissingContentLength", http.StatusLengthRequired, "You must provide the Content-Length HTTP header."}
+	errS3MalformedXML       = &s3Error{"MalformedXML", http.StatusBadRequest, "The XML you provided was not well-formed."}
+	errS3IncompleteBody     = &s3Error{"IncompleteBody", http.StatusBadRequest, "The request body is incomplete or invalid."}
+	errS3NotImplemented     = &s3Error{"NotImplemented", http.StatusNotImplemented, "This operation is not supported."}
+	errS3QuotaExceeded      = &s3Error{"QuotaExceeded", http.StatusForbidden, "The quota of the user is exceeded."}
+	errS3PathConflict       = &s3Error{"PathConflict", http.StatusConflict, "A directory of the same name or a file in place of a parent directory exists."}
+	errS3InternalError      = &s3Error{"InternalError", http.StatusInternalServerError, "We encountered an internal error. Please try again."}
+	errS3ServiceUnavailable = &s3Error{"ServiceUnavailable", http.StatusServiceUnavailable, "Too few storage sites are available."}
+)
+
+// authErrors maps the errors of verifyS3Request to S3 errors.
+var authErrors = map[error]*s3Error{
+	errAccessDenied:     {"InvalidAccessKeyId", http.StatusForbidden, "The access key does not exist."},
+	errSignatureInvalid: {"SignatureDoesNotMatch", http.StatusForbidden, "The request signature does not match."},
+	errRequestExpired:   {"RequestTimeTooSkewed", http.StatusForbidden, "The request time is too far from the server time or has expired."},
+	errAuthMalformed:    {"AuthorizationHeaderMalformed", http.StatusBadRequest, "The authorization is malformed."},
+	errDigestInvalid:    {"XAmzContentSHA256Mismatch", http.StatusBadRequest, "The payload hash does not match."},
+}
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type listBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+type listObjectsResult struct {
+	XMLName   xml.Name `xml:"ListBucketResult"`
+	Xmlns     string   `xml:"xmlns,attr"`
+	Name      string
+	Prefix    string
+	Delimiter string `xml:",omitempty"`
+	MaxKeys   int
+	// Marker and NextMarker are used by ListObjects.
+	Marker     *string `xml:",omitempty"`
+	NextMarker string  `xml:",omitempty"`
+	// The other fields are used by ListObjectsV2.
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	KeyCount              *int   `xml:",omitempty"`
+
+	IsTruncated    bool
+	Contents       []s3Object
+	CommonPrefixes []s3Prefix
+}
+
+type deleteRequest struct {
+	Quiet   bool
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type deletedObject struct {
+	Key string
+}
+
+type deleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+// s3Router returns the engine of the S3 gateway.
+func s3Router() *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Logger(), gin.Recovery())
+	r.Use(s3AuthMiddleware())
+	r.Any("/*path", s3Handler)
+
+	return r
+}
+
+func s3AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := verifyS3Request(c.Request)
+		if err != nil {
+			e, ok := authErrors[err]
+			if !ok {
+				e = errS3AccessDenied
+			}
+			writeS3Error(c, e)
+			c.Abort()
+			return
+		}
+
+		c.Set(usernameKey, user.Username)
+		c.Next()
+	}
+}
+
+func writeS3Error(c *gin.Context, e *s3Error) {
+	c.XML(e.Status, s3ErrorResponse{
+		Code:     e.Code,
+		Message:  e.Message,
+		Resource: c.Request.URL.Path,
+	})
+}
+
+// s3Handler dispatches a request on its bucket, key and query.
+func s3Handler(c *gin.Context) {
+	username := c.GetString(usernameKey)
+	query := c.Request.URL.Query()
+
+	bucket := strings.TrimPrefix(c.Param("path"), "/")
+	key := ""
+	if i := strings.IndexByte(bucket, '/'); i >= 0 {
+		bucket, key = bucket[:i], bucket[i+1:]
+	}
+
+	if bucket == "" {
+		if c.Request.Method != http.MethodGet {
+			writeS3Error(c, errS3NotImplemented)
+			return
+		}
+		listBuckets(c, username)
+		return
+	}
+	if bucket != username {
+		writeS3Error(c, errS3NoSuchBucket)
+		return
+	}
+
+	if key == "" {
+		switch {
+		case c.Request.Method == http.MethodHead:
+			c.Status(http.StatusOK)
+		case c.Request.Method == http.MethodPut:
+			// The bucket of a user always exists.
+			c.Status(http.StatusOK)
+		case c.Request.Method == http.MethodGet && hasQuery(query, "location"):
+			c.XML(http.StatusOK, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3Namespace})
+		case c.Request.Method == http.MethodGet && hasQuery(query, "uploads"):
+			listMultipartUploads(c, username)
+		case c.Request.Method == http.MethodGet:
+			listObjects(c, username)
+		case c.Request.Method == http.MethodPost && hasQuery(query, "delete"):
+			deleteObjects(c, username)
+		default:
+			writeS3Error(c, errS3NotImplemented)
+		}
+		return
+	}
+
+	uploadID := query.Get("uploadId")
+	switch {
+	case c.Request.Method == http.MethodPut && uploadID != "":
+		uploadPart(c, username, key, uploadID)
+	case c.Request.Method == http.MethodPut && c.GetHeader("X-Amz-Copy-Source") != "":
+		writeS3Error(c, errS3NotImplemented)
+	case c.Request.Method == http.MethodPut:
+		putObject(c, username, key)
+	case c.Request.Method == http.MethodGet && uploadID != "":
+		listParts(c, username, key, uploadID)
+	case c.Request.Method == http.MethodGet:
+		getObject(c, username, key)
+	case c.Request.Method == http.MethodHead:
+		getObject(c, username, key)
+	case c.Request.Method == http.MethodDelete && uploadID != "":
+		abortMultipartUpload(c, username, key, uploadID)
+	case c.Request.Method == http.MethodDelete:
+		deleteObject(c, username, key)
+	case c.Request.Method == http.MethodPost && hasQuery(query, "uploads"):
+		createMultipartUpload(c, username, key)
+	case c.Request.Method == http.MethodPost && uploadID != "":
+		completeMultipartUpload(c, username, key, uploadID)
+	default:
+		writeS3Error(c, errS3NotImplemented)
+	}
+}
+
+func hasQuery(query map[string][]string, name string) bool {
+	_, ok := query[name]
+	return ok
+}
+
+func listBuckets(c *gin.Context, username string) {
+	c.XML(http.StatusOK, listBucketsResult{
+		Xmlns: s3Namespace,
+		Owner: s3Owner{ID: username, DisplayName: username},
+		Buckets: []s3Bucket{{
+			Name:         username,
+			CreationDate: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		}},
+	})
+}
+
+// listObjects serves both ListObjects and ListObjectsV2.
+func listObjects(c *gin.Context, username string) {
+	query := c.Request.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	maxKeys := maxS3Keys
+	if value := query.Get("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeS3Error(c, errS3InvalidArgument)
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	result := listObjectsResult{
+		Xmlns:     s3Namespace,
+		Name:      username,
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+	}
+
+	// Keys up to marker are skipped.
+	var marker string
+	if v2 {
+		result.StartAfter = query.Get("start-after")
+		result.ContinuationToken = query.Get("continuation-token")
+		marker = result.StartAfter
+		if result.ContinuationToken != "" {
+			token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+			if err != nil {
+				writeS3Error(c, errS3InvalidArgument)
+				return
+			}
+			marker = string(token)
+		}
+	} else {
+		marker = query.Get("marker")
+		result.Marker = &marker
+	}
+
+	// One key tells whether a listing of no keys is truncated.
+	limit := int64(maxKeys)
+	if limit == 0 {
+		limit = 1
+	}
+
+	var (
+		files    []dao.File
+		prefixes []string
+		last     string
+	)
+	if delimiter == "" {
+		page, err := d.QueryFiles(username, dao.FileQuery{
+			Prefix:     prefix,
+			StartAfter: marker,
+			Limit:      limit,
+			SkipTotal:  true,
+		})
+		if err != nil {
+			writeS3Error(c, errS3InternalError)
+			log.WithError(err).Errorf("list %v's files", username)
+			return
+		}
+		files, result.IsTruncated = page.Files, page.NextCursor != ""
+	} else {
+		// Keys with the delimiter after the prefix are rolled up into a
+		// common prefix.
+		page, err := d.ListDir(username, dao.DirQuery{
+			Prefix:     prefix,
+			Delimiter:  delimiter,
+			StartAfter: marker,
+			Limit:      limit,
+		})
+		if err != nil {
+			writeS3Error(c, errS3InternalError)
+			log.WithError(err).Errorf("list %v's files", username)
+			return
+		}
+		files, prefixes, result.IsTruncated = page.Files, page.Prefixes, page.NextCursor != ""
+	}
+	if maxKeys == 0 {
+		result.IsTruncated = len(files)+len(prefixes) > 0
+		files, prefixes = nil, nil
+	}
+
+	for i := range files {
+		file := &files[i]
+		result.Contents = append(result.Contents, s3Object{
+			Key:          file.Filename,
+			LastModified: time.Unix(file.LastModified, 0).UTC().Format(time.RFC3339),
+			ETag:         fileETag(file),
+			Size:         file.Size,
+			StorageClass: "STANDARD",
+		})
+		last = file.Filename
+	}
+	for _, p := range prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, s3Prefix{Prefix: p})
+		if p > last {
+			last = p
+		}
+	}
+
+	if v2 {
+		count := len(result.Contents) + len(result.CommonPrefixes)
+		result.KeyCount = &count
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else if result.IsTruncated && delimiter != "" {
+		result.NextMarker = last
+	}
+
+	c.XML(http.StatusOK, result)
+}
+
+// s3ContentLength returns the length of the payload of a request, -1 if it
+// is unknown.
+func s3ContentLength(r *http.Request) int64 {
+	if value := r.Header.Get("X-Amz-Decoded-Content-Length"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+
+	return r.ContentLength
+}
+
+func putObject(c *gin.Context, username, key string) {
+	file, _, err := storeFile(username, key, c.Request.Body, s3ContentLength(c.Request))
+	if !s3StoreError(c, err, username, key) {
+		return
+	}
+
+	c.Header("ETag", fileETag(file))
+	c.Status(http.StatusOK)
+}
+
+// s3StoreError writes the S3 error of a storeFile error, it returns whether
+// err is nil.
+func s3StoreError(c *gin.Context, err error, username, key string) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errUploadInterrupted):
+		writeS3Error(c, errS3IncompleteBody)
+	case err == errStorageFailed:
+		writeS3Error(c, errS3ServiceUnavailable)
+	case err == errQuotaExceeded:
+		writeS3Error(c, errS3QuotaExceeded)
+		return false
+	case err == errPathExists:
+		writeS3Error(c, errS3PathConflict)
+		return false
+	default:
+		writeS3Error(c, errS3InternalError)
+	}
+	log.WithError(err).Errorf("store %v for %v", key, username)
+
+	return false
+}
+
+func getObject(c *gin.Context, username, key string) {
+	file, err := d.GetFileInfo(username, key)
+	if err == dao.ErrFileNotFound {
+		writeS3Error(c, errS3NoSuchKey)
+		return
+	}
+	if err != nil {
+		writeS3Error(c, errS3InternalError)
+		log.WithError(err).Errorf("get file %v of %v", key, username)
+		return
+	}
+
+	err = serveFile(c, username, file)
+	if err != nil {
+		writeS3Error(c, errS3InternalError)
+		log.WithError(err).Errorf("download %v from %v failed", key, file.Sites)
+	}
+}
+
+func deleteObject(c *gin.Context, username, key string) {
+	e := s3DeleteFile(username, key)
+	if e != nil {
+		writeS3Error(c, e)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// s3DeleteFile deletes a file, deleting a file that does not exist succeeds.
+func s3DeleteFile(username, key string) *s3Error {
+	file, err := d.GetFileInfo(username, key)
+	if err == dao.ErrFileNotFound {
+		return nil
+	}
+	if err != nil {
+		log.WithError(err).Errorf("get file %v of %v", key, username)
+		return errS3InternalError
+	}
+
+	err = removeFile(username, file)
+	if err != nil {
+		log.WithError(err).Errorf("remove file %v failed", key)
+		return errS3InternalError
+	}
+
+	return nil
+}
+
+func deleteObjects(c *gin.Context, username string) {
+	var req deleteRequest
+	err := xml.NewDecoder(io.LimitReader(c.Request.Body, maxS3XMLSize)).Decode(&req)
+	if err != nil || len(req.Objects) > maxS3Keys {
+		writeS3Error(c, errS3MalformedXML)
+		return
+	}
+
+	result := deleteResult{Xmlns: s3Namespace}
+	for _, object := range req.Objects {
+		e := s3DeleteFile(username, object.Key)
+		if e != nil {
+			result.Errors = append(result.Errors, deleteError{
+				Key:     object.Key,
+				Code:    e.Code,
+				Message: e.Message,
+			})
+			continue
+		}
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, deletedObject{Key: object.Key})
+		}
+	}
+
+	c.XML(http.StatusOK, result)
+}
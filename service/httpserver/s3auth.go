@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+)
+
+const (
+	signV4Algorithm = "AWS4-HMAC-SHA256"
+	iso8601Format   = "20060102T150405Z"
+	yyyymmdd        = "20060102"
+
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// maxClockSkew is how far the request date may be from the server time.
+	maxClockSkew = 15 * time.Minute
+	// maxChunkSize limits the chunks of streaming uploads.
+	maxChunkSize = 16 << 20
+)
+
+var (
+	errAccessDenied     = errors.New("AccessDenied")
+	errSignatureInvalid = errors.New("SignatureDoesNotMatch")
+	errRequestExpired   = errors.New("RequestTimeTooSkewed")
+	errDigestInvalid    = errors.New("XAmzContentSHA256Mismatch")
+	errAuthMalformed    = errors.New("AuthorizationHeaderMalformed")
+)
+
+// signature is the parsed signature of a SigV4 signed request.
+type signature struct {
+	accessKey     string
+	date          time.Time
+	scope         string
+	signedHeaders []string
+	signature     string
+	payloadHash   string
+	// expires is set for presigned URLs.
+	expires time.Duration
+}
+
+// verifyS3Request checks the SigV4 signature of a request, from either the
+// Authorization header or a presigned URL. It returns the user and replaces
+// the request body with one that verifies the payload while it is read.
+func verifyS3Request(r *http.Request) (*dao.User, error) {
+	sig, err := parseSignature(r)
+	if err != nil {
+		return nil, err
+	}
+	err = sig.checkDate(time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := d.GetUserByAccessKey(sig.accessKey)
+	if err != nil || user.Disabled {
+		return nil, errAccessDenied
+	}
+
+	err = sig.verify(r, user.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// parseSignature parses the signature of a request, from either the
+// Authorization header or a presigned URL.
+func parseSignature(r *http.Request) (*signature, error) {
+	if r.URL.Query().Get("X-Amz-Algorithm") != "" {
+		return parsePresigned(r)
+	}
+
+	return parseAuthorization(r)
+}
+
+// checkDate fails if the signature is not valid at now, a presigned URL is
+// valid until it expires.
+func (s *signature) checkDate(now time.Time) error {
+	if s.expires > 0 {
+		if now.Before(s.date.Add(-maxClockSkew)) || now.After(s.date.Add(s.expires)) {
+			return errRequestExpired
+		}
+	} else if now.Sub(s.date) > maxClockSkew || s.date.Sub(now) > maxClockSkew {
+		return errRequestExpired
+	}
+
+	return nil
+}
+
+// verify checks the signature of r against secretKey and replaces its body
+// with one that verifies the payload while it is read.
+func (s *signature) verify(r *http.Request, secretKey string) error {
+	key := signingKey(secretKey, s.scope)
+	canonical := canonicalRequest(r, s.signedHeaders, s.payloadHash, s.expires > 0)
+	want := hex.EncodeToString(hmacSHA256(key, stringToSign(s.date, s.scope, canonical)))
+	if !hmac.Equal([]byte(want), []byte(s.signature)) {
+		return errSignatureInvalid
+	}
+
+	switch s.payloadHash {
+	case unsignedPayload:
+	case streamingPayload:
+		r.Body = &chunkedReader{
+			r:       bufio.NewReader(r.Body),
+			closer:  r.Body,
+			key:     key,
+			date:    s.date,
+			scope:   s.scope,
+			prevSig: s.signature,
+		}
+	default:
+		want, err := hex.DecodeString(s.payloadHash)
+		if err != nil {
+			return errDigestInvalid
+		}
+		r.Body = &digestReader{r: r.Body, h: sha256.New(), want: want}
+	}
+
+	return nil
+}
+
+func parseAuthorization(r *http.Request) (*signature, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, signV4Algorithm+" ") {
+		return nil, errAccessDenied
+	}
+
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(auth, signV4Algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, errAuthMalformed
+		}
+		fields[kv[0]] = kv[1]
+	}
+
+	dateHeader := "x-amz-date"
+	amzDate := r.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		dateHeader = "date"
+		amzDate = r.Header.Get("Date")
+	}
+
+	sig, err := newSignature(fields["Credential"], fields["SignedHeaders"], fields["Signature"], amzDate)
+	if err != nil {
+		return nil, err
+	}
+	// An unsigned date could be moved to replay the request.
+	if !sig.signs(dateHeader) {
+		return nil, errAuthMalformed
+	}
+
+	// Some clients leave the payload hash out of requests without a body.
+	sig.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if sig.payloadHash == "" {
+		sig.payloadHash = emptySHA256
+	}
+
+	return sig, nil
+}
+
+func parsePresigned(r *http.Request) (*signature, error) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signV4Algorithm {
+		return nil, errAuthMalformed
+	}
+
+	sig, err := newSignature(query.Get("X-Amz-Credential"), query.Get("X-Amz-SignedHeaders"), query.Get("X-Amz-Signature"), query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, err
+	}
+
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires <= 0 || expires > 7*24*3600 {
+		return nil, errAuthMalformed
+	}
+	sig.expires = time.Duration(expires) * time.Second
+	sig.payloadHash = unsignedPayload
+
+	return sig, nil
+}
+
+func newSignature(credential, signedHeaders, sig, amzDate string) (*signature, error) {
+	// AKID/20130524/us-east-1/s3/aws4_request
+	parts := strings.SplitN(credential, "/", 2)
+	if len(parts) != 2 || signedHeaders == "" || sig == "" {
+		return nil, errAuthMalformed
+	}
+
+	scope := strings.Split(parts[1], "/")
+	if len(scope) != 4 || scope[2] != "s3" || scope[3] != "aws4_request" {
+		return nil, errAuthMalformed
+	}
+
+	date, err := time.Parse(iso8601Format, amzDate)
+	if err != nil {
+		date, err = http.ParseTime(amzDate)
+		if err != nil {
+			return nil, errAuthMalformed
+		}
+	}
+	if date.UTC().Format(yyyymmdd) != scope[0] {
+		return nil, errAuthMalformed
+	}
+
+	s := &signature{
+		accessKey:     parts[0],
+		date:          date.UTC(),
+		scope:         parts[1],
+		signedHeaders: strings.Split(signedHeaders, ";"),
+		signature:     sig,
+	}
+	// A signature that does not cover the host could be replayed against
+	// another one.
+	if !s.signs("host") {
+		return nil, errAuthMalformed
+	}
+
+	return s, nil
+}
+
+// signs reports whether header is one of the signed headers.
+func (s *signature) signs(header string) bool {
+	for _, name := range s.signedHeaders {
+		if name == header {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canonicalRequest builds the canonical request of the SigV4 spec.
+func canonicalRequest(r *http.Request, signedHeaders []string, payloadHash string, presigned bool) string {
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		headers.WriteString(name)
+		headers.WriteByte(':')
+		switch name {
+		case "host":
+			headers.WriteString(r.Host)
+		case "content-length":
+			headers.WriteString(strconv.FormatInt(r.ContentLength, 10))
+		default:
+			values := r.Header[http.CanonicalHeaderKey(name)]
+			for i, value := range values {
+				if i > 0 {
+					headers.WriteByte(',')
+				}
+				headers.WriteString(strings.Join(strings.Fields(value), " "))
+			}
+		}
+		headers.WriteByte('\n')
+	}
+
+	query := r.URL.Query()
+	if presigned {
+		query.Del("X-Amz-Signature")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(query),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode encodes s as the SigV4 spec demands, slashes are kept unless
+// encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func stringToSign(date time.Time, scope, canonicalRequest string) []byte {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	return []byte(strings.Join([]string{
+		signV4Algorithm,
+		date.Format(iso8601Format),
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n"))
+}
+
+// signingKey derives the signing key from the secret key and the scope
+// date/region/service/aws4_request.
+func signingKey(secretKey, scope string) []byte {
+	key := []byte("AWS4" + secretKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, []byte(part))
+	}
+
+	return key
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// digestReader fails at the end of the body if its hash is not want.
+type digestReader struct {
+	r    io.ReadCloser
+	h    hash.Hash
+	want []byte
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	dr.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(dr.h.Sum(nil), dr.want) {
+		return n, errDigestInvalid
+	}
+
+	return n, err
+}
+
+func (dr *digestReader) Close() error {
+	return dr.r.Close()
+}
+
+// chunkedReader decodes an aws-chunked body and verifies the signature of
+// every chunk, each of which is chained to the previous signature.
+type chunkedReader struct {
+	r      *bufio.Reader
+	closer io.Closer
+
+	key     []byte
+	date    time.Time
+	scope   string
+	prevSig string
+
+	chunk []byte
+	done  bool
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for len(cr.chunk) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+
+		err := cr.nextChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
+
+// nextChunk reads and verifies a chunk of the form
+// hex-size;chunk-signature=sig\r\ndata\r\n
+func (cr *chunkedReader) nextChunk() error {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	header := strings.SplitN(strings.TrimRight(line, "\r\n"), ";chunk-signature=", 2)
+	if len(header) != 2 {
+		return errAuthMalformed
+	}
+	size, err := strconv.ParseInt(header[0], 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errAuthMalformed
+	}
+
+	chunk := make([]byte, size+2)
+	_, err = io.ReadFull(cr.r, chunk)
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if !bytes.HasSuffix(chunk, []byte("\r\n")) {
+		return errAuthMalformed
+	}
+	chunk = chunk[:size]
+
+	hash := sha256.Sum256(chunk)
+	toSign := strings.Join([]string{
+		signV4Algorithm + "-PAYLOAD",
+		cr.date.Format(iso8601Format),
+		cr.scope,
+		cr.prevSig,
+		emptySHA256,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	sig := hex.EncodeToString(hmacSHA256(cr.key, []byte(toSign)))
+	if !hmac.Equal([]byte(sig), []byte(header[1])) {
+		return errSignatureInvalid
+	}
+
+	cr.prevSig = sig
+	cr.chunk = chunk
+	cr.done = size == 0
+	return nil
+}
+
+func (cr *chunkedReader) Close() error {
+	return cr.closer.Close()
+}
@@ -0,0 +1,739 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// A multipart upload is scheduled like a file of unknown size when it is
+// created, and starts a multipart upload on each of its sites. Every part is
+// uploaded as a part of those like the chunks of a resumable upload, so that
+// completing the upload only completes them and records the file.
+
+const (
+	maxPartNumber = 10000
+	// minPartSize is the least size of all parts but the last, the sites
+	// require it of their multipart uploads.
+	minPartSize = 5 << 20
+	// maxS3Parts is the most parts or uploads returned by a listing.
+	maxS3Parts = 1000
+)
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type completeMultipartUploadRequest struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+type s3Part struct {
+	PartNumber   int
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+type listPartsResult struct {
+	XMLName              xml.Name `xml:"ListPartsResult"`
+	Xmlns                string   `xml:"xmlns,attr"`
+	Bucket               string
+	Key                  string
+	UploadId             string
+	PartNumberMarker     int
+	NextPartNumberMarker int
+	MaxParts             int
+	IsTruncated          bool
+	Parts                []s3Part `xml:"Part"`
+}
+
+type s3Upload struct {
+	Key       string
+	UploadId  string
+	Initiated string
+}
+
+type listMultipartUploadsResult struct {
+	XMLName            xml.Name `xml:"ListMultipartUploadsResult"`
+	Xmlns              string   `xml:"xmlns,attr"`
+	Bucket             string
+	KeyMarker          string
+	UploadIdMarker     string
+	NextKeyMarker      string
+	NextUploadIdMarker string
+	Prefix             string
+	Delimiter          string `xml:",omitempty"`
+	MaxUploads         int
+	IsTruncated        bool
+	Uploads            []s3Upload `xml:"Upload"`
+	CommonPrefixes     []s3Prefix
+}
+
+func createMultipartUpload(c *gin.Context, username, key string) {
+	upload, err := startUpload(username, key)
+	switch {
+	case err == errQuotaExceeded:
+		writeS3Error(c, errS3QuotaExceeded)
+		return
+	case err == errPathExists:
+		writeS3Error(c, errS3PathConflict)
+		return
+	case err == errStorageFailed:
+		writeS3Error(c, errS3ServiceUnavailable)
+		log.WithError(err).Errorf("create upload of %v for %v", key, username)
+		return
+	case err != nil:
+		writeS3Error(c, errS3InternalError)
+		log.WithError(err).Errorf("create upload of %v for %v", key, username)
+		return
+	}
+
+	c.XML(http.StatusOK, initiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   username,
+		Key:      key,
+		UploadId: upload.ID,
+	})
+}
+
+// startUpload schedules a file of unknown size and starts multipart uploads
+// on its sites. Erasure-coded files take blocks of maxBlockSize, as the size
+// is not known.
+func startUpload(username, key string) (*dao.Upload, error) {
+	err := checkFilePath(username, key)
+	if err != nil {
+		return nil, err
+	}
+	strategy, err := d.GetUserStrategy(username)
+	if err != nil {
+		return nil, fmt.Errorf("get %v's strategy: %v", username, err)
+	}
+	// The upload holds a reservation of quota, which its parts grow, until
+	// it is completed or aborted.
+	id := newID()
+	res, err := reserveQuota(id, username, key, -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	created := false
+	defer func() {
+		if !created {
+			res.release()
+		}
+	}()
+	strategy = strategy.ForFile(key, -1)
+
+	sites, err := schedule(username, key, -1, strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	upload := &dao.Upload{
+		ID:       id,
+		Username: username,
+		Filename: key,
+		Object:   newObjectName(username),
+		Created:  now,
+		Updated:  now,
+	}
+	if strategy.DataShards > 0 {
+		if len(sites) != strategy.DataShards+strategy.ParityShards {
+			return nil, fmt.Errorf("%v sites for %v shards", len(sites), strategy.DataShards+strategy.ParityShards)
+		}
+		upload.Erasure = &dao.Erasure{
+			DataShards:   strategy.DataShards,
+			ParityShards: strategy.ParityShards,
+			BlockSize:    maxBlockSize,
+			Shards:       sites,
+		}
+	}
+
+	upload.Targets = startTargets(sites, upload.Object)
+	if liveTargets(upload.Targets) < minTargets(upload.Erasure) {
+		abortTargets(upload.Targets, upload.Object)
+		return nil, errStorageFailed
+	}
+
+	err = d.CreateUpload(*upload)
+	if err != nil {
+		abortTargets(upload.Targets, upload.Object)
+		return nil, fmt.Errorf("create upload for %v: %v", username, err)
+	}
+	created = true
+
+	return upload, nil
+}
+
+// getUpload returns the multipart upload of key.
+func getUpload(username, key, id string) (*dao.Upload, *s3Error) {
+	upload, err := d.GetUpload(username, id)
+	if err != nil || upload.Filename != key {
+		return nil, errS3NoSuchUpload
+	}
+
+	return upload, nil
+}
+
+// getLiveUpload returns the multipart upload of key if it takes parts.
+// Uploads from before parts went to the sites of the file can only be
+// aborted.
+func getLiveUpload(username, key, id string) (*dao.Upload, *s3Error) {
+	upload, e := getUpload(username, key, id)
+	if e == nil && len(upload.Targets) == 0 {
+		e = errS3NoSuchUpload
+	}
+
+	return upload, e
+}
+
+func uploadPart(c *gin.Context, username, key, id string) {
+	number, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || number < 1 || number > maxPartNumber {
+		writeS3Error(c, errS3InvalidArgument)
+		return
+	}
+	// A part goes to the sites as it is read, which needs its size.
+	length := s3ContentLength(c.Request)
+	if length < 0 {
+		writeS3Error(c, errS3MissingLength)
+		return
+	}
+
+	upload, e := getLiveUpload(username, key, id)
+	if e != nil {
+		writeS3Error(c, e)
+		return
+	}
+
+	strategy, err := d.GetUserStrategy(username)
+	if err != nil {
+		writeS3Error(c, errS3InternalError)
+		log.WithError(err).Errorf("get %v's strategy", username)
+		return
+	}
+	body, limited, err := limitPart(upload, c.Request.Body, strategy)
+	if err == errQuotaExceeded {
+		writeS3Error(c, errS3QuotaExceeded)
+		return
+	}
+	if err != nil {
+		writeS3Error(c, errS3InternalError)
+		log.WithError(err).Errorf("check %v's quota", username)
+		return
+	}
+
+	failed := make([]bool, len(upload.Targets))
+	for i, target := range upload.Targets {
+		failed[i] = target.Failed
+	}
+	h := md5.New()
+	etags, err := putPart(upload.Targets, upload.Object, upload.Erasure, number, io.TeeReader(body, h), length)
+	var newlyFailed []int
+	for i, target := range upload.Targets {
+		if target.Failed && !failed[i] {
+			newlyFailed = append(newlyFailed, i)
+		}
+	}
+	if len(newlyFailed) > 0 {
+		ferr := d.FailUploadTargets(username, id, newlyFailed)
+		if ferr != nil {
+			log.WithError(ferr).Errorf("record failed targets of upload %v of %v", id, username)
+		}
+	}
+	if limited != nil && (limited.exceeded || err != nil) {
+		limited.res.shrink(limited.res.bytes)
+	}
+	switch {
+	case limited != nil && limited.exceeded:
+		writeS3Error(c, errS3QuotaExceeded)
+		return
+	case err == errStorageFailed:
+		writeS3Error(c, errS3ServiceUnavailable)
+		log.WithError(err).Errorf("upload part %v of %v for %v", number, key, username)
+		return
+	case err != nil:
+		writeS3Error(c, errS3IncompleteBody)
+		log.WithError(err).Errorf("upload part %v of %v for %v", number, key, username)
+		return
+	}
+
+	now := time.Now().Unix()
+	part := dao.Part{
+		Number:       number,
+		Size:         length,
+		ETag:         hex.EncodeToString(h.Sum(nil)),
+		LastModified: now,
+		TargetETags:  etags,
+	}
+	err = d.PutUploadPart(username, id, part, now)
+	if err != nil {
+		if limited != nil {
+			limited.res.shrink(limited.res.bytes)
+		}
+		if err == dao.ErrNoUpload {
+			writeS3Error(c, errS3NoSuchUpload)
+			return
+		}
+		writeS3Error(c, errS3InternalError)
+		log.WithError(err).Errorf("record part %v of %v for %v", number, key, username)
+		return
+	}
+
+	// The upload keeps what the part counts for reserved, what has been
+	// reserved beyond that and for the part replaced is given back. The
+	// part replaced has been overwritten on the sites.
+	if limited != nil {
+		unused := limited.res.bytes - limited.count(part.Size)
+		for _, old := range upload.Parts {
+			if old.Number == number {
+				unused += limited.count(old.Size)
+			}
+		}
+		limited.res.shrink(unused)
+	}
+
+	c.Header("ETag", `"`+part.ETag+`"`)
+	c.Status(http.StatusOK)
+}
+
+// limitPart limits the body of a part so that the parts of upload stay
+// within the quota of the user, the part grows the reservation of upload as
+// it is read. The parts count as the file they make up would. The returned
+// quotaReader is nil if there is no limit.
+func limitPart(upload *dao.Upload, body io.Reader, strategy *dao.Strategy) (io.Reader, *quotaReader, error) {
+	res, err := openReservation(upload.ID, upload.Username, upload.Filename)
+	if err != nil || res == nil {
+		return body, nil, err
+	}
+
+	limited := &quotaReader{r: body, count: countFunc(upload.Filename, -1, strategy), res: res}
+	return limited, limited, nil
+}
+
+// checkPartSizes checks that parts, all but the last of which are followed
+// by another, can make up a file. Parts of erasure-coded files are encoded
+// on their own, so all but the last have to be whole stripes, and of whole
+// chunks like those of resumable uploads, so that the shards get parts of
+// the least size.
+func checkPartSizes(upload *dao.Upload, parts []dao.Part) *s3Error {
+	unit := int64(0)
+	if e := upload.Erasure; e != nil {
+		unit = int64(e.DataShards) * sessionChunkSize
+	}
+
+	for _, part := range parts[:len(parts)-1] {
+		if part.Size < minPartSize {
+			return errS3EntityTooSmall
+		}
+		if unit > 0 && part.Size%unit != 0 {
+			return &s3Error{
+				Code:    errS3EntityTooSmall.Code,
+				Status:  errS3EntityTooSmall.Status,
+				Message: fmt.Sprintf("All parts but the last of erasure-coded files must be multiples of %v MiB.", unit>>20),
+			}
+		}
+	}
+
+	return nil
+}
+
+func completeMultipartUpload(c *gin.Context, username, key, id string) {
+	upload, e := getLiveUpload(username, key, id)
+	if e != nil {
+		writeS3Error(c, e)
+		return
+	}
+
+	var req completeMultipartUploadRequest
+	err := xml.NewDecoder(io.LimitReader(c.Request.Body, maxS3XMLSize)).Decode(&req)
+	if err != nil || len(req.Parts) == 0 {
+		writeS3Error(c, errS3MalformedXML)
+		return
+	}
+
+	uploaded := make(map[int]dao.Part)
+	for _, part := range upload.Parts {
+		uploaded[part.Number] = part
+	}
+
+	var (
+		parts []dao.Part
+		size  int64
+	)
+	sums := md5.New()
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			writeS3Error(c, errS3InvalidPartOrder)
+			return
+		}
+		part, ok := uploaded[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != part.ETag {
+			writeS3Error(c, errS3InvalidPart)
+			return
+		}
+
+		sum, _ := hex.DecodeString(part.ETag)
+		sums.Write(sum)
+		parts = append(parts, part)
+		size += part.Size
+	}
+	e = checkPartSizes(upload, parts)
+	if e != nil {
+		writeS3Error(c, e)
+		return
+	}
+	err = checkFilePath(username, key)
+	if err == errPathExists {
+		writeS3Error(c, errS3PathConflict)
+		return
+	}
+	if err != nil {
+		writeS3Error(c, errS3InternalError)
+		log.WithError(err).Errorf("check path of %v for %v", key, username)
+		return
+	}
+
+	// Removing the record claims the upload, so that it is completed once.
+	err = d.RemoveUpload(username, id)
+	if err == dao.ErrNoUpload {
+		writeS3Error(c, errS3NoSuchUpload)
+		return
+	}
+	if err != nil {
+		writeS3Error(c, errS3InternalError)
+		log.WithError(err).Errorf("remove upload %v of %v", id, username)
+		return
+	}
+	// The reservation holds the quota of the file until it is recorded.
+	defer uploadReservation(upload).release()
+
+	file, err := finishUpload(upload, parts, size)
+	if err == errStorageFailed {
+		writeS3Error(c, errS3ServiceUnavailable)
+		log.WithError(err).Errorf("complete upload of %v for %v", key, username)
+		return
+	}
+	if err != nil {
+		writeS3Error(c, errS3InternalError)
+		log.WithError(err).Errorf("complete upload of %v for %v", key, username)
+		return
+	}
+
+	// The checksums of the file are only known once it is read.
+	go checksumFile(username, *file)
+
+	c.XML(http.StatusOK, completeMultipartUploadResult{
+		Xmlns:  s3Namespace,
+		Bucket: username,
+		Key:    key,
+		ETag:   fmt.Sprintf(`"%x-%d"`, sums.Sum(nil), len(parts)),
+	})
+}
+
+// finishUpload completes the multipart uploads of the targets of upload
+// from parts, which are size bytes together, and records the file.
+func finishUpload(upload *dao.Upload, parts []dao.Part, size int64) (*dao.File, error) {
+	file := &dao.File{
+		Filename:     upload.Filename,
+		Size:         size,
+		LastModified: time.Now().Unix(),
+		Object:       upload.Object,
+	}
+
+	want := size
+	if e := upload.Erasure; e != nil {
+		want = 0
+		for _, part := range parts {
+			want += shardSize(part.Size, e.DataShards, e.BlockSize)
+		}
+		file.Erasure = &dao.Erasure{
+			DataShards:   e.DataShards,
+			ParityShards: e.ParityShards,
+			BlockSize:    e.BlockSize,
+			Shards:       make([]string, len(e.Shards)),
+		}
+	}
+
+	// A target a part has failed on is left out.
+	targets := make([]dao.Target, len(upload.Targets))
+	copy(targets, upload.Targets)
+	targetParts := make([][]dao.TargetPart, len(targets))
+	for i := range targets {
+		for _, part := range parts {
+			if targets[i].Failed || i >= len(part.TargetETags) || part.TargetETags[i] == "" {
+				targets[i].Failed = true
+				break
+			}
+			targetParts[i] = append(targetParts[i], dao.TargetPart{Number: part.Number, ETag: part.TargetETags[i]})
+		}
+		if targets[i].Failed && !upload.Targets[i].Failed {
+			abortMultipartOnSite(targets[i].Site, upload.Object, targets[i].UploadID)
+		}
+	}
+	completeTargets(file, targets, targetParts, want)
+
+	// recordFile removes the objects of the file if it is not recorded.
+	err := recordFile(upload.Username, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func abortMultipartUpload(c *gin.Context, username, key, id string) {
+	upload, e := getUpload(username, key, id)
+	if e != nil {
+		writeS3Error(c, e)
+		return
+	}
+
+	err := removeUpload(upload)
+	if err == dao.ErrNoUpload {
+		writeS3Error(c, errS3NoSuchUpload)
+		return
+	}
+	if err != nil {
+		writeS3Error(c, errS3InternalError)
+		log.WithError(err).Errorf("remove upload %v of %v", id, username)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// removeUpload removes the record of an upload, and then aborts its
+// multipart uploads, deletes the staged parts of uploads from before and
+// releases its quota reservation. It fails with dao.ErrNoUpload if the
+// upload has been removed already.
+func removeUpload(upload *dao.Upload) error {
+	err := d.RemoveUpload(upload.Username, upload.ID)
+	if err != nil {
+		return err
+	}
+
+	discardUpload(upload)
+	return nil
+}
+
+// discardUpload aborts the multipart uploads of a removed upload, deletes
+// its staged parts and releases its quota reservation.
+func discardUpload(upload *dao.Upload) {
+	abortTargets(upload.Targets, upload.Object)
+	for _, part := range upload.Parts {
+		if part.Object != "" {
+			removeObjects(&dao.File{Object: part.Object, Sites: []string{part.Site}})
+		}
+	}
+	uploadReservation(upload).release()
+}
+
+// sweepUploads removes the multipart uploads that have not been updated
+// since before. Uploads used since they have been read are left alone.
+func sweepUploads(before time.Time) {
+	uploads, err := d.GetStaleUploads(before.Unix())
+	if err != nil {
+		log.WithError(err).Errorln("get stale uploads")
+		return
+	}
+
+	for i := range uploads {
+		upload := &uploads[i]
+		err = d.RemoveStaleUpload(upload.Username, upload.ID, before.Unix())
+		switch {
+		case err == dao.ErrNoUpload:
+		case err != nil:
+			log.WithError(err).Errorf("remove upload %v of %v", upload.ID, upload.Username)
+		default:
+			discardUpload(upload)
+			log.Infof("aborted upload %v of %v unused since %v", upload.ID, upload.Username, time.Unix(lastUsed(upload), 0))
+		}
+	}
+}
+
+// lastUsed returns the time upload was last updated.
+func lastUsed(upload *dao.Upload) int64 {
+	if upload.Updated == 0 {
+		return upload.Created
+	}
+
+	return upload.Updated
+}
+
+// uploadReservation returns the quota reservation of a multipart upload.
+func uploadReservation(upload *dao.Upload) *reservation {
+	return &reservation{id: upload.ID, username: upload.Username, filename: upload.Filename}
+}
+
+func listParts(c *gin.Context, username, key, id string) {
+	upload, e := getUpload(username, key, id)
+	if e != nil {
+		writeS3Error(c, e)
+		return
+	}
+	query := c.Request.URL.Query()
+
+	result := listPartsResult{
+		Xmlns:    s3Namespace,
+		Bucket:   username,
+		Key:      key,
+		UploadId: id,
+		MaxParts: maxS3Parts,
+	}
+	if value := query.Get("max-parts"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeS3Error(c, errS3InvalidArgument)
+			return
+		}
+		if n < result.MaxParts {
+			result.MaxParts = n
+		}
+	}
+	if value := query.Get("part-number-marker"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeS3Error(c, errS3InvalidArgument)
+			return
+		}
+		result.PartNumberMarker = n
+	}
+
+	parts := make([]dao.Part, 0, len(upload.Parts))
+	for _, part := range upload.Parts {
+		if part.Number > result.PartNumberMarker {
+			parts = append(parts, part)
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+	if len(parts) > result.MaxParts {
+		parts, result.IsTruncated = parts[:result.MaxParts], true
+	}
+
+	for _, part := range parts {
+		modified := part.LastModified
+		if modified == 0 {
+			modified = upload.Created
+		}
+		result.Parts = append(result.Parts, s3Part{
+			PartNumber:   part.Number,
+			LastModified: time.Unix(modified, 0).UTC().Format(time.RFC3339),
+			ETag:         `"` + part.ETag + `"`,
+			Size:         part.Size,
+		})
+		result.NextPartNumberMarker = part.Number
+	}
+
+	c.XML(http.StatusOK, result)
+}
+
+func listMultipartUploads(c *gin.Context, username string) {
+	query := c.Request.URL.Query()
+	result := listMultipartUploadsResult{
+		Xmlns:          s3Namespace,
+		Bucket:         username,
+		KeyMarker:      query.Get("key-marker"),
+		UploadIdMarker: query.Get("upload-id-marker"),
+		Prefix:         query.Get("prefix"),
+		Delimiter:      query.Get("delimiter"),
+		MaxUploads:     maxS3Parts,
+	}
+	if value := query.Get("max-uploads"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeS3Error(c, errS3InvalidArgument)
+			return
+		}
+		if n < result.MaxUploads {
+			result.MaxUploads = n
+		}
+	}
+
+	uploads, err := d.GetUserUploads(username)
+	if err != nil {
+		writeS3Error(c, errS3InternalError)
+		log.WithError(err).Errorf("list %v's uploads", username)
+		return
+	}
+
+	// Uploads of keys before the key marker are skipped, and so are those of
+	// the key marker itself up to the upload id marker, or all of them
+	// without one. A common prefix as key marker skips its keys.
+	pastMarker := false
+	seen := make(map[string]bool)
+	for i := range uploads {
+		upload := &uploads[i]
+		if !strings.HasPrefix(upload.Filename, result.Prefix) || upload.Filename < result.KeyMarker {
+			continue
+		}
+		if upload.Filename == result.KeyMarker && (result.UploadIdMarker == "" || !pastMarker) {
+			pastMarker = pastMarker || upload.ID == result.UploadIdMarker
+			continue
+		}
+		if result.Delimiter != "" && strings.HasSuffix(result.KeyMarker, result.Delimiter) && strings.HasPrefix(upload.Filename, result.KeyMarker) {
+			continue
+		}
+
+		// Keys with the delimiter after the prefix are rolled up into a
+		// common prefix.
+		prefix := ""
+		if result.Delimiter != "" {
+			rest := upload.Filename[len(result.Prefix):]
+			if j := strings.Index(rest, result.Delimiter); j >= 0 {
+				prefix = result.Prefix + rest[:j+len(result.Delimiter)]
+			}
+		}
+		if prefix != "" && seen[prefix] {
+			continue
+		}
+
+		if len(result.Uploads)+len(result.CommonPrefixes) == result.MaxUploads {
+			result.IsTruncated = true
+			break
+		}
+		if prefix != "" {
+			seen[prefix] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, s3Prefix{Prefix: prefix})
+			result.NextKeyMarker, result.NextUploadIdMarker = prefix, ""
+			continue
+		}
+		result.Uploads = append(result.Uploads, s3Upload{
+			Key:       upload.Filename,
+			UploadId:  upload.ID,
+			Initiated: time.Unix(upload.Created, 0).UTC().Format(time.RFC3339),
+		})
+		result.NextKeyMarker, result.NextUploadIdMarker = upload.Filename, upload.ID
+	}
+
+	c.XML(http.StatusOK, result)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPartSizes(t *testing.T) {
+	replicated := &dao.Upload{}
+	erasure := &dao.Upload{Erasure: &dao.Erasure{DataShards: 2, ParityShards: 1, BlockSize: maxBlockSize}}
+	sizes := func(sizes ...int64) []dao.Part {
+		parts := make([]dao.Part, len(sizes))
+		for i, size := range sizes {
+			parts[i] = dao.Part{Number: i + 1, Size: size}
+		}
+		return parts
+	}
+
+	tests := []struct {
+		name   string
+		upload *dao.Upload
+		parts  []dao.Part
+		ok     bool
+	}{
+		{"single small part", replicated, sizes(1), true},
+		{"small last part", replicated, sizes(minPartSize, 1), true},
+		{"small first part", replicated, sizes(minPartSize-1, 1), false},
+		{"whole chunks", erasure, sizes(2*sessionChunkSize, 4*sessionChunkSize, 1), true},
+		{"misaligned part", erasure, sizes(sessionChunkSize, 1), false},
+		{"single erasure part", erasure, sizes(100), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := checkPartSizes(tt.upload, tt.parts)
+			require.Equal(t, tt.ok, e == nil, "%v", e)
+		})
+	}
+}
+
+// s3Request serves a request of username by the S3 gateway.
+func s3Request(username, method, target string, body []byte) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.Any("/*path", func(c *gin.Context) {
+		c.Set(usernameKey, username)
+		s3Handler(c)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewReader(body)))
+	return w
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	const username = "s3-multipart-test"
+	sites, cleanup := newTestSites(t, 2)
+	defer cleanup()
+	newTestSessionUser(t, username, sites)
+
+	w := s3Request(username, http.MethodPost, "/"+username+"/dir/f?uploads", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created initiateMultipartUploadResult
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &created))
+	for _, site := range sites {
+		require.Equal(t, 1, site.pendingUploads())
+	}
+
+	first, last := testContent(minPartSize), testContent(100)
+	put := func(number int, content []byte) string {
+		w := s3Request(username, http.MethodPut, fmt.Sprintf("/%v/dir/f?uploadId=%v&partNumber=%v", username, created.UploadId, number), content)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return w.Header().Get("ETag")
+	}
+	put(1, last)
+	etag2 := put(2, last)
+	for _, site := range sites {
+		require.Equal(t, 2, site.partCount())
+	}
+
+	w = s3Request(username, http.MethodGet, fmt.Sprintf("/%v/dir/f?uploadId=%v&max-parts=1", username, created.UploadId), nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var parts listPartsResult
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &parts))
+	require.True(t, parts.IsTruncated)
+	require.Equal(t, 1, parts.NextPartNumberMarker)
+	require.Len(t, parts.Parts, 1)
+	require.Equal(t, int64(len(last)), parts.Parts[0].Size)
+
+	w = s3Request(username, http.MethodGet, "/"+username+"?uploads&delimiter=/", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var uploads listMultipartUploadsResult
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &uploads))
+	require.Equal(t, []s3Prefix{{Prefix: "dir/"}}, uploads.CommonPrefixes)
+	w = s3Request(username, http.MethodGet, "/"+username+"?uploads&prefix=dir/", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	uploads = listMultipartUploadsResult{}
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &uploads))
+	require.Len(t, uploads.Uploads, 1)
+	require.Equal(t, created.UploadId, uploads.Uploads[0].UploadId)
+
+	complete := func(etag1 string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf("<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>%v</ETag></Part><Part><PartNumber>2</PartNumber><ETag>%v</ETag></Part></CompleteMultipartUpload>", etag1, etag2)
+		return s3Request(username, http.MethodPost, fmt.Sprintf("/%v/dir/f?uploadId=%v", username, created.UploadId), []byte(body))
+	}
+	// All parts but the last have to be of the least size.
+	w = complete(put(1, last))
+	require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), "EntityTooSmall")
+
+	w = complete(put(1, first))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	content := append(append([]byte{}, first...), last...)
+	file, err := d.GetFileInfo(username, "dir/f")
+	require.Nil(t, err)
+	require.Equal(t, int64(len(content)), file.Size)
+	require.Equal(t, siteNames(sites), file.Sites)
+	for _, site := range sites {
+		require.Equal(t, 0, site.pendingUploads())
+		stored, ok := site.object(file.Object)
+		require.True(t, ok)
+		require.Equal(t, content, stored)
+	}
+	requireReserved(t, username, 0, 0)
+	w = complete(etag2)
+	require.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	// The checksums are recorded once the file has been read.
+	for i := 0; i < 100 && file.MD5 == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		file, err = d.GetFileInfo(username, "dir/f")
+		require.Nil(t, err)
+	}
+	r, _, err := openFile(username, file, 0)
+	require.Nil(t, err)
+	read, err := ioutil.ReadAll(r)
+	r.Close()
+	require.Nil(t, err)
+	require.Equal(t, content, read)
+	require.NotEmpty(t, file.SHA256)
+}
+
+func TestSweepUploads(t *testing.T) {
+	const username = "s3-sweep-test"
+	sites, cleanup := newTestSites(t, 2)
+	defer cleanup()
+	newTestSessionUser(t, username, sites)
+
+	upload, err := startUpload(username, "f")
+	require.Nil(t, err)
+	// Uploads from before have their parts staged on a site.
+	sites[0].setObject("staged", []byte("part"))
+	legacy := dao.Upload{
+		ID:       newID(),
+		Username: username,
+		Filename: "g",
+		Created:  time.Now().Unix(),
+		Parts:    []dao.Part{{Number: 1, Size: 4, ETag: "e", Site: sites[0].name, Object: "staged"}},
+	}
+	require.Nil(t, d.CreateUpload(legacy))
+
+	sweepUploads(time.Now().Add(-time.Hour))
+	_, err = d.GetUpload(username, upload.ID)
+	require.Nil(t, err)
+
+	sweepUploads(time.Now().Add(time.Hour))
+	uploads, err := d.GetUserUploads(username)
+	require.Nil(t, err)
+	require.Empty(t, uploads)
+	for _, site := range sites {
+		require.Equal(t, 0, site.pendingUploads())
+	}
+	_, ok := sites[0].object("staged")
+	require.False(t, ok)
+	requireReserved(t, username, 0, 0)
+}
@@ -1,42 +1,98 @@
 package main
 
 import (
-	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"path"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
-	pb "github.com/Sean-Pearce/jcs/service/scheduler/proto"
+	"github.com/Sean-Pearce/jcs/service/httpserver/token"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// defaultListLimit and maxListLimit are the default and the largest
+	// number of files listed at once.
+	defaultListLimit = 100
+	maxListLimit     = 1000
 )
 
 const (
 	// OK
 	codeOK = 9200
 	// BadRequest
-	codeUploadError   = 9400
-	codeAuthFail      = 9401
-	codeInvalidToken  = 9402
-	codeFileNotExists = 9404
+	codeUploadError      = 9400
+	codeAuthFail         = 9401
+	codeInvalidToken     = 9402
+	codePermissionDenied = 9403
+	codeFileNotExists    = 9404
+	codeInvalidRequest   = 9405
+	codeQuotaExceeded    = 9406
 	// InternalError
 	codeInternalError = 9500
 )
 
 func tokenAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := c.GetHeader("X-Token")
-		if token == "" {
-			token = c.Query("t")
+		username, err := tokens.Get(requestToken(c))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code":    codeInvalidToken,
+				"message": "Invalid token",
+			})
+			c.Abort()
+			if err != token.ErrInvalidToken {
+				log.WithError(err).Errorln("get token")
+			}
+			return
+		}
+
+		// Tokens outlive a failed revocation, so users disabled or deleted
+		// since they logged in are turned away here.
+		user, err := d.GetUserInfo(username)
+		if err != nil && err != mongo.ErrNoDocuments {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"code":    codeInternalError,
+				"message": "Something is wrong.",
+			})
+			c.Abort()
+			log.WithError(err).Errorf("get %v's info", username)
+			return
 		}
-		if _, ok := tokenMap[token]; !ok {
+		if err == mongo.ErrNoDocuments || (user != nil && user.Disabled) {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"code":    codeInvalidToken,
 				"message": "Invalid token",
 			})
 			c.Abort()
+			return
+		}
+
+		c.Set(usernameKey, username)
+		c.Next()
+	}
+}
+
+// adminOnly restricts the following handlers to enabled users of the admin
+// role.
+func adminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := c.GetString(usernameKey)
+
+		user, err := d.GetUserInfo(username)
+		if err != nil || user.Role != roleAdmin || user.Disabled {
+			c.JSON(http.StatusForbidden, gin.H{
+				"code":    codePermissionDenied,
+				"message": "Permission denied.",
+			})
+			c.Abort()
+			return
 		}
 
 		c.Next()
@@ -47,17 +103,34 @@ func login(c *gin.Context) {
 	username := c.Request.FormValue("username")
 	password := c.Request.FormValue("password")
 
-	user, err := d.GetUserInfo(username)
-	if err != nil || user.Password != password {
+	user, err := d.VerifyPassword(username, password)
+	if err != nil {
+		if err != dao.ErrWrongPassword && err != mongo.ErrNoDocuments {
+			log.WithError(err).Errorf("verify %v's password", username)
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"code":    codeAuthFail,
 			"message": "Account and password are incorrect.",
 		})
 		return
 	}
+	if user.Disabled {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    codePermissionDenied,
+			"message": "User disabled.",
+		})
+		return
+	}
 
-	token := genToken()
-	tokenMap[token] = username
+	token, err := tokens.Create(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("create token for %v", username)
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"code": codeOK,
@@ -68,8 +141,15 @@ func login(c *gin.Context) {
 }
 
 func logout(c *gin.Context) {
-	token := c.GetHeader("X-Token")
-	delete(tokenMap, token)
+	err := tokens.Revoke(requestToken(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorln("revoke token")
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    codeOK,
@@ -77,261 +157,1200 @@ func logout(c *gin.Context) {
 	})
 }
 
-func info(c *gin.Context) {
-	username := getUsernameByToken(c.GetHeader("X-Token"))
+func changePassword(c *gin.Context) {
+	username := c.GetString(usernameKey)
 
-	user, err := d.GetUserInfo(username)
+	var form struct {
+		OldPassword string `json:"old_password" binding:"required"`
+		NewPassword string `json:"new_password" binding:"required"`
+	}
+	err := c.ShouldBindJSON(&form)
+	if err != nil || !validatePassword(form.NewPassword) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Password must have 6 to 72 characters.",
+		})
+		return
+	}
+
+	_, err = d.VerifyPassword(username, form.OldPassword)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{
-			"code":    codeInvalidToken,
-			"message": "User not exist.",
+			"code":    codeAuthFail,
+			"message": "Old password is incorrect.",
+		})
+		return
+	}
+
+	err = d.SetUserPassword(username, form.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
 		})
+		log.WithError(err).Errorf("set %v's password", username)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"code": codeOK,
-		"data": gin.H{
-			"role":   user.Role,
-			"avatar": "https://wpimg.wallstcn.com/f778738c-e4f8-4870-b634-56703b4acafe.gif",
-		},
+		"code":    codeOK,
+		"message": "Change password successfully",
 	})
 }
 
-func list(c *gin.Context) {
-	username := getUsernameByToken(c.GetHeader("X-Token"))
+func resetPassword(c *gin.Context) {
+	var form struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	err := c.ShouldBindJSON(&form)
+	if err != nil || !validatePassword(form.Password) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Password must have 6 to 72 characters.",
+		})
+		return
+	}
 
-	files, err := d.GetUserFiles(username)
+	err = d.SetUserPassword(form.Username, form.Password)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "User not exist.",
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    codeInternalError,
 			"message": "Something is wrong.",
 		})
-		log.WithError(err).Errorf("get %v's files", username)
+		log.WithError(err).Errorf("reset %v's password", form.Username)
+		return
+	}
+
+	// Sessions opened with the old password end.
+	err = tokens.RevokeUser(form.Username)
+	if err != nil {
+		log.WithError(err).Errorf("revoke %v's tokens", form.Username)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    codeOK,
+		"message": "Reset password successfully",
+	})
+}
+
+// getKeys returns the S3 credentials of the user, empty if none have been
+// created.
+func getKeys(c *gin.Context) {
+	username := c.GetString(usernameKey)
+
+	user, err := d.GetUserInfo(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    codeInvalidToken,
+			"message": "User not exist.",
+		})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"code": codeOK,
 		"data": gin.H{
-			"total": len(*files),
-			"items": files,
+			"access_key": user.AccessKey,
+			"secret_key": user.SecretKey,
 		},
 	})
 }
 
-func getStrategy(c *gin.Context) {
-	username := getUsernameByToken(c.GetHeader("X-Token"))
+// createKeys creates new S3 credentials for the user, replacing the old
+// ones.
+func createKeys(c *gin.Context) {
+	username := c.GetString(usernameKey)
 
-	strategy, err := d.GetUserStrategy(username)
+	accessKey, secretKey := genKeys()
+	err := d.SetUserKeys(username, accessKey, secretKey)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    codeInternalError,
 			"message": "Something is wrong.",
 		})
-		log.WithError(err).Errorf("get %v's strategy", username)
+		log.WithError(err).Errorf("set %v's keys", username)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"code": codeOK,
 		"data": gin.H{
-			"sites":    clientList,
-			"strategy": strategy,
+			"access_key": accessKey,
+			"secret_key": secretKey,
 		},
 	})
 }
 
-func setStrategy(c *gin.Context) {
-	username := getUsernameByToken(c.GetHeader("X-Token"))
+func info(c *gin.Context) {
+	username := c.GetString(usernameKey)
 
-	// TODO: validate form
-	var strategy dao.Strategy
-	c.BindJSON(&strategy)
+	user, err := d.GetUserInfo(username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    codeInvalidToken,
+			"message": "User not exist.",
+		})
+		return
+	}
 
-	err := d.SetUserStrategy(username, strategy)
+	quota, err := d.GetUserQuota(username)
+	var usage *dao.Usage
+	if err == nil {
+		usage, err = d.GetUserUsage(username)
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    codeInternalError,
 			"message": "Something is wrong.",
 		})
-		log.WithError(err).Errorf("set %v's strategy", username)
+		log.WithError(err).Errorf("get %v's quota", username)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"code":    codeOK,
-		"message": "Set strategy successfully",
+		"code": codeOK,
+		"data": gin.H{
+			"role":   user.Role,
+			"avatar": "https://wpimg.wallstcn.com/f778738c-e4f8-4870-b634-56703b4acafe.gif",
+			"quota": gin.H{
+				"mode":       *quotaMode,
+				"max_bytes":  quota.MaxBytes,
+				"max_files":  quota.MaxFiles,
+				"used_bytes": countedBytes(usage),
+				"files":      usage.Files,
+			},
+		},
 	})
 }
 
-func upload(c *gin.Context) {
-	username := getUsernameByToken(c.GetHeader("X-Token"))
+func list(c *gin.Context) {
+	username := c.GetString(usernameKey)
 
-	// TODO: FormFile reads all c.body
-	file, err := c.FormFile("file")
+	q, err := fileQuery(c)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"code":    codeUploadError,
-			"message": "Form key must be 'file'",
+			"code":    codeInvalidRequest,
+			"message": "Invalid query: " + err.Error() + ".",
 		})
 		return
 	}
 
-	_, err = d.GetFileInfo(username, file.Filename)
-	if err == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"code":    codeUploadError,
-			"message": "File already exists",
-		})
+	// Files under a prefix are listed like S3 does, with the paths that have
+	// the delimiter after the prefix rolled up into directories.
+	if delimiter := c.Query("delimiter"); delimiter != "" {
+		listDir(c, username, q, delimiter)
 		return
 	}
 
-	// user1/testfile
-	filename := path.Join(username, file.Filename)
-
-	body, err := file.Open()
-	if err != nil {
+	page, err := d.QueryFiles(username, *q)
+	if err == dao.ErrInvalidCursor {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"code":    codeUploadError,
-			"message": "Cannot open file",
+			"code":    codeInvalidRequest,
+			"message": "Invalid cursor.",
 		})
 		return
 	}
-
-	strategy, err := d.GetUserStrategy(username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    codeInternalError,
 			"message": "Something is wrong.",
 		})
-		log.WithError(err).Errorf("get %v's strategy", username)
+		log.WithError(err).Errorf("get %v's files", username)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+	c.JSON(http.StatusOK, gin.H{
+		"code": codeOK,
+		"data": gin.H{
+			"total":       page.Total,
+			"items":       page.Files,
+			"next_cursor": page.NextCursor,
+		},
+	})
+}
 
-	resp, err := s.Schedule(
-		ctx,
-		&pb.ScheduleRequest{Sites: strategy.Sites},
-	)
+// listDir serves a list request with a delimiter, one page of the files
+// and directories under the prefix of q.
+func listDir(c *gin.Context, username string, q *dao.FileQuery, delimiter string) {
+	page, err := d.ListDir(username, dao.DirQuery{
+		Prefix:    q.Prefix,
+		Delimiter: delimiter,
+		Cursor:    q.Cursor,
+		Limit:     q.Limit,
+		Dirs:      true,
+	})
+	if err == dao.ErrInvalidCursor {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Invalid cursor.",
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    codeInternalError,
 			"message": "Something is wrong.",
 		})
-		log.WithError(err).Errorf("schedule for %v, sites are %v", username, strategy.Sites)
+		log.WithError(err).Errorf("list %v's files under %v", username, q.Prefix)
 		return
 	}
 
-	var sites []string
-	for _, site := range resp.Sites {
-		resp, err := clientMap[site].Upload(body, filename)
-		if err != nil || resp.StatusCode != http.StatusCreated {
-			log.WithError(err).Errorf("upload %v to %v failed", filename, site)
-			continue
-		}
-		sites = append(sites, site)
+	c.JSON(http.StatusOK, gin.H{
+		"code": codeOK,
+		"data": gin.H{
+			"items":       page.Files,
+			"dirs":        page.Prefixes,
+			"next_cursor": page.NextCursor,
+		},
+	})
+}
+
+// fileQuery returns the file query of a list request.
+func fileQuery(c *gin.Context) (*dao.FileQuery, error) {
+	q := &dao.FileQuery{
+		Prefix: c.Query("prefix"),
+		Name:   c.Query("name"),
+		Site:   c.Query("site"),
+		Sort:   c.Query("sort"),
+		Desc:   c.Query("order") == "desc",
+		Cursor: c.Query("cursor"),
+		Limit:  defaultListLimit,
 	}
 
-	if len(sites) == 0 {
-		c.JSON(http.StatusOK, gin.H{
-			"code":    codeUploadError,
-			"message": "Upload to storage backends failed",
-		})
-		return
+	switch q.Sort {
+	case "", dao.SortByName, dao.SortBySize, dao.SortByLastModified:
+	default:
+		return nil, fmt.Errorf("sort must be %v, %v or %v", dao.SortByName, dao.SortBySize, dao.SortByLastModified)
 	}
 
-	item := dao.File{
-		Filename:     file.Filename,
-		Size:         file.Size,
-		LastModified: time.Now().Unix(),
-		Sites:        sites,
+	numbers := []struct {
+		name  string
+		value *int64
+	}{
+		{"min_size", &q.MinSize},
+		{"max_size", &q.MaxSize},
+		{"after", &q.After},
+		{"before", &q.Before},
+		{"offset", &q.Offset},
+		{"limit", &q.Limit},
+	}
+	for _, n := range numbers {
+		value := c.Query(n.name)
+		if value == "" {
+			continue
+		}
+		var err error
+		*n.value, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || *n.value < 0 {
+			return nil, fmt.Errorf("%v must be a number not less than 0", n.name)
+		}
 	}
-	err = d.AddFile(username, item)
+	if q.Limit == 0 || q.Limit > maxListLimit {
+		q.Limit = maxListLimit
+	}
+
+	return q, nil
+}
+
+func getStrategy(c *gin.Context) {
+	username := c.GetString(usernameKey)
+
+	strategy, err := d.GetUserStrategy(username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    codeInternalError,
 			"message": "Something is wrong.",
 		})
-		log.WithError(err).Errorf("add file %v for %v", filename, username)
+		log.WithError(err).Errorf("get %v's strategy", username)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"code": codeOK,
+		"data": gin.H{
+			"sites":    registry.list(),
+			"regions":  registry.listRegions(),
+			"strategy": strategy,
+		},
 	})
 }
 
-func deleteFile(c *gin.Context) {
-	username := getUsernameByToken(c.GetHeader("X-Token"))
-	filename := c.Param("filename")
+func setStrategy(c *gin.Context) {
+	username := c.GetString(usernameKey)
 
-	file, err := d.GetFileInfo(username, filename)
+	var strategy dao.Strategy
+	err := c.ShouldBindJSON(&strategy)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"code":    codeFileNotExists,
-			"message": "The given file not exists.",
+			"code":    codeInvalidRequest,
+			"message": "Invalid strategy.",
 		})
 		return
 	}
 
-	for _, site := range file.Sites {
-		resp, err := clientMap[site].Delete(path.Join(username, filename))
-		if err != nil || resp.StatusCode != http.StatusOK {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"code":    codeInternalError,
-				"message": "Something is wrong.",
-			})
-			logrus.WithError(err).Errorf("delete %v in %v failed", filename, file.Sites[0], resp.StatusCode)
-			return
-		}
-		resp.Body.Close()
+	if strategy.Version == 0 {
+		strategy.Version = dao.StrategyVersion
+	}
+	errs := validateStrategy(&strategy)
+	if len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Invalid strategy.",
+			"data": gin.H{
+				"errors": errs,
+			},
+		})
+		return
 	}
 
-	err = d.RemoveFile(username, filename)
+	err = d.SetUserStrategy(username, strategy)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    codeInternalError,
 			"message": "Something is wrong.",
 		})
-		logrus.WithError(err).Errorf("Remove file %v from database failed", filename)
+		log.WithError(err).Errorf("set %v's strategy", username)
 		return
 	}
 
+	// Files stay where they are unless asked to be moved.
+	if c.Query("migrate") == "true" {
+		migrations.start(username)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"code":    codeOK,
-		"message": "Delete file successfully",
+		"message": "Set strategy successfully",
 	})
 }
 
-func download(c *gin.Context) {
-	username := getUsernameByToken(c.Query("t"))
-	filename := c.Query("filename")
+func getMigration(c *gin.Context) {
+	username := c.GetString(usernameKey)
 
-	file, err := d.GetFileInfo(username, filename)
+	job := migrations.get(username)
+	if job == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    codeFileNotExists,
+			"message": "No migration has been started.",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": codeOK,
+		"data": job,
+	})
+}
+
+func upload(c *gin.Context) {
+	username := c.GetString(usernameKey)
+
+	reader, err := c.Request.MultipartReader()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"code":    codeFileNotExists,
-			"message": "The given file not exists.",
+			"code":    codeUploadError,
+			"message": "Multipart form expected",
 		})
 		return
 	}
 
-	// TODO: choose best site
-	resp, err := clientMap[file.Sites[0]].Download(path.Join(username, filename))
-	if err != nil || resp.StatusCode != http.StatusOK {
+	part, size, err := nextFilePart(reader)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeUploadError,
+			"message": "Form key must be 'file'",
+		})
+		return
+	}
+	defer part.Close()
+
+	// Files go to the directory given, or to the top. The name is checked
+	// before joining so that it cannot climb out of the directory.
+	filename, err := cleanPath(part.FileName())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Invalid filename.",
+		})
+		return
+	}
+	if dir := c.Query("dir"); dir != "" {
+		dir, err = cleanPath(dir)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    codeInvalidRequest,
+				"message": "Invalid directory.",
+			})
+			return
+		}
+		filename = path.Join(dir, filename)
+	}
+
+	_, err = d.GetFileInfo(username, filename)
+	if err == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    codeUploadError,
+			"message": "File already exists",
+		})
+		return
+	}
+	if err != dao.ErrFileNotFound {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    codeInternalError,
 			"message": "Something is wrong.",
 		})
-		logrus.WithError(err).Errorf("download %v from %v failed", filename, file.Sites[0], resp.StatusCode)
+		log.WithError(err).Errorf("get file %v of %v", filename, username)
 		return
 	}
-	defer resp.Body.Close()
 
-	c.DataFromReader(http.StatusOK, resp.ContentLength, "multipart/form-data", resp.Body, map[string]string{
-		"Content-Disposition": "attachment; filename=" + filename,
+	_, results, err := storeFile(username, filename, part, size)
+	if err == errPathExists {
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "A directory of the same name or a file in place of a parent directory exists.",
+		})
+		return
+	}
+	if err == errQuotaExceeded {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    codeQuotaExceeded,
+			"message": "Quota exceeded.",
+		})
+		return
+	}
+	if errors.Is(err, errUploadInterrupted) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeUploadError,
+			"message": "Upload interrupted",
+		})
+		log.WithError(err).Errorf("upload %v for %v", filename, username)
+		return
+	}
+	if err == errStorageFailed {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    codeUploadError,
+			"message": "Upload to storage backends failed",
+			"data": gin.H{
+				"sites": results,
+			},
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("upload %v for %v", filename, username)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": codeOK,
+		"data": gin.H{
+			"sites": results,
+		},
+	})
+}
+
+func createUpload(c *gin.Context) {
+	username := c.GetString(usernameKey)
+
+	var form struct {
+		Filename string `json:"filename" binding:"required"`
+		Size     *int64 `json:"size" binding:"required"`
+	}
+	err := c.ShouldBindJSON(&form)
+	if err == nil && *form.Size >= 0 {
+		form.Filename, err = cleanPath(form.Filename)
+	}
+	if err != nil || *form.Size < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Filename and size are required.",
+		})
+		return
+	}
+
+	_, err = d.GetFileInfo(username, form.Filename)
+	if err == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    codeUploadError,
+			"message": "File already exists",
+		})
+		return
+	}
+	if err != dao.ErrFileNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("get file %v of %v", form.Filename, username)
+		return
+	}
+
+	session, err := createSession(username, form.Filename, *form.Size)
+	if err == errPathExists {
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "A directory of the same name or a file in place of a parent directory exists.",
+		})
+		return
+	}
+	if err == errQuotaExceeded {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    codeQuotaExceeded,
+			"message": "Quota exceeded.",
+		})
+		return
+	}
+	if err == errStorageFailed {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    codeUploadError,
+			"message": "Upload to storage backends failed",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("create upload of %v for %v", form.Filename, username)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": codeOK,
+		"data": session,
+	})
+}
+
+func listUploads(c *gin.Context) {
+	username := c.GetString(usernameKey)
+
+	sessions, err := d.GetUploadSessions(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("get %v's uploads", username)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": codeOK,
+		"data": gin.H{
+			"total": len(sessions),
+			"items": sessions,
+		},
+	})
+}
+
+// getSession returns the upload session of the request, it writes the error
+// response if there is none.
+func getSession(c *gin.Context) (*dao.UploadSession, bool) {
+	username := c.GetString(usernameKey)
+
+	session, err := d.GetUploadSession(username, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    codeFileNotExists,
+			"message": "The given upload not exists.",
+		})
+		return nil, false
+	}
+
+	return session, true
+}
+
+func uploadStatus(c *gin.Context) {
+	session, ok := getSession(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": codeOK,
+		"data": session,
+	})
+}
+
+func putUploadChunk(c *gin.Context) {
+	session, ok := getSession(c)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
+	if err != nil || c.Request.ContentLength < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Offset and content length are required.",
+		})
+		return
+	}
+
+	err = putChunk(session, offset, c.Request.Body, c.Request.ContentLength)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{
+			"code": codeOK,
+			"data": session,
+		})
+	case err == errOffsetMismatch, err == dao.ErrSessionChanged:
+		// The client resumes from the offset the session is at.
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Offset mismatch.",
+			"data":    session,
+		})
+	case err == errChunkSize:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Chunks must be of the chunk size, except the last one.",
+			"data":    session,
+		})
+	case errors.Is(err, errUploadInterrupted):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeUploadError,
+			"message": "Upload interrupted",
+			"data":    session,
+		})
+		log.WithError(err).Errorf("upload chunk of %v at %v", session.Filename, offset)
+	case err == errStorageFailed:
+		c.JSON(http.StatusOK, gin.H{
+			"code":    codeUploadError,
+			"message": "Upload to storage backends failed",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("upload chunk of %v at %v", session.Filename, offset)
+	}
+}
+
+func completeUpload(c *gin.Context) {
+	session, ok := getSession(c)
+	if !ok {
+		return
+	}
+
+	file, err := completeSession(session)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{
+			"code": codeOK,
+			"data": file,
+		})
+	case err == dao.ErrSessionChanged:
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Upload in progress.",
+		})
+	case err == errSessionIncomplete:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Upload incomplete.",
+			"data":    session,
+		})
+	case err == errStorageFailed:
+		c.JSON(http.StatusOK, gin.H{
+			"code":    codeUploadError,
+			"message": "Upload to storage backends failed",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("complete upload of %v", session.Filename)
+	}
+}
+
+func abortUpload(c *gin.Context) {
+	session, ok := getSession(c)
+	if !ok {
+		return
+	}
+
+	err := abortSession(session)
+	if err == dao.ErrSessionChanged {
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Upload in progress.",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("abort upload of %v", session.Filename)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    codeOK,
+		"message": "Abort upload successfully",
+	})
+}
+
+func deleteFile(c *gin.Context) {
+	username := c.GetString(usernameKey)
+	filename := strings.TrimPrefix(c.Param("filename"), "/")
+
+	file, err := d.GetFileInfo(username, filename)
+	if err == dao.ErrFileNotFound {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeFileNotExists,
+			"message": "The given file not exists.",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("get file %v of %v", filename, username)
+		return
+	}
+
+	err = removeFile(username, file)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		logrus.WithError(err).Errorf("remove file %v failed", filename)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    codeOK,
+		"message": "Delete file successfully",
+	})
+}
+
+func download(c *gin.Context) {
+	username := c.GetString(usernameKey)
+	filename := c.Query("filename")
+
+	file, err := d.GetFileInfo(username, filename)
+	if err == dao.ErrFileNotFound {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeFileNotExists,
+			"message": "The given file not exists.",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("get file %v of %v", filename, username)
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+path.Base(filename))
+	err = serveFile(c, username, file)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		logrus.WithError(err).Errorf("download %v from %v failed", filename, file.Sites)
+	}
+}
+
+func getRepairStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"code": codeOK,
+		"data": repairs.snapshot(),
+	})
+}
+
+func startRepair(c *gin.Context) {
+	if !repairs.start() {
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "A repair pass is already running.",
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"code":    codeOK,
+		"message": "Repair pass started.",
+	})
+}
+
+func getSiteStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"code": codeOK,
+		"data": aggregateStats(registry.listStats()),
+	})
+}
+
+func getQuotas(c *gin.Context) {
+	roles, err := d.GetRoleQuotas()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorln("get role quotas")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": codeOK,
+		"data": gin.H{
+			"mode":  *quotaMode,
+			"roles": roles,
+		},
+	})
+}
+
+// bindQuota binds the quota of the request, it writes the error response if
+// the quota is invalid.
+func bindQuota(c *gin.Context) (*dao.Quota, bool) {
+	var quota dao.Quota
+	err := c.ShouldBindJSON(&quota)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Invalid quota.",
+		})
+		return nil, false
+	}
+	if errs := validateQuota(&quota); len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Invalid quota.",
+			"data": gin.H{
+				"errors": errs,
+			},
+		})
+		return nil, false
+	}
+
+	return &quota, true
+}
+
+func setRoleQuota(c *gin.Context) {
+	role := c.Param("role")
+	quota, ok := bindQuota(c)
+	if !ok {
+		return
+	}
+
+	err := d.SetRoleQuota(role, *quota)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("set quota of role %v", role)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    codeOK,
+		"message": "Set quota successfully",
+	})
+}
+
+// setUserQuota sets the quota of a user, or with DELETE has the user fall
+// back to the quota of the role.
+func setUserQuota(c *gin.Context) {
+	username := c.Param("username")
+	var quota *dao.Quota
+	if c.Request.Method != http.MethodDelete {
+		var ok bool
+		quota, ok = bindQuota(c)
+		if !ok {
+			return
+		}
+	}
+
+	err := d.SetUserQuota(username, quota)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "User not exist.",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("set %v's quota", username)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    codeOK,
+		"message": "Set quota successfully",
+	})
+}
+
+func listUsers(c *gin.Context) {
+	users, err := d.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorln("list users")
+		return
+	}
+
+	infos := make([]userInfo, len(users))
+	for i := range users {
+		infos[i] = newUserInfo(&users[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": codeOK,
+		"data": infos,
+	})
+}
+
+func createUser(c *gin.Context) {
+	var form struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	err := c.ShouldBindJSON(&form)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Invalid user.",
+		})
+		return
+	}
+	if form.Role == "" {
+		form.Role = roleUser
+	}
+	if errs := validateUser(form.Username, form.Password, form.Role); len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Invalid user.",
+			"data": gin.H{
+				"errors": errs,
+			},
+		})
+		return
+	}
+
+	err = d.CreateNewUser(dao.User{
+		Username: form.Username,
+		Password: form.Password,
+		Role:     form.Role,
+	})
+	if err == dao.ErrUserExists {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "User already exists.",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("create user %v", form.Username)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    codeOK,
+		"message": "Create user successfully",
+	})
+}
+
+// notSelf rejects requests of admins about their own user, which could
+// lock them out.
+func notSelf(c *gin.Context) bool {
+	if c.Param("username") != c.GetString(usernameKey) {
+		return true
+	}
+
+	c.JSON(http.StatusBadRequest, gin.H{
+		"code":    codeInvalidRequest,
+		"message": "Cannot change your own user.",
+	})
+	return false
+}
+
+func setUserRole(c *gin.Context) {
+	username := c.Param("username")
+	if !notSelf(c) {
+		return
+	}
+	var form struct {
+		Role string `json:"role"`
+	}
+	err := c.ShouldBindJSON(&form)
+	if err != nil || !rolePattern.MatchString(form.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Invalid role.",
+		})
+		return
+	}
+
+	err = d.SetUserRole(username, form.Role)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "User not exist.",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("set %v's role", username)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    codeOK,
+		"message": "Set role successfully",
+	})
+}
+
+// setUserDisabled disables a user on PUT and enables it on DELETE. Disabled
+// users are logged out.
+func setUserDisabled(c *gin.Context) {
+	username := c.Param("username")
+	if !notSelf(c) {
+		return
+	}
+	disabled := c.Request.Method != http.MethodDelete
+
+	err := d.SetUserDisabled(username, disabled)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "User not exist.",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("set %v disabled to %v", username, disabled)
+		return
+	}
+
+	if disabled {
+		err = tokens.RevokeUser(username)
+		if err != nil {
+			log.WithError(err).Errorf("revoke %v's tokens", username)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    codeOK,
+		"message": "Set user successfully",
+	})
+}
+
+// deleteUser removes a user and its files. The user is disabled first, so
+// that nothing is stored while the files are deleted.
+func deleteUser(c *gin.Context) {
+	username := c.Param("username")
+	if !notSelf(c) {
+		return
+	}
+
+	err := d.SetUserDisabled(username, true)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "User not exist.",
+		})
+		return
+	}
+	if err == nil {
+		err = tokens.RevokeUser(username)
+	}
+	if err == nil {
+		err = removeUser(username)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    codeInternalError,
+			"message": "Something is wrong.",
+		})
+		log.WithError(err).Errorf("delete user %v", username)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    codeOK,
+		"message": "Delete user successfully",
+	})
+}
+
+func getGCStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"code": codeOK,
+		"data": orphans.snapshot(),
+	})
+}
+
+func startGC(c *gin.Context) {
+	var form struct {
+		Mode string `json:"mode"`
+	}
+	err := c.ShouldBindJSON(&form)
+	if form.Mode == "" {
+		form.Mode = gcDryRun
+	}
+	if err != nil || !validGCMode(form.Mode) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "Mode must be dry-run, quarantine or delete.",
+		})
+		return
+	}
+
+	if !orphans.start(form.Mode) {
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    codeInvalidRequest,
+			"message": "A gc pass is already running.",
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"code":    codeOK,
+		"message": "Gc pass started.",
 	})
 }
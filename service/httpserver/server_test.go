@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadInvalidFilename(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/storage/upload", upload)
+
+	for _, filename := range []string{"..", ".", "/", "a/.."} {
+		t.Run(filename, func(t *testing.T) {
+			var body bytes.Buffer
+			form := multipart.NewWriter(&body)
+			part, err := form.CreateFormFile("file", filename)
+			require.NoError(t, err)
+			part.Write([]byte("hello"))
+			require.NoError(t, form.Close())
+
+			req := httptest.NewRequest(http.MethodPost, "/api/storage/upload", &body)
+			req.Header.Set("Content-Type", form.FormDataContentType())
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			var resp struct {
+				Code int `json:"code"`
+			}
+			require.Equal(t, http.StatusBadRequest, w.Code)
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			require.Equal(t, codeInvalidRequest, resp.Code)
+		})
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/Sean-Pearce/jcs/service/scheduler/proto"
+	"github.com/Sean-Pearce/jcs/service/storage/client"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// failureCooldown is how long a failed site is ranked last.
+	failureCooldown = time.Minute
+	// latencyWeight is the weight of a new sample in the latency average.
+	latencyWeight = 0.2
+	// siteCheckTimeout bounds the pings and stats requests of each site.
+	siteCheckTimeout = 5 * time.Second
+)
+
+// errObjectNotFound is returned if a site does not have an object.
+var errObjectNotFound = errors.New("object not found")
+
+// siteRegistry holds the storage clients of the known sites. Sites come
+// from the static config and from discovery through the scheduler.
+type siteRegistry struct {
+	mu         sync.RWMutex
+	static     map[string]*client.StorageClient
+	discovered map[string]*client.StorageClient
+	// regions are the regions of the discovered sites.
+	regions map[string]string
+	health  map[string]*siteHealth
+	// stats are the latest stats the sites reported.
+	stats map[string]*siteStats
+}
+
+// siteHealth is what has been observed talking to a site.
+type siteHealth struct {
+	// latency is a moving average of response times, 0 if unknown.
+	latency time.Duration
+	// failures is the number of consecutive failures.
+	failures    int
+	lastFailure time.Time
+}
+
+func newSiteRegistry(static []client.StorageClient) *siteRegistry {
+	r := &siteRegistry{
+		static:     make(map[string]*client.StorageClient),
+		discovered: make(map[string]*client.StorageClient),
+		regions:    make(map[string]string),
+		health:     make(map[string]*siteHealth),
+		stats:      make(map[string]*siteStats),
+	}
+	for i := range static {
+		r.static[static[i].Name] = &static[i]
+	}
+
+	return r
+}
+
+// get returns the client of given site.
+func (r *siteRegistry) get(name string) (*client.StorageClient, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if c, ok := r.discovered[name]; ok {
+		return c, nil
+	}
+	if c, ok := r.static[name]; ok {
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("unknown site %v", name)
+}
+
+// list returns the names of all sites in order.
+func (r *siteRegistry) list() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.static)+len(r.discovered))
+	for name := range r.static {
+		names = append(names, name)
+	}
+	for name := range r.discovered {
+		if _, ok := r.static[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// region returns the region of given site, "" if it is unknown. Only sites
+// discovered through the scheduler have a known region.
+func (r *siteRegistry) region(name string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.regions[name]
+}
+
+// listRegions returns the regions of the discovered sites in order.
+func (r *siteRegistry) listRegions() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var regions []string
+	for _, region := range r.regions {
+		if region != "" && !seen[region] {
+			seen[region] = true
+			regions = append(regions, region)
+		}
+	}
+	sort.Strings(regions)
+
+	return regions
+}
+
+// setDiscovered replaces the discovered sites and their regions.
+func (r *siteRegistry) setDiscovered(clients map[string]*client.StorageClient, regions map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.discovered = clients
+	r.regions = regions
+}
+
+// setStats records the latest stats of site, nil if they are unknown.
+func (r *siteRegistry) setStats(site string, stats *siteStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if stats == nil {
+		delete(r.stats, site)
+		return
+	}
+	r.stats[site] = stats
+}
+
+// listStats returns the latest stats of the sites that reported them, in
+// order of name.
+func (r *siteRegistry) listStats() []*siteStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stats := make([]*siteStats, 0, len(r.stats))
+	for _, s := range r.stats {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+
+	return stats
+}
+
+// siteUsage returns the usage of the sites that reported their stats, for
+// the scheduler.
+func (r *siteRegistry) siteUsage() []*pb.SiteUsage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	usage := make([]*pb.SiteUsage, 0, len(r.stats))
+	for _, s := range r.stats {
+		usage = append(usage, &pb.SiteUsage{
+			Name:     s.Name,
+			Capacity: s.Capacity,
+			Used:     s.Used,
+		})
+	}
+
+	return usage
+}
+
+// observe records the outcome of a request to site. latency is 0 if the
+// request has not been timed.
+func (r *siteRegistry) observe(site string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, ok := r.health[site]
+	if !ok {
+		h = &siteHealth{}
+		r.health[site] = h
+	}
+
+	if err != nil {
+		h.failures++
+		h.lastFailure = time.Now()
+		return
+	}
+
+	h.failures = 0
+	if latency > 0 {
+		if h.latency == 0 {
+			h.latency = latency
+		} else {
+			h.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(h.latency))
+		}
+	}
+}
+
+// rank orders sites from best to worst: sites that failed recently go
+// last, the others are ordered by latency with unknown latencies after the
+// known ones.
+func (r *siteRegistry) rank(sites []string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	failed := func(site string) bool {
+		h, ok := r.health[site]
+		return ok && h.failures > 0 && time.Since(h.lastFailure) < failureCooldown
+	}
+	latency := func(site string) time.Duration {
+		if h, ok := r.health[site]; ok {
+			return h.latency
+		}
+		return 0
+	}
+
+	ranked := append([]string(nil), sites...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if failed(a) != failed(b) {
+			return !failed(a)
+		}
+		la, lb := latency(a), latency(b)
+		if (la == 0) != (lb == 0) {
+			return la != 0
+		}
+		return la < lb
+	})
+
+	return ranked
+}
+
+// downloadFromSite downloads filename from given site, starting at offset.
+func downloadFromSite(site, filename string, offset int64) (*http.Response, error) {
+	c, err := registry.get(site)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := c.DownloadRange(filename, offset, -1)
+	if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+		registry.observe(site, 0, fmt.Errorf("unexpected status %v", resp.StatusCode))
+	} else {
+		registry.observe(site, time.Since(start), err)
+	}
+
+	return resp, err
+}
+
+// openObject opens filename on site for reading from offset.
+func openObject(site, filename string, offset int64) (io.ReadCloser, error) {
+	resp, err := downloadFromSite(site, filename, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		// The site ignored the range, skip to offset.
+		_, err = io.CopyN(ioutil.Discard, resp.Body, offset)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp.Body, nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+}
+
+// objectInfo is what a site reports about an object.
+type objectInfo struct {
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag"`
+	ContentType  string `json:"content_type"`
+	LastModified int64  `json:"last_modified"`
+}
+
+// objectUsage is how much is stored on a site.
+type objectUsage struct {
+	Used    int64 `json:"used"`
+	Objects int64 `json:"objects"`
+}
+
+// siteStats is what a site reports about its capacity and usage. Users
+// holds the usage of each user of httpserver.
+type siteStats struct {
+	Name      string                  `json:"name"`
+	Region    string                  `json:"region"`
+	Capacity  int64                   `json:"capacity"`
+	Used      int64                   `json:"used"`
+	Objects   int64                   `json:"objects"`
+	Users     map[string]*objectUsage `json:"users"`
+	Collected int64                   `json:"collected"`
+}
+
+// clusterStats sums up the stats of the sites.
+type clusterStats struct {
+	// Capacity is the sum of the capacities of the sites with limited
+	// capacity, Unlimited is the number of the others.
+	Capacity  int64                   `json:"capacity"`
+	Unlimited int                     `json:"unlimited"`
+	Used      int64                   `json:"used"`
+	Objects   int64                   `json:"objects"`
+	Users     map[string]*objectUsage `json:"users"`
+	Sites     []*siteStats            `json:"sites"`
+}
+
+// aggregateStats sums up the stats of the sites. A file is counted once
+// per site it is stored on.
+func aggregateStats(sites []*siteStats) *clusterStats {
+	total := &clusterStats{
+		Users: make(map[string]*objectUsage),
+		Sites: sites,
+	}
+	for _, site := range sites {
+		if site.Capacity > 0 {
+			total.Capacity += site.Capacity
+		} else {
+			total.Unlimited++
+		}
+		total.Used += site.Used
+		total.Objects += site.Objects
+
+		for user, usage := range site.Users {
+			sum, ok := total.Users[user]
+			if !ok {
+				sum = &objectUsage{}
+				total.Users[user] = sum
+			}
+			sum.Used += usage.Used
+			sum.Objects += usage.Objects
+		}
+	}
+
+	return total
+}
+
+// listPageSize is the number of objects listed per request.
+const listPageSize = 1000
+
+// statOnSite returns the info of filename on site, or errObjectNotFound if
+// the site does not have it.
+func statOnSite(site, filename string) (*objectInfo, error) {
+	c, err := registry.get(site)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Stat(filename)
+	if err != nil {
+		registry.observe(site, 0, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errObjectNotFound
+	default:
+		return nil, fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+
+	var info objectInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// listOnSite lists the objects on site whose names start with prefix.
+func listOnSite(site, prefix string) ([]objectInfo, error) {
+	c, err := registry.get(site)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		objects []objectInfo
+		token   string
+	)
+	for {
+		resp, err := c.List(prefix, token, listPageSize, true)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Objects   []objectInfo `json:"objects"`
+			NextToken string       `json:"next_token"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		} else {
+			err = fmt.Errorf("unexpected status %v", resp.StatusCode)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, page.Objects...)
+		if page.NextToken == "" {
+			return objects, nil
+		}
+		token = page.NextToken
+	}
+}
+
+// statsOfSite fetches the stats of site.
+func statsOfSite(site string) (*siteStats, error) {
+	c, err := registry.get(site)
+	if err != nil {
+		return nil, err
+	}
+	timed := *c
+	timed.Timeout = siteCheckTimeout
+
+	resp, err := timed.Stats()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+
+	var stats siteStats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	if err != nil {
+		return nil, err
+	}
+	// Static sites may not know the name they are configured with.
+	stats.Name = site
+
+	return &stats, nil
+}
+
+// copyOnSite copies filename to dest within site.
+func copyOnSite(site, filename, dest string) error {
+	c, err := registry.get(site)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Copy(filename, dest)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// deleteFromSite deletes filename from given site.
+func deleteFromSite(site, filename string) (*http.Response, error) {
+	c, err := registry.get(site)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Delete(filename)
+}
+
+// discoverSites keeps the registry in sync with the sites alive according
+// to the scheduler.
+func discoverSites(interval time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := s.ListSites(ctx, &pb.ListSitesRequest{})
+		cancel()
+		if err != nil {
+			log.WithError(err).Warnln("discover sites failed")
+		} else {
+			clients := make(map[string]*client.StorageClient)
+			regions := make(map[string]string)
+			for _, site := range resp.Sites {
+				clients[site.Name] = client.NewStorageClient(site.Name, site.Endpoint, *storageUser, *storagePassword)
+				regions[site.Name] = site.Region
+			}
+			registry.setDiscovered(clients, regions)
+		}
+
+		pingSites()
+		refreshStats()
+		time.Sleep(interval)
+	}
+}
+
+// pingSites pings all sites at once to keep their health up to date, a site
+// that does not answer within siteCheckTimeout counts as failed.
+func pingSites() {
+	var wg sync.WaitGroup
+	for _, site := range registry.list() {
+		c, err := registry.get(site)
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(site string, c client.StorageClient) {
+			defer wg.Done()
+			c.Timeout = siteCheckTimeout
+
+			start := time.Now()
+			resp, err := c.Ping()
+			if err == nil && resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("unexpected status %v", resp.StatusCode)
+			}
+			registry.observe(site, time.Since(start), err)
+		}(site, *c)
+	}
+	wg.Wait()
+}
+
+// refreshStats fetches the stats of all sites at once. Sites that fail to
+// report them within siteCheckTimeout are left out of the stats until they
+// report again.
+func refreshStats() {
+	var wg sync.WaitGroup
+	for _, site := range registry.list() {
+		wg.Add(1)
+		go func(site string) {
+			defer wg.Done()
+			stats, err := statsOfSite(site)
+			if err != nil {
+				log.WithError(err).Debugf("fetch stats of %v failed", site)
+			}
+			registry.setStats(site, stats)
+		}(site)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	pb "github.com/Sean-Pearce/jcs/service/scheduler/proto"
+	"github.com/Sean-Pearce/jcs/service/storage/client"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// testSite is a storage site keeping objects in memory. It serves uploads
+// and downloads, failing them partway if failAfter is set, deletions, stats,
+// listings, copies and multipart uploads.
+type testSite struct {
+	name   string
+	server *httptest.Server
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	// modified holds the modification times of the objects.
+	modified map[string]int64
+	// failAfter is the number of bytes after which uploads and downloads
+	// fail, -1 if they do not.
+	failAfter int64
+	// uploads holds the parts of the multipart uploads in progress by
+	// upload id.
+	uploads map[string]*testUpload
+	nextID  int
+}
+
+// testUpload is a multipart upload in progress on a testSite.
+type testUpload struct {
+	filename string
+	parts    map[int][]byte
+}
+
+// newTestSites starts n sites and makes them the sites of the registry.
+func newTestSites(t *testing.T, n int) ([]*testSite, func()) {
+	sites := make([]*testSite, n)
+	for i := range sites {
+		s := &testSite{
+			name:      fmt.Sprintf("site%v", i),
+			objects:   make(map[string][]byte),
+			modified:  make(map[string]int64),
+			failAfter: -1,
+			uploads:   make(map[string]*testUpload),
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/upload", s.upload)
+		mux.HandleFunc("/download", s.download)
+		mux.HandleFunc("/delete", s.deleteObject)
+		mux.HandleFunc("/stat", s.stat)
+		mux.HandleFunc("/list", s.list)
+		mux.HandleFunc("/copy", s.copyObject)
+		mux.HandleFunc("/multipart/init", s.initMultipart)
+		mux.HandleFunc("/multipart/part", s.uploadPart)
+		mux.HandleFunc("/multipart/complete", s.completeMultipart)
+		mux.HandleFunc("/multipart/abort", s.abortMultipart)
+		s.server = httptest.NewServer(mux)
+
+		sites[i] = s
+	}
+	resetRegistry(sites)
+
+	return sites, func() {
+		for _, s := range sites {
+			s.server.Close()
+		}
+	}
+}
+
+// resetRegistry makes sites the sites of a new registry, forgetting the
+// failures observed.
+func resetRegistry(sites []*testSite) {
+	clients := make([]client.StorageClient, len(sites))
+	for i, s := range sites {
+		clients[i] = *client.NewStorageClient(s.name, s.server.URL, "test", "test")
+	}
+	registry = newSiteRegistry(clients)
+}
+
+// testContent returns n bytes that differ from block to block.
+func testContent(n int) []byte {
+	content := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(content)
+	return content
+}
+
+func siteNames(sites []*testSite) []string {
+	names := make([]string, len(sites))
+	for i, s := range sites {
+		names[i] = s.name
+	}
+
+	return names
+}
+
+func (s *testSite) setFailAfter(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failAfter = n
+}
+
+func (s *testSite) object(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[name]
+	return data, ok
+}
+
+func (s *testSite) setObject(name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if data == nil {
+		delete(s.objects, name)
+		delete(s.modified, name)
+		return
+	}
+	s.objects[name] = data
+	s.modified[name] = time.Now().Unix()
+}
+
+// setModified sets the modification time of an object.
+func (s *testSite) setModified(name string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modified[name] = t.Unix()
+}
+
+func (s *testSite) upload(w http.ResponseWriter, r *http.Request) {
+	form, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var filename string
+	for {
+		part, err := form.NextPart()
+		if err != nil {
+			http.Error(w, "file not found", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "filename" {
+			value, _ := ioutil.ReadAll(part)
+			filename = string(value)
+			continue
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+
+		s.mu.Lock()
+		failAfter := s.failAfter
+		s.mu.Unlock()
+		if failAfter >= 0 {
+			io.CopyN(ioutil.Discard, part, failAfter)
+			http.Error(w, "disk full", http.StatusInternalServerError)
+			return
+		}
+
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.setObject(filename, data)
+		sum := md5.Sum(data)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"created": filename,
+			"size":    len(data),
+			"md5":     hex.EncodeToString(sum[:]),
+		})
+		return
+	}
+}
+
+func (s *testSite) download(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.object(r.URL.Query().Get("filename"))
+	if !ok {
+		http.Error(w, "object not found", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	failAfter := s.failAfter
+	s.mu.Unlock()
+	if failAfter < 0 || failAfter >= int64(len(data)) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		return
+	}
+
+	// Announce the whole object and drop the connection partway, ignoring
+	// the range.
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data[:failAfter])
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+func (s *testSite) deleteObject(w http.ResponseWriter, r *http.Request) {
+	s.setObject(r.URL.Query().Get("filename"), nil)
+	w.Write([]byte("{}"))
+}
+
+func (s *testSite) stat(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("filename")
+	data, ok := s.object(name)
+	if !ok {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+
+	sum := md5.Sum(data)
+	json.NewEncoder(w).Encode(objectInfo{Name: name, Size: int64(len(data)), ETag: hex.EncodeToString(sum[:])})
+}
+
+// list lists the objects whose names start with prefix in a single page.
+func (s *testSite) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	objects := []objectInfo{}
+	s.mu.Lock()
+	for name, data := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, objectInfo{Name: name, Size: int64(len(data)), LastModified: s.modified[name]})
+		}
+	}
+	s.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"objects": objects})
+}
+
+func (s *testSite) copyObject(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.object(r.URL.Query().Get("filename"))
+	if !ok {
+		http.Error(w, "object not found", http.StatusNotFound)
+		return
+	}
+
+	dest := r.URL.Query().Get("dest")
+	s.setObject(dest, data)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"created": dest})
+}
+
+// pendingUploads returns the number of multipart uploads in progress.
+func (s *testSite) pendingUploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// partCount returns the number of parts uploaded to multipart uploads in
+// progress.
+func (s *testSite) partCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, upload := range s.uploads {
+		n += len(upload.parts)
+	}
+	return n
+}
+
+func (s *testSite) initMultipart(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.uploads[id] = &testUpload{filename: r.URL.Query().Get("filename"), parts: make(map[int][]byte)}
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"upload_id": id})
+}
+
+// testUploadOf returns the multipart upload a request is for, or nil.
+func (s *testSite) testUploadOf(r *http.Request) *testUpload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, ok := s.uploads[r.URL.Query().Get("upload_id")]
+	if !ok || upload.filename != r.URL.Query().Get("filename") {
+		return nil
+	}
+	return upload
+}
+
+func (s *testSite) uploadPart(w http.ResponseWriter, r *http.Request) {
+	upload := s.testUploadOf(r)
+	number, err := strconv.Atoi(r.URL.Query().Get("part_number"))
+	if upload == nil || err != nil {
+		http.Error(w, "no such upload", http.StatusBadRequest)
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	upload.parts[number] = data
+	s.mu.Unlock()
+
+	sum := md5.Sum(data)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"etag": hex.EncodeToString(sum[:]),
+		"size": len(data),
+	})
+}
+
+func (s *testSite) completeMultipart(w http.ResponseWriter, r *http.Request) {
+	upload := s.testUploadOf(r)
+	var parts []client.CompletedPart
+	err := json.NewDecoder(r.Body).Decode(&parts)
+	if upload == nil || err != nil {
+		http.Error(w, "no such upload", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	var data []byte
+	for _, part := range parts {
+		sum := md5.Sum(upload.parts[part.PartNumber])
+		if hex.EncodeToString(sum[:]) != part.ETag {
+			s.mu.Unlock()
+			http.Error(w, "invalid part", http.StatusBadRequest)
+			return
+		}
+		data = append(data, upload.parts[part.PartNumber]...)
+	}
+	delete(s.uploads, r.URL.Query().Get("upload_id"))
+	s.objects[upload.filename] = data
+	s.modified[upload.filename] = time.Now().Unix()
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"size": len(data)})
+}
+
+func (s *testSite) abortMultipart(w http.ResponseWriter, r *http.Request) {
+	if s.testUploadOf(r) == nil {
+		http.Error(w, "no such upload", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	delete(s.uploads, r.URL.Query().Get("upload_id"))
+	s.mu.Unlock()
+	w.Write([]byte("{}"))
+}
+
+// testScheduler places files on the first sites of their strategy, as many
+// as there are shards or replicas.
+type testScheduler struct {
+	pb.SchedulerClient
+}
+
+func (testScheduler) Schedule(ctx context.Context, in *pb.ScheduleRequest, opts ...grpc.CallOption) (*pb.ScheduleResponse, error) {
+	n := int(in.Replicas)
+	if in.Shards > 0 {
+		n = int(in.Shards)
+	}
+	if n == 0 || n > len(in.Sites) {
+		n = len(in.Sites)
+	}
+
+	return &pb.ScheduleResponse{Sites: in.Sites[:n]}, nil
+}
+
+// testDaoErr is the error connecting to the test database, so that it is
+// tried once.
+var testDaoErr error
+
+// useTestDao connects d to the test database and creates the user username
+// anew, files are scheduled by a testScheduler. The test is skipped if
+// mongodb is not available.
+func useTestDao(t *testing.T, username string) {
+	if d == nil && testDaoErr == nil {
+		d, testDaoErr = dao.NewDao(*mongoURL, "test", "user")
+	}
+	if testDaoErr != nil {
+		t.Skipf("mongodb not available: %v", testDaoErr)
+	}
+
+	d.DeleteUser(username)
+	err := d.CreateNewUser(dao.User{Username: username, Password: "secret", Role: "user"})
+	require.Nil(t, err)
+	s = testScheduler{}
+}
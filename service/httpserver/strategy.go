@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+)
+
+// maxShards is the most shards reedsolomon can encode a file into.
+const maxShards = 256
+
+// strategyNames are the placement strategies of the scheduler.
+var strategyNames = map[string]bool{
+	"":                true,
+	"replicate-all":   true,
+	"replicate-n":     true,
+	"cheapest":        true,
+	"lowest-latency":  true,
+	"most-free-space": true,
+}
+
+// fieldError is a problem with a field of a request.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validateStrategy checks a strategy and each of its overrides against the
+// known sites and the replica limits, it returns the problems found.
+func validateStrategy(strategy *dao.Strategy) []fieldError {
+	var errs []fieldError
+	if strategy.Version > dao.StrategyVersion {
+		errs = append(errs, fieldError{"version", fmt.Sprintf("version %v is not supported", strategy.Version)})
+	}
+
+	errs = append(errs, validatePlacement(strategy, "")...)
+	for i, o := range strategy.Overrides {
+		prefix := fmt.Sprintf("overrides[%v].", i)
+		switch {
+		case o.MinSize < 0:
+			errs = append(errs, fieldError{prefix + "min_size", "must not be negative"})
+		case o.MaxSize < 0:
+			errs = append(errs, fieldError{prefix + "max_size", "must not be negative"})
+		case o.MaxSize > 0 && o.MinSize > o.MaxSize:
+			errs = append(errs, fieldError{prefix + "max_size", "must not be less than min_size"})
+		}
+		if o.Replicas > 0 && o.DataShards > 0 {
+			errs = append(errs, fieldError{prefix + "replicas", "cannot be combined with erasure coding"})
+			continue
+		}
+		errs = append(errs, validatePlacement(strategy.With(o), prefix)...)
+	}
+
+	return errs
+}
+
+// validatePlacement checks how a strategy places files, prefix is put
+// before the names of the fields at fault.
+func validatePlacement(strategy *dao.Strategy, prefix string) []fieldError {
+	var errs []fieldError
+	fail := func(field, format string, a ...interface{}) {
+		errs = append(errs, fieldError{prefix + field, fmt.Sprintf(format, a...)})
+	}
+
+	if !strategyNames[strategy.Name] {
+		fail("name", "unknown strategy %q", strategy.Name)
+	}
+
+	for _, err := range validateSites(strategy) {
+		fail(err.Field, "%v", err.Message)
+	}
+	n := len(strategy.Sites)
+
+	if strategy.Replicas < 0 {
+		fail("replicas", "must not be negative")
+	}
+	if strategy.DataShards < 0 {
+		fail("data_shards", "must not be negative")
+	}
+	if strategy.ParityShards < 0 {
+		fail("parity_shards", "must not be negative")
+	}
+	if strategy.MaxCostPerGB < 0 {
+		fail("max_cost_per_gb", "must not be negative")
+	}
+	if strategy.MaxLatency < 0 {
+		fail("max_latency", "must not be negative")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	if strategy.DataShards == 0 {
+		if strategy.ParityShards > 0 {
+			fail("parity_shards", "needs data_shards")
+		}
+
+		copies := replicaCount(strategy)
+		switch {
+		case strategy.Name == "replicate-n" && strategy.Replicas == 0:
+			fail("replicas", "replicate-n needs the number of replicas")
+		case copies > n:
+			fail("replicas", "%v replicas need as many sites, %v given", copies, n)
+		case copies < *minReplicas:
+			fail("replicas", "at least %v replicas are required", *minReplicas)
+		case *maxReplicas > 0 && copies > *maxReplicas:
+			fail("replicas", "at most %v replicas are allowed", *maxReplicas)
+		}
+		return errs
+	}
+
+	// Erasure-coded files must survive as many lost sites as the fewest
+	// replicas allowed.
+	shards := strategy.DataShards + strategy.ParityShards
+	if strategy.Replicas != 0 {
+		fail("replicas", "cannot be combined with erasure coding")
+	}
+	if strategy.ParityShards < *minReplicas-1 {
+		fail("parity_shards", "at least %v parity shards are required", *minReplicas-1)
+	}
+	switch {
+	case shards > maxShards:
+		fail("data_shards", "at most %v shards are allowed", maxShards)
+	case shards > n:
+		fail("data_shards", "%v shards need as many sites, %v given", shards, n)
+	}
+
+	return errs
+}
+
+// validateSites checks that the sites of a strategy are known, distinct,
+// in the required regions and not in the forbidden ones.
+func validateSites(strategy *dao.Strategy) []fieldError {
+	var errs []fieldError
+	fail := func(field, format string, a ...interface{}) {
+		errs = append(errs, fieldError{field, fmt.Sprintf(format, a...)})
+	}
+
+	if len(strategy.Sites) == 0 {
+		fail("sites", "at least one site is required")
+	}
+
+	known := make(map[string]bool)
+	for _, region := range registry.listRegions() {
+		known[region] = true
+	}
+	allowed := make(map[string]bool)
+	for _, region := range strategy.Regions {
+		if !known[region] {
+			fail("regions", "unknown region %q", region)
+		}
+		allowed[region] = true
+	}
+	forbidden := make(map[string]bool)
+	for _, region := range strategy.ForbiddenRegions {
+		if allowed[region] {
+			fail("forbidden_regions", "region %q is also required", region)
+		}
+		forbidden[region] = true
+	}
+
+	seen := make(map[string]bool)
+	for _, site := range strategy.Sites {
+		if seen[site] {
+			fail("sites", "site %q is given twice", site)
+			continue
+		}
+		seen[site] = true
+
+		_, err := registry.get(site)
+		if err != nil {
+			fail("sites", "unknown site %q", site)
+			continue
+		}
+
+		region := registry.region(site)
+		switch {
+		case forbidden[region] && region != "":
+			fail("sites", "site %q is in forbidden region %q", site, region)
+		case len(allowed) == 0:
+		case region == "":
+			fail("sites", "region of site %q is unknown", site)
+		case !allowed[region]:
+			fail("sites", "site %q is in region %q, not in %v", site, region, strategy.Regions)
+		}
+	}
+
+	return errs
+}
+
+// replicaCount returns the number of copies a replicating strategy keeps of
+// a file.
+func replicaCount(strategy *dao.Strategy) int {
+	if strategy.Replicas > 0 {
+		return strategy.Replicas
+	}
+	if strategy.Name == "" || strategy.Name == "replicate-all" {
+		return len(strategy.Sites)
+	}
+	return 1
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/Sean-Pearce/jcs/service/storage/client"
+	"github.com/stretchr/testify/require"
+)
+
+// stubRegistry knows the static sites a to d, of unknown region, and the
+// discovered sites eu1, eu2 in eu and us1 in us.
+func stubRegistry() *siteRegistry {
+	r := newSiteRegistry([]client.StorageClient{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}})
+	r.setDiscovered(map[string]*client.StorageClient{
+		"eu1": {Name: "eu1"},
+		"eu2": {Name: "eu2"},
+		"us1": {Name: "us1"},
+	}, map[string]string{
+		"eu1": "eu",
+		"eu2": "eu",
+		"us1": "us",
+	})
+
+	return r
+}
+
+func TestValidatePlacement(t *testing.T) {
+	registry = stubRegistry()
+	defer func(min, max int) {
+		*minReplicas, *maxReplicas = min, max
+	}(*minReplicas, *maxReplicas)
+
+	abcd := []string{"a", "b", "c", "d"}
+	tests := []struct {
+		name        string
+		strategy    dao.Strategy
+		minReplicas int
+		maxReplicas int
+		// fields are the fields at fault, in order.
+		fields []string
+	}{
+		{"replicate all", dao.Strategy{Sites: abcd}, 1, 0, nil},
+		{"unknown name", dao.Strategy{Name: "random", Sites: abcd}, 1, 0, []string{"name"}},
+		{"no sites", dao.Strategy{}, 1, 0, []string{"sites"}},
+		{"unknown site", dao.Strategy{Sites: []string{"a", "x"}}, 1, 0, []string{"sites"}},
+		{"site twice", dao.Strategy{Sites: []string{"a", "a"}}, 1, 0, []string{"sites"}},
+		{"negative", dao.Strategy{Sites: abcd, Replicas: -1, DataShards: -1, ParityShards: -1, MaxCostPerGB: -1, MaxLatency: -1}, 1, 0,
+			[]string{"replicas", "data_shards", "parity_shards", "max_cost_per_gb", "max_latency"}},
+
+		{"replicate n", dao.Strategy{Name: "replicate-n", Sites: abcd, Replicas: 2}, 1, 0, nil},
+		{"replicate n without replicas", dao.Strategy{Name: "replicate-n", Sites: abcd}, 1, 0, []string{"replicas"}},
+		{"more replicas than sites", dao.Strategy{Name: "replicate-n", Sites: abcd, Replicas: 5}, 1, 0, []string{"replicas"}},
+		{"below min replicas", dao.Strategy{Name: "cheapest", Sites: abcd}, 2, 0, []string{"replicas"}},
+		{"min replicas", dao.Strategy{Name: "cheapest", Sites: abcd, Replicas: 2}, 2, 0, nil},
+		{"above max replicas", dao.Strategy{Sites: abcd}, 1, 3, []string{"replicas"}},
+		{"max replicas", dao.Strategy{Sites: abcd[:3]}, 1, 3, nil},
+		{"parity without data", dao.Strategy{Sites: abcd, ParityShards: 1}, 1, 0, []string{"parity_shards"}},
+
+		{"erasure", dao.Strategy{Sites: abcd, DataShards: 2, ParityShards: 2}, 3, 0, nil},
+		{"erasure with replicas", dao.Strategy{Sites: abcd, DataShards: 2, ParityShards: 2, Replicas: 2}, 1, 0, []string{"replicas"}},
+		{"too few parity shards", dao.Strategy{Sites: abcd, DataShards: 3, ParityShards: 1}, 3, 0, []string{"parity_shards"}},
+		{"more shards than sites", dao.Strategy{Sites: abcd, DataShards: 4, ParityShards: 1}, 1, 0, []string{"data_shards"}},
+		{"too many shards", dao.Strategy{Sites: abcd, DataShards: 250, ParityShards: 7}, 1, 0, []string{"data_shards"}},
+
+		{"in region", dao.Strategy{Sites: []string{"eu1", "eu2"}, Regions: []string{"eu"}}, 1, 0, nil},
+		{"out of region", dao.Strategy{Sites: []string{"eu1", "us1"}, Regions: []string{"eu"}}, 1, 0, []string{"sites"}},
+		{"region unknown", dao.Strategy{Sites: []string{"eu1", "a"}, Regions: []string{"eu"}}, 1, 0, []string{"sites"}},
+		{"unknown region", dao.Strategy{Sites: []string{"eu1"}, Regions: []string{"asia"}}, 1, 0, []string{"regions", "sites"}},
+		{"forbidden region", dao.Strategy{Sites: []string{"eu1", "us1"}, ForbiddenRegions: []string{"us"}}, 1, 0, []string{"sites"}},
+		{"forbidden and required", dao.Strategy{Sites: []string{"eu1"}, Regions: []string{"eu"}, ForbiddenRegions: []string{"eu"}}, 1, 0,
+			[]string{"forbidden_regions", "sites"}},
+		{"forbidden allows unknown", dao.Strategy{Sites: []string{"a", "eu1"}, ForbiddenRegions: []string{"us"}}, 1, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*minReplicas, *maxReplicas = tt.minReplicas, tt.maxReplicas
+
+			var fields []string
+			for _, err := range validatePlacement(&tt.strategy, "") {
+				fields = append(fields, err.Field)
+			}
+			require.Equal(t, tt.fields, fields)
+		})
+	}
+}
+
+func TestValidatePlacementPrefix(t *testing.T) {
+	registry = stubRegistry()
+
+	errs := validatePlacement(&dao.Strategy{Name: "random", Sites: []string{"x"}}, "overrides[1].")
+	require.Equal(t, []fieldError{
+		{"overrides[1].name", `unknown strategy "random"`},
+		{"overrides[1].sites", `unknown site "x"`},
+	}, errs)
+}
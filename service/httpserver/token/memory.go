@@ -0,0 +1,108 @@
+package token
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store in memory, tokens are lost on restart.
+type MemoryStore struct {
+	ttl time.Duration
+	// now returns the current time, tests replace it.
+	now func() time.Time
+
+	mu        sync.Mutex
+	sessions  map[string]*session
+	lastSweep time.Time
+}
+
+type session struct {
+	username string
+	expires  time.Time
+}
+
+// NewMemoryStore constructs a MemoryStore.
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		ttl:       ttl,
+		now:       time.Now,
+		sessions:  make(map[string]*session),
+		lastSweep: time.Now(),
+	}
+}
+
+// Create creates a new token for given user.
+func (s *MemoryStore) Create(username string) (string, error) {
+	token, err := genToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+	s.sessions[token] = &session{
+		username: username,
+		expires:  s.now().Add(s.ttl),
+	}
+
+	return token, nil
+}
+
+// Get returns the user of given token and refreshes its expiry.
+func (s *MemoryStore) Get(token string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok {
+		return "", ErrInvalidToken
+	}
+	if s.now().After(sess.expires) {
+		delete(s.sessions, token)
+		return "", ErrInvalidToken
+	}
+	sess.expires = s.now().Add(s.ttl)
+
+	return sess.username, nil
+}
+
+// Revoke revokes given token.
+func (s *MemoryStore) Revoke(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, token)
+	return nil
+}
+
+// RevokeUser revokes all tokens of given user.
+func (s *MemoryStore) RevokeUser(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, sess := range s.sessions {
+		if sess.username == username {
+			delete(s.sessions, token)
+		}
+	}
+
+	return nil
+}
+
+// sweep drops expired sessions at most once per TTL. The caller must hold
+// s.mu.
+func (s *MemoryStore) sweep() {
+	now := s.now()
+	if now.Sub(s.lastSweep) < s.ttl {
+		return
+	}
+	s.lastSweep = now
+
+	for token, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, token)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package token
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// refreshInterval limits how often the expiry of a token is written back,
+// so that not every request costs a write.
+const refreshInterval = time.Minute
+
+// MongoStore is a Store in mongodb, tokens survive restarts and can be
+// shared between httpservers. Expired tokens are removed by a TTL index.
+type MongoStore struct {
+	client     *mongo.Client
+	database   string
+	collection string
+	ttl        time.Duration
+}
+
+type mongoSession struct {
+	Token    string
+	Username string
+	Expires  time.Time
+}
+
+// NewMongoStore constructs a MongoStore.
+func NewMongoStore(mongoURI, database, collection string, ttl time.Duration) (*MongoStore, error) {
+	store := &MongoStore{
+		database:   database,
+		collection: collection,
+		ttl:        ttl,
+	}
+
+	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = client.Ping(ctx, readpref.Primary())
+	if err != nil {
+		return nil, err
+	}
+
+	store.client = client
+	err = store.ensureIndexes()
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (s *MongoStore) col() *mongo.Collection {
+	return s.client.Database(s.database).Collection(s.collection)
+}
+
+func (s *MongoStore) ensureIndexes() error {
+	unique := true
+	expireAfter := int32(0)
+	_, err := s.col().Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.M{"token": 1},
+			Options: &options.IndexOptions{Unique: &unique},
+		},
+		{
+			Keys: bson.M{"username": 1},
+		},
+		{
+			Keys:    bson.M{"expires": 1},
+			Options: &options.IndexOptions{ExpireAfterSeconds: &expireAfter},
+		},
+	})
+
+	return err
+}
+
+// Create creates a new token for given user.
+func (s *MongoStore) Create(username string) (string, error) {
+	token, err := genToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.col().InsertOne(context.TODO(), mongoSession{
+		Token:    token,
+		Username: username,
+		Expires:  time.Now().Add(s.ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Get returns the user of given token and refreshes its expiry.
+func (s *MongoStore) Get(token string) (string, error) {
+	now := time.Now()
+
+	var sess mongoSession
+	err := s.col().FindOne(context.TODO(), bson.M{
+		"token":   token,
+		"expires": bson.M{"$gt": now},
+	}).Decode(&sess)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if sess.Expires.Sub(now) < s.ttl-refreshInterval {
+		_, err = s.col().UpdateOne(
+			context.TODO(),
+			bson.M{
+				"token": token,
+			},
+			bson.M{
+				"$set": bson.M{
+					"expires": now.Add(s.ttl),
+				},
+			},
+		)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return sess.Username, nil
+}
+
+// Revoke revokes given token.
+func (s *MongoStore) Revoke(token string) error {
+	_, err := s.col().DeleteOne(context.TODO(), bson.M{"token": token})
+	return err
+}
+
+// RevokeUser revokes all tokens of given user.
+func (s *MongoStore) RevokeUser(username string) error {
+	_, err := s.col().DeleteMany(context.TODO(), bson.M{"username": username})
+	return err
+}
@@ -0,0 +1,36 @@
+// Package token implements stores of session tokens.
+package token
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+// ErrInvalidToken is returned for tokens that are unknown, expired or
+// revoked.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Store keeps the session tokens of logged in users. Tokens expire once
+// they have not been used for the TTL of the store.
+type Store interface {
+	// Create creates a new token for given user.
+	Create(username string) (string, error)
+	// Get returns the user of given token and refreshes its expiry.
+	Get(token string) (string, error)
+	// Revoke revokes given token.
+	Revoke(token string) error
+	// RevokeUser revokes all tokens of given user.
+	RevokeUser(username string) error
+}
+
+func genToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	// Tokens are passed in query strings as well as headers.
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
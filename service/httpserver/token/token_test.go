@@ -0,0 +1,81 @@
+package token
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore(time.Hour))
+
+	s := NewMemoryStore(10 * time.Minute)
+	clock := time.Now()
+	s.now = func() time.Time { return clock }
+	token, err := s.Create("admin")
+	require.Nil(t, err)
+
+	// used tokens stay valid
+	for i := 0; i < 3; i++ {
+		clock = clock.Add(5 * time.Minute)
+		username, err := s.Get(token)
+		require.Nil(t, err)
+		require.Equal(t, "admin", username)
+	}
+
+	clock = clock.Add(11 * time.Minute)
+	_, err = s.Get(token)
+	require.Equal(t, ErrInvalidToken, err)
+
+	// expired tokens are swept when others are created
+	expired, err := s.Create("admin")
+	require.Nil(t, err)
+	clock = clock.Add(11 * time.Minute)
+	_, err = s.Create("user")
+	require.Nil(t, err)
+	require.NotContains(t, s.sessions, expired)
+}
+
+func TestMongoStore(t *testing.T) {
+	s, err := NewMongoStore("mongodb://localhost:27017", "test", "token", time.Hour)
+	if err != nil {
+		t.Skipf("mongodb not available: %v", err)
+	}
+	s.col().Drop(context.TODO())
+	s.ensureIndexes()
+
+	testStore(t, s)
+}
+
+func testStore(t *testing.T, s Store) {
+	admin1, err := s.Create("admin")
+	require.Nil(t, err)
+	admin2, err := s.Create("admin")
+	require.Nil(t, err)
+	user, err := s.Create("user")
+	require.Nil(t, err)
+	require.NotEqual(t, admin1, admin2)
+
+	username, err := s.Get(admin1)
+	require.Nil(t, err)
+	require.Equal(t, "admin", username)
+
+	_, err = s.Get("unknown")
+	require.Equal(t, ErrInvalidToken, err)
+
+	require.Nil(t, s.Revoke(admin1))
+	_, err = s.Get(admin1)
+	require.Equal(t, ErrInvalidToken, err)
+	_, err = s.Get(admin2)
+	require.Nil(t, err)
+
+	require.Nil(t, s.RevokeUser("admin"))
+	_, err = s.Get(admin2)
+	require.Equal(t, ErrInvalidToken, err)
+
+	username, err = s.Get(user)
+	require.Nil(t, err)
+	require.Equal(t, "user", username)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Usernames prefix the objects of their users and name their S3 buckets,
+	// they are kept to what bucket names allow.
+	usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{2,31}$`)
+	rolePattern     = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+)
+
+// userInfo is a user as listed to admins.
+type userInfo struct {
+	Username  string     `json:"username"`
+	Role      string     `json:"role"`
+	Disabled  bool       `json:"disabled"`
+	AccessKey string     `json:"access_key"`
+	Quota     *dao.Quota `json:"quota"`
+}
+
+func newUserInfo(user *dao.User) userInfo {
+	return userInfo{
+		Username:  user.Username,
+		Role:      user.Role,
+		Disabled:  user.Disabled,
+		AccessKey: user.AccessKey,
+		Quota:     user.Quota,
+	}
+}
+
+// validateUser checks the fields of a new user, it returns the problems
+// found.
+func validateUser(username, password, role string) []fieldError {
+	var errs []fieldError
+	if !usernamePattern.MatchString(username) {
+		errs = append(errs, fieldError{"username", "must have 3 to 32 lowercase letters, digits or hyphens, starting with a letter or digit"})
+	}
+	if !validatePassword(password) {
+		errs = append(errs, fieldError{"password", fmt.Sprintf("must have %v to %v characters", minPasswordLength, maxPasswordLength)})
+	}
+	if !rolePattern.MatchString(role) {
+		errs = append(errs, fieldError{"role", "must have 1 to 32 lowercase letters, digits, hyphens or underscores, starting with a letter"})
+	}
+
+	return errs
+}
+
+// removeUser deletes the files of a user from the sites, aborts its uploads
+// and then removes the user. The user is kept if a file could not be
+// deleted, so that removing it can be retried.
+func removeUser(username string) error {
+	sessions, err := d.GetUploadSessions(username)
+	if err != nil {
+		return fmt.Errorf("get upload sessions: %v", err)
+	}
+	for i := range sessions {
+		err = abortSession(&sessions[i])
+		if err != nil {
+			log.WithError(err).Errorf("abort upload session %v of %v", sessions[i].ID, username)
+		}
+	}
+
+	uploads, err := d.GetUserUploads(username)
+	if err != nil {
+		return fmt.Errorf("get uploads: %v", err)
+	}
+	for i := range uploads {
+		err = removeUpload(&uploads[i])
+		if err != nil && err != dao.ErrNoUpload {
+			log.WithError(err).Errorf("remove upload %v of %v", uploads[i].ID, username)
+		}
+	}
+
+	files, err := d.GetUserFiles(username)
+	if err != nil {
+		return fmt.Errorf("get files: %v", err)
+	}
+	failed := 0
+	for i := range *files {
+		err = removeFile(username, &(*files)[i])
+		if err != nil {
+			log.WithError(err).Errorf("remove %v's file", username)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v files could not be deleted", failed)
+	}
+
+	return d.DeleteUser(username)
+}
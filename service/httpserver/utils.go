@@ -3,15 +3,112 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Sean-Pearce/jcs/service/httpserver/dao"
+	"github.com/gin-gonic/gin"
 )
 
-func genToken() string {
-	b := make([]byte, 8)
+// maxFormValueSize limits the size of non-file form fields.
+const maxFormValueSize = 4096
+
+const (
+	roleAdmin = "admin"
+	// roleUser is the role of users created without one.
+	roleUser = "user"
+	// bcrypt uses at most 72 bytes of a password.
+	minPasswordLength = 6
+	maxPasswordLength = 72
+)
+
+// validatePassword checks the length of a new password.
+func validatePassword(password string) bool {
+	return len(password) >= minPasswordLength && len(password) <= maxPasswordLength
+}
+
+// usernameKey is the context key of the user authenticated by the token.
+const usernameKey = "username"
+
+// requestToken returns the token of a request, taken from the X-Token header
+// or the t query parameter for links such as downloads.
+func requestToken(c *gin.Context) string {
+	token := c.GetHeader("X-Token")
+	if token == "" {
+		token = c.Query("t")
+	}
+
+	return token
+}
+
+// nextFilePart advances reader to the part named "file" and returns it along
+// with the value of an optional "size" field preceding it, or -1 if there is
+// none. The file part is left unread so it can be streamed.
+func nextFilePart(reader *multipart.Reader) (*multipart.Part, int64, error) {
+	var size int64 = -1
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, 0, errors.New("file not found")
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch part.FormName() {
+		case "file":
+			if part.FileName() == "" {
+				return nil, 0, errors.New("empty filename")
+			}
+			return part, size, nil
+		case "size":
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueSize))
+			if err != nil {
+				return nil, 0, err
+			}
+			size, err = strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+}
+
+// objectName returns the name of the object that stores a user's file.
+// Files uploaded before objects got names of their own are stored by
+// filename in the user's directory.
+func objectName(username string, file *dao.File) string {
+	if file.Object != "" {
+		return file.Object
+	}
+
+	return path.Join(username, file.Filename)
+}
+
+// newObjectName returns a unique object name for a new file of given user.
+func newObjectName(username string) string {
+	return path.Join(username, ".objects", newID())
+}
+
+// newID returns a random id for an upload or a reservation.
+func newID() string {
+	b := make([]byte, 16)
 	rand.Read(b)
-	return base64.StdEncoding.EncodeToString(b)
+	return hex.EncodeToString(b)
 }
 
-func getUsernameByToken(token string) string {
-	username := tokenMap[token]
-	return username
+// genKeys generates a pair of S3 access key and secret key.
+func genKeys() (string, string) {
+	access := make([]byte, 10)
+	rand.Read(access)
+	secret := make([]byte, 30)
+	rand.Read(secret)
+
+	return strings.ToUpper(hex.EncodeToString(access)), base64.RawURLEncoding.EncodeToString(secret)
 }
@@ -14,7 +14,10 @@ const (
 )
 
 var (
-	port = flag.String("port", ":5001", "grpc service port number")
+	port      = flag.String("port", ":5001", "grpc service port number")
+	config    = flag.String("config", "scheduler.json", "site info config file")
+	heartbeat = flag.Duration("heartbeat", defaultHeartbeat, "heartbeat interval of storage nodes")
+	highWater = flag.Float64("high-water", 0.95, "fraction of its capacity a site may be filled to")
 )
 
 func main() {
@@ -23,6 +26,13 @@ func main() {
 	log.Infoln("Starting scheduler", version)
 
 	s := newScheduler("")
+	s.heartbeat = *heartbeat
+	s.highWater = *highWater
+	err := s.loadSites(*config)
+	if err != nil {
+		log.WithError(err).Warnln("load site info failed, placing without it")
+	}
+
 	gs := grpc.NewServer()
 	pb.RegisterSchedulerServer(gs, s)
 
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pb "github.com/Sean-Pearce/jcs/service/scheduler/proto"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultHeartbeat = 10 * time.Second
+
+// alive reports whether a registered site has sent a heartbeat recently.
+func (s *scheduler) alive(info *site) bool {
+	return time.Since(info.lastSeen) < 3*s.heartbeat
+}
+
+// RegisterSite adds a storage node to the sites, or updates it if the site
+// is already known, e.g. from the config file.
+func (s *scheduler) RegisterSite(ctx context.Context, req *pb.SiteInfo) (*pb.RegisterSiteResponse, error) {
+	if req.Name == "" || req.Endpoint == "" {
+		return nil, errors.New("site name and endpoint are required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, ok := s.sites[req.Name]
+	if !ok {
+		info = &site{Name: req.Name}
+		s.sites[req.Name] = info
+	}
+	info.Endpoint = req.Endpoint
+	info.Region = req.Region
+	info.Capacity = req.Capacity
+	info.Used = req.Used
+	info.registered = true
+	info.lastSeen = time.Now()
+
+	log.Infof("site %v registered at %v", req.Name, req.Endpoint)
+
+	return &pb.RegisterSiteResponse{
+		HeartbeatInterval: int64(s.heartbeat / time.Second),
+	}, nil
+}
+
+// Heartbeat keeps a registered site alive and updates its usage.
+func (s *scheduler) Heartbeat(ctx context.Context, req *pb.SiteInfo) (*pb.HeartbeatResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, ok := s.sites[req.Name]
+	if !ok || !info.registered || !s.alive(info) {
+		return &pb.HeartbeatResponse{Registered: false}, nil
+	}
+	info.Capacity = req.Capacity
+	info.Used = req.Used
+	info.lastSeen = time.Now()
+
+	return &pb.HeartbeatResponse{Registered: true}, nil
+}
+
+// ListSites returns the registered sites that are alive.
+func (s *scheduler) ListSites(ctx context.Context, req *pb.ListSitesRequest) (*pb.ListSitesResponse, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := &pb.ListSitesResponse{}
+	for _, info := range s.sites {
+		if !info.registered || !s.alive(info) {
+			continue
+		}
+
+		res.Sites = append(res.Sites, &pb.SiteInfo{
+			Name:     info.Name,
+			Endpoint: info.Endpoint,
+			Region:   info.Region,
+			Capacity: info.Capacity,
+			Used:     info.Used,
+		})
+	}
+
+	return res, nil
+}
@@ -2,26 +2,205 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
 
 	pb "github.com/Sean-Pearce/jcs/service/scheduler/proto"
 )
 
 type scheduler struct {
 	name string
+	// heartbeat is the interval storage nodes are asked to send heartbeats
+	// at, a registered site that misses three of them is considered dead.
+	heartbeat time.Duration
+	// highWater is the fraction of its capacity a site may be filled to,
+	// sites that a file would fill beyond it are not placed on.
+	highWater float64
+
+	mu    sync.RWMutex
+	sites map[string]*site
+}
+
+// site is what the scheduler knows about a storage site.
+type site struct {
+	Name   string `json:"name"`
+	Region string `json:"region"`
+	// CostPerGB is the monthly storage price per GB.
+	CostPerGB float64 `json:"cost_per_gb"`
+	// Latency is the round-trip time to the site in milliseconds.
+	Latency  int64  `json:"latency"`
+	Capacity int64  `json:"capacity"`
+	Used     int64  `json:"used"`
+	Endpoint string `json:"endpoint"`
+
+	// registered is set once the storage node has registered itself,
+	// lastSeen is the time of its last heartbeat.
+	registered bool
+	lastSeen   time.Time
+}
+
+// fileInfo is the file_info of a ScheduleRequest.
+type fileInfo struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
 }
 
 func newScheduler(name string) *scheduler {
-	return &scheduler{name: name}
+	return &scheduler{
+		name:      name,
+		heartbeat: defaultHeartbeat,
+		highWater: 1,
+		sites:     make(map[string]*site),
+	}
 }
 
-func (s *scheduler) Schedule(ctx context.Context, req *pb.ScheduleRequest) (*pb.ScheduleResponse, error) {
-	res := &pb.ScheduleResponse{}
+// loadSites loads site info from a JSON config file.
+func (s *scheduler) loadSites(config string) error {
+	data, err := ioutil.ReadFile(config)
+	if err != nil {
+		return err
+	}
+
+	var sites []site
+	err = json.Unmarshal(data, &sites)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range sites {
+		s.sites[sites[i].Name] = &sites[i]
+	}
 
+	return nil
+}
+
+func (s *scheduler) Schedule(ctx context.Context, req *pb.ScheduleRequest) (*pb.ScheduleResponse, error) {
 	if len(req.Sites) == 0 {
 		return nil, errors.New("no site info provided")
 	}
 
-	res.Sites = req.Sites
-	return res, nil
+	strategy, ok := strategies[req.Strategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %q", req.Strategy)
+	}
+
+	info := fileInfo{Size: -1}
+	if req.FileInfo != "" {
+		err := json.Unmarshal([]byte(req.FileInfo), &info)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file info: %v", err)
+		}
+	}
+
+	n := int(req.Replicas)
+	if req.Shards > 0 {
+		n = int(req.Shards)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p := &placement{
+		candidates: s.candidates(req.Sites, info.Size, req.Policy, req.Usage),
+		size:       info.Size,
+		n:          n,
+	}
+	err := strategy(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.ScheduleResponse{
+		Sites:   p.sites,
+		Reasons: p.reasons,
+	}, nil
+}
+
+// candidates returns the info of the given sites that are alive, have room
+// for a file of given size below the high water mark and meet policy, which
+// may be nil. usage replaces what is known of the capacity and usage of the
+// sites in it. Sites the scheduler knows nothing about are kept unless
+// policy requires a region. The caller must hold s.mu.
+func (s *scheduler) candidates(names []string, size int64, policy *pb.Policy, usage []*pb.SiteUsage) []*site {
+	var sites []*site
+	for _, name := range names {
+		info, ok := s.sites[name]
+		if !ok {
+			info = &site{Name: name}
+		} else if info.registered && !s.alive(info) {
+			continue
+		}
+
+		for _, u := range usage {
+			if u.Name == name {
+				// The sites are shared, the copy is only for this request.
+				copied := *info
+				copied.Capacity, copied.Used = u.Capacity, u.Used
+				info = &copied
+			}
+		}
+
+		if !s.fits(info, size) {
+			continue
+		}
+		if !allowed(info, policy) {
+			continue
+		}
+		sites = append(sites, info)
+	}
+
+	return sites
+}
+
+// fits reports whether a file of given size fits on a site below the high
+// water mark. A file of unknown size fits if the site is below the mark.
+func (s *scheduler) fits(info *site, size int64) bool {
+	if info.Capacity == 0 {
+		return true
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	return info.Capacity-info.Used >= size &&
+		float64(info.Used+size) <= s.highWater*float64(info.Capacity)
+}
+
+// allowed reports whether a site meets policy. A site must be known to be
+// in one of the required regions, but a missing price or latency does not
+// exclude it.
+func allowed(info *site, policy *pb.Policy) bool {
+	if policy == nil {
+		return true
+	}
+
+	if len(policy.Regions) > 0 && !contains(policy.Regions, info.Region) {
+		return false
+	}
+	if info.Region != "" && contains(policy.ForbiddenRegions, info.Region) {
+		return false
+	}
+	if policy.MaxCostPerGb > 0 && info.CostPerGB > policy.MaxCostPerGb {
+		return false
+	}
+	if policy.MaxLatency > 0 && info.Latency > policy.MaxLatency {
+		return false
+	}
+
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
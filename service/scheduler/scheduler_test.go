@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"testing"
+	"time"
 
 	pb "github.com/Sean-Pearce/jcs/service/scheduler/proto"
 	"github.com/stretchr/testify/require"
@@ -16,8 +17,9 @@ const bufSize = 1024 * 1024
 
 var (
 	tests = []struct {
-		sites []string
-		want  []string
+		sites  []string
+		shards int32
+		want   []string
 	}{
 		{
 			sites: nil,
@@ -27,6 +29,11 @@ var (
 			sites: []string{"a", "b", "c"},
 			want:  []string{"a", "b", "c"},
 		},
+		{
+			sites:  []string{"a", "b", "c"},
+			shards: 2,
+			want:   []string{"a", "b"},
+		},
 	}
 	lis *bufconn.Listener
 )
@@ -49,7 +56,7 @@ func bufDialer(context.Context, string) (net.Conn, error) {
 func TestLocal(t *testing.T) {
 	s := newScheduler("yoyo")
 	for _, test := range tests {
-		req := &pb.ScheduleRequest{Sites: test.sites}
+		req := &pb.ScheduleRequest{Sites: test.sites, Shards: test.shards}
 		resp, err := s.Schedule(context.Background(), req)
 		if err != nil {
 			t.Skipf("Schedule(%v) got unexpected error: %v", *req, err)
@@ -68,7 +75,7 @@ func TestGrpc(t *testing.T) {
 
 	client := pb.NewSchedulerClient(conn)
 	for _, test := range tests {
-		req := &pb.ScheduleRequest{Sites: test.sites}
+		req := &pb.ScheduleRequest{Sites: test.sites, Shards: test.shards}
 		resp, err := client.Schedule(ctx, req)
 		if err != nil {
 			t.Skipf("client.Schedule(%v) got unexpected error: %v", *req, err)
@@ -76,3 +83,185 @@ func TestGrpc(t *testing.T) {
 		require.Equal(t, resp.Sites, test.want)
 	}
 }
+
+func TestStrategies(t *testing.T) {
+	s := newScheduler("strategies")
+	s.sites["a"] = &site{Name: "a", CostPerGB: 0.3, Latency: 10, Capacity: 100, Used: 90}
+	s.sites["b"] = &site{Name: "b", CostPerGB: 0.1, Latency: 30, Capacity: 100, Used: 50}
+	s.sites["c"] = &site{Name: "c", CostPerGB: 0.2, Latency: 20, Capacity: 100, Used: 10}
+
+	strategyTests := []struct {
+		strategy string
+		replicas int32
+		shards   int32
+		fileInfo string
+		want     []string
+		wantErr  bool
+	}{
+		{strategy: "replicate-all", want: []string{"a", "b", "c"}},
+		{strategy: "replicate-all", shards: 2, want: []string{"a", "b"}},
+		{strategy: "replicate-n", replicas: 2, want: []string{"a", "b"}},
+		{strategy: "replicate-n", wantErr: true},
+		{strategy: "cheapest", want: []string{"b"}},
+		{strategy: "cheapest", replicas: 2, want: []string{"b", "c"}},
+		{strategy: "lowest-latency", replicas: 2, want: []string{"a", "c"}},
+		{strategy: "most-free-space", replicas: 3, want: []string{"c", "b", "a"}},
+		// a has only 10 bytes left
+		{strategy: "lowest-latency", fileInfo: `{"size": 20}`, want: []string{"c"}},
+		{strategy: "replicate-all", fileInfo: `{"size": 60}`, want: []string{"c"}},
+		{strategy: "cheapest", replicas: 4, wantErr: true},
+		{strategy: "unknown", wantErr: true},
+		{strategy: "cheapest", fileInfo: "{", wantErr: true},
+	}
+
+	for _, test := range strategyTests {
+		req := &pb.ScheduleRequest{
+			Strategy: test.strategy,
+			Sites:    []string{"a", "b", "c"},
+			FileInfo: test.fileInfo,
+			Shards:   test.shards,
+			Replicas: test.replicas,
+		}
+		resp, err := s.Schedule(context.Background(), req)
+		if test.wantErr {
+			require.NotNil(t, err, "Schedule(%v)", *req)
+			continue
+		}
+		require.Nil(t, err, "Schedule(%v)", *req)
+		require.Equal(t, test.want, resp.Sites)
+		require.Len(t, resp.Reasons, len(test.want))
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	s := newScheduler("policy")
+	s.sites["a"] = &site{Name: "a", Region: "north", CostPerGB: 0.3, Latency: 10}
+	s.sites["b"] = &site{Name: "b", Region: "south", CostPerGB: 0.1, Latency: 30}
+	s.sites["c"] = &site{Name: "c", Region: "north", CostPerGB: 0.2}
+
+	policyTests := []struct {
+		policy *pb.Policy
+		want   []string
+	}{
+		{policy: nil, want: []string{"a", "b", "c", "d"}},
+		{policy: &pb.Policy{Regions: []string{"north"}}, want: []string{"a", "c"}},
+		{policy: &pb.Policy{ForbiddenRegions: []string{"north"}}, want: []string{"b", "d"}},
+		{policy: &pb.Policy{MaxCostPerGb: 0.2}, want: []string{"b", "c", "d"}},
+		// c has no latency info
+		{policy: &pb.Policy{MaxLatency: 20}, want: []string{"a", "c", "d"}},
+		{policy: &pb.Policy{Regions: []string{"north"}, MaxCostPerGb: 0.25}, want: []string{"c"}},
+	}
+
+	for _, test := range policyTests {
+		req := &pb.ScheduleRequest{
+			Strategy: "replicate-all",
+			Sites:    []string{"a", "b", "c", "d"},
+			Policy:   test.policy,
+		}
+		resp, err := s.Schedule(context.Background(), req)
+		require.Nil(t, err, "Schedule(%v)", *req)
+		require.Equal(t, test.want, resp.Sites)
+	}
+
+	req := &pb.ScheduleRequest{
+		Strategy: "replicate-n",
+		Sites:    []string{"a", "b", "c"},
+		Replicas: 2,
+		Policy:   &pb.Policy{Regions: []string{"south"}},
+	}
+	_, err := s.Schedule(context.Background(), req)
+	require.NotNil(t, err)
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	s := newScheduler("registry")
+
+	resp, err := s.Heartbeat(ctx, &pb.SiteInfo{Name: "a"})
+	require.Nil(t, err)
+	require.False(t, resp.Registered)
+
+	_, err = s.RegisterSite(ctx, &pb.SiteInfo{Name: "a"})
+	require.NotNil(t, err)
+
+	for _, name := range []string{"a", "b"} {
+		resp, err := s.RegisterSite(ctx, &pb.SiteInfo{
+			Name:     name,
+			Endpoint: "http://storage-" + name,
+			Capacity: 100,
+		})
+		require.Nil(t, err)
+		require.Equal(t, int64(defaultHeartbeat/time.Second), resp.HeartbeatInterval)
+	}
+
+	hb, err := s.Heartbeat(ctx, &pb.SiteInfo{Name: "a", Capacity: 100, Used: 95})
+	require.Nil(t, err)
+	require.True(t, hb.Registered)
+
+	sites, err := s.ListSites(ctx, &pb.ListSitesRequest{})
+	require.Nil(t, err)
+	require.Len(t, sites.Sites, 2)
+
+	// a has no room left for 10 bytes
+	req := &pb.ScheduleRequest{Sites: []string{"a", "b", "c"}, FileInfo: `{"size": 10}`}
+	sched, err := s.Schedule(ctx, req)
+	require.Nil(t, err)
+	require.Equal(t, []string{"b", "c"}, sched.Sites)
+
+	// b misses its heartbeats
+	s.sites["b"].lastSeen = time.Now().Add(-3 * defaultHeartbeat)
+
+	sites, err = s.ListSites(ctx, &pb.ListSitesRequest{})
+	require.Nil(t, err)
+	require.Len(t, sites.Sites, 1)
+	require.Equal(t, "a", sites.Sites[0].Name)
+
+	sched, err = s.Schedule(ctx, &pb.ScheduleRequest{Sites: []string{"a", "b", "c"}})
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "c"}, sched.Sites)
+
+	hb, err = s.Heartbeat(ctx, &pb.SiteInfo{Name: "b"})
+	require.Nil(t, err)
+	require.False(t, hb.Registered)
+}
+
+func TestUsage(t *testing.T) {
+	s := newScheduler("usage")
+	s.highWater = 0.9
+	s.sites["a"] = &site{Name: "a", Capacity: 100, Used: 10}
+	s.sites["b"] = &site{Name: "b", Capacity: 100, Used: 85}
+
+	usageTests := []struct {
+		fileInfo string
+		usage    []*pb.SiteUsage
+		want     []string
+	}{
+		{want: []string{"a", "b", "c"}},
+		// b would go beyond 90 bytes
+		{fileInfo: `{"size": 10}`, want: []string{"a", "c"}},
+		{
+			usage: []*pb.SiteUsage{{Name: "a", Capacity: 100, Used: 95}},
+			want:  []string{"b", "c"},
+		},
+		// c is only known from the usage
+		{
+			fileInfo: `{"size": 10}`,
+			usage:    []*pb.SiteUsage{{Name: "c", Capacity: 50, Used: 45}},
+			want:     []string{"a"},
+		},
+	}
+
+	for _, test := range usageTests {
+		req := &pb.ScheduleRequest{
+			Sites:    []string{"a", "b", "c"},
+			FileInfo: test.fileInfo,
+			Usage:    test.usage,
+		}
+		resp, err := s.Schedule(context.Background(), req)
+		require.Nil(t, err, "Schedule(%v)", *req)
+		require.Equal(t, test.want, resp.Sites)
+	}
+
+	// The usage of a request is not kept.
+	require.Equal(t, int64(10), s.sites["a"].Used)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+const gb = 1 << 30
+
+// placement is the state of scheduling a single file.
+type placement struct {
+	// candidates are the sites with room for the file in order of
+	// preference.
+	candidates []*site
+	// size is the file size, -1 if unknown.
+	size int64
+	// n is the number of sites wanted, 0 if the strategy decides.
+	n int
+
+	sites   []string
+	reasons map[string]string
+}
+
+// choose places the file on the first n candidates, or on a single site
+// if no number was asked for.
+func (p *placement) choose(reason func(*site) string) error {
+	n := p.n
+	if n == 0 {
+		n = 1
+	}
+	if n > len(p.candidates) {
+		return fmt.Errorf("need %v sites, only %v available", n, len(p.candidates))
+	}
+
+	p.reasons = make(map[string]string)
+	for _, site := range p.candidates[:n] {
+		p.sites = append(p.sites, site.Name)
+		p.reasons[site.Name] = reason(site)
+	}
+
+	return nil
+}
+
+// rank sorts candidates by key, sites without info go last.
+func (p *placement) rank(known func(*site) bool, less func(a, b *site) bool) {
+	sort.SliceStable(p.candidates, func(i, j int) bool {
+		a, b := p.candidates[i], p.candidates[j]
+		if known(a) != known(b) {
+			return known(a)
+		}
+		return known(a) && less(a, b)
+	})
+}
+
+type strategy func(p *placement) error
+
+var strategies = map[string]strategy{
+	"":                replicateAll,
+	"replicate-all":   replicateAll,
+	"replicate-n":     replicateN,
+	"cheapest":        cheapest,
+	"lowest-latency":  lowestLatency,
+	"most-free-space": mostFreeSpace,
+}
+
+// replicateAll places the file on every candidate.
+func replicateAll(p *placement) error {
+	if p.n == 0 {
+		p.n = len(p.candidates)
+	}
+
+	return p.choose(func(*site) string {
+		return "replicate to all sites"
+	})
+}
+
+// replicateN places the file on the first n candidates in order of
+// preference.
+func replicateN(p *placement) error {
+	if p.n == 0 {
+		return fmt.Errorf("replicate-n needs the number of replicas")
+	}
+
+	return p.choose(func(*site) string {
+		return fmt.Sprintf("one of the first %v preferred sites", p.n)
+	})
+}
+
+// cheapest places the file on the sites with the lowest storage price.
+func cheapest(p *placement) error {
+	p.rank(
+		func(s *site) bool { return s.CostPerGB > 0 },
+		func(a, b *site) bool { return a.CostPerGB < b.CostPerGB },
+	)
+
+	return p.choose(func(s *site) string {
+		if s.CostPerGB == 0 {
+			return "no cost info"
+		}
+		if p.size < 0 {
+			return fmt.Sprintf("costs %.4f per GB", s.CostPerGB)
+		}
+		return fmt.Sprintf("costs %.4f per GB, %.4f for %v bytes", s.CostPerGB, s.CostPerGB*float64(p.size)/gb, p.size)
+	})
+}
+
+// lowestLatency places the file on the sites closest to the server.
+func lowestLatency(p *placement) error {
+	p.rank(
+		func(s *site) bool { return s.Latency > 0 },
+		func(a, b *site) bool { return a.Latency < b.Latency },
+	)
+
+	return p.choose(func(s *site) string {
+		if s.Latency == 0 {
+			return "no latency info"
+		}
+		return fmt.Sprintf("latency %vms", s.Latency)
+	})
+}
+
+// mostFreeSpace places the file on the sites with the most space left.
+func mostFreeSpace(p *placement) error {
+	p.rank(
+		func(s *site) bool { return s.Capacity > 0 },
+		func(a, b *site) bool { return a.Capacity-a.Used > b.Capacity-b.Used },
+	)
+
+	return p.choose(func(s *site) string {
+		if s.Capacity == 0 {
+			return "no capacity info"
+		}
+		return fmt.Sprintf("%v of %v bytes free", s.Capacity-s.Used, s.Capacity)
+	})
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errNotFound    = errors.New("object not found")
+	errInvalidName = errors.New("invalid object name")
+	errNoSuchPart  = errors.New("part not found")
+)
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Name         string
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+}
+
+// Listing is a page of listed objects.
+type Listing struct {
+	Objects []ObjectInfo
+	// Prefixes are the names up to and including the first slash after
+	// the listed prefix, of the objects rolled up.
+	Prefixes []string
+	// NextToken is "" on the last page.
+	NextToken string
+}
+
+// Object is the content of a stored object. Seeking does not read the
+// skipped bytes.
+type Object interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Backend stores objects by slash separated names. Methods return
+// errNotFound for objects that do not exist.
+type Backend interface {
+	// Put stores size bytes read from r as name, replacing the object if
+	// it exists. size is -1 if it is unknown, r is then read to the end.
+	Put(name string, r io.Reader, size int64, contentType string) (*ObjectInfo, error)
+	// Get opens name for reading.
+	Get(name string) (Object, *ObjectInfo, error)
+	Stat(name string) (*ObjectInfo, error)
+	// Delete removes name, removing an object that does not exist is not
+	// an error.
+	Delete(name string) error
+	// List returns a page of at most max objects whose names start with
+	// prefix, in order of name. Unless recursive, objects with a slash
+	// after prefix are rolled up into prefixes, which count towards max.
+	// token is the next token of the previous page, or "" for the first.
+	List(prefix, token string, max int, recursive bool) (*Listing, error)
+	Copy(src, dst string) (*ObjectInfo, error)
+}
+
+// multipartBackend is a Backend that assembles objects from parts uploaded
+// separately. Backends that are not are given stagedMultipart.
+type multipartBackend interface {
+	NewMultipart(name string) (string, error)
+	// PutPart stores part number of an upload and returns its etag.
+	PutPart(name, uploadID string, number int, r io.Reader, size int64) (string, error)
+	CompleteMultipart(name, uploadID string, parts []completedPart) (*ObjectInfo, error)
+	AbortMultipart(name, uploadID string) error
+}
+
+// newBackend creates the backend of given type from the flags.
+func newBackend(typ string) (Backend, error) {
+	switch typ {
+	case "minio":
+		return newMinioBackend(*endpoint, *accessKey, *secretKey, *useSSL, *bucket)
+	case "fs":
+		return newFSBackend(*dataDir)
+	case "memory":
+		return newMemoryBackend(), nil
+	default:
+		return nil, fmt.Errorf("unknown backend %v", typ)
+	}
+}
+
+// multipartOf returns the multipart uploads of b.
+func multipartOf(b Backend) multipartBackend {
+	if mb, ok := b.(multipartBackend); ok {
+		return mb
+	}
+
+	return &stagedMultipart{b}
+}
+
+// validName reports whether name is a clean relative path.
+func validName(name string) bool {
+	return name != "" && path.Clean("/"+name) == "/"+name
+}
+
+// page returns a page of at most max entries of names, which start with
+// prefix, for backends whose next token is the last entry of a page. Unless
+// recursive, names are rolled up as described in Backend.List, names that
+// end with a slash are taken as rolled up already.
+func page(names []string, prefix, token string, max int, recursive bool) (objects, prefixes []string, next string) {
+	sort.Strings(names)
+
+	objects, prefixes = []string{}, []string{}
+	last := ""
+	for _, name := range names {
+		entry := name
+		if !recursive {
+			if i := strings.Index(name[len(prefix):], "/"); i >= 0 {
+				entry = name[:len(prefix)+i+1]
+			}
+		}
+		// Names rolled up into the same prefix are next to each other.
+		if entry <= token || entry == last {
+			continue
+		}
+		if len(objects)+len(prefixes) == max {
+			return objects, prefixes, last
+		}
+
+		// Object names never end with a slash.
+		if strings.HasSuffix(entry, "/") {
+			prefixes = append(prefixes, entry)
+		} else {
+			objects = append(objects, name)
+		}
+		last = entry
+	}
+
+	return objects, prefixes, ""
+}
+
+// stagedMultipart keeps the parts of an upload as objects under
+// multipartPrefix and concatenates them on completion.
+type stagedMultipart struct {
+	Backend
+}
+
+// multipartPrefix holds the staged uploads, it is not a valid user.
+const multipartPrefix = ".multipart/"
+
+// uploadObject is the object recording the name of an upload.
+func uploadObject(uploadID string) string {
+	return multipartPrefix + uploadID + "/upload"
+}
+
+func partObject(uploadID string, number int) string {
+	return multipartPrefix + uploadID + "/" + strconv.Itoa(number)
+}
+
+func (s *stagedMultipart) NewMultipart(name string) (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(id)
+
+	_, err = s.Put(uploadObject(uploadID), strings.NewReader(name), int64(len(name)), "")
+	if err != nil {
+		return "", err
+	}
+
+	return uploadID, nil
+}
+
+// checkUpload returns errNotFound unless uploadID is an upload of name.
+func (s *stagedMultipart) checkUpload(name, uploadID string) error {
+	if uploadID == "" || strings.Contains(uploadID, "/") {
+		return errNotFound
+	}
+
+	obj, _, err := s.Get(uploadObject(uploadID))
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	owner, err := ioutil.ReadAll(obj)
+	if err != nil {
+		return err
+	}
+	if string(owner) != name {
+		return errNotFound
+	}
+
+	return nil
+}
+
+func (s *stagedMultipart) PutPart(name, uploadID string, number int, r io.Reader, size int64) (string, error) {
+	err := s.checkUpload(name, uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := s.Put(partObject(uploadID, number), r, size, "")
+	if err != nil {
+		return "", err
+	}
+
+	return info.ETag, nil
+}
+
+func (s *stagedMultipart) CompleteMultipart(name, uploadID string, parts []completedPart) (*ObjectInfo, error) {
+	err := s.checkUpload(name, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	for _, part := range parts {
+		info, err := s.Stat(partObject(uploadID, part.PartNumber))
+		if err == errNotFound || err == nil && strings.Trim(part.ETag, `"`) != info.ETag {
+			return nil, errNoSuchPart
+		}
+		if err != nil {
+			return nil, err
+		}
+		size += info.Size
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.concat(pw, uploadID, parts))
+	}()
+	info, err := s.Put(name, pr, size, "")
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return info, s.AbortMultipart(name, uploadID)
+}
+
+// concat writes the parts of an upload to w one after another.
+func (s *stagedMultipart) concat(w io.Writer, uploadID string, parts []completedPart) error {
+	for _, part := range parts {
+		obj, _, err := s.Get(partObject(uploadID, part.PartNumber))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, obj)
+		obj.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *stagedMultipart) AbortMultipart(name, uploadID string) error {
+	err := s.checkUpload(name, uploadID)
+	if err != nil {
+		return err
+	}
+
+	token := ""
+	for {
+		listing, err := s.List(multipartPrefix+uploadID+"/", token, maxListKeys, true)
+		if err != nil {
+			return err
+		}
+		for _, obj := range listing.Objects {
+			// The upload record goes last so that a failed abort can
+			// be retried.
+			if obj.Name == uploadObject(uploadID) {
+				continue
+			}
+			err = s.Delete(obj.Name)
+			if err != nil {
+				return err
+			}
+		}
+		if listing.NextToken == "" {
+			break
+		}
+		token = listing.NextToken
+	}
+
+	return s.Delete(uploadObject(uploadID))
+}
+
+// copyHashed copies size bytes from r to w, or up to the end if size is -1,
+// and returns the number of bytes copied and their MD5 as an etag.
+func copyHashed(w io.Writer, r io.Reader, size int64) (int64, string, error) {
+	h := md5.New()
+	w = io.MultiWriter(w, h)
+
+	var (
+		n   int64
+		err error
+	)
+	if size < 0 {
+		n, err = io.Copy(w, r)
+	} else {
+		n, err = io.CopyN(w, r, size)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil {
+		return n, "", err
+	}
+
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// backends creates one backend of each kind that needs no service.
+func backends(t *testing.T) (map[string]Backend, func()) {
+	dir, err := ioutil.TempDir("", "storage")
+	require.NoError(t, err)
+	fs, err := newFSBackend(dir)
+	require.NoError(t, err)
+
+	return map[string]Backend{
+		"memory": newMemoryBackend(),
+		"fs":     fs,
+	}, func() { os.RemoveAll(dir) }
+}
+
+func TestBackends(t *testing.T) {
+	all, cleanup := backends(t)
+	defer cleanup()
+
+	for name, b := range all {
+		t.Run(name, func(t *testing.T) {
+			testPutGet(t, b)
+			testCopyDelete(t, b)
+			testList(t, b)
+			testMultipart(t, multipartOf(b))
+		})
+	}
+}
+
+func testPutGet(t *testing.T, b Backend) {
+	info, err := b.Put("u/a.txt", strings.NewReader("hello"), 5, "text/plain")
+	require.NoError(t, err)
+	require.Equal(t, "u/a.txt", info.Name)
+	require.Equal(t, int64(5), info.Size)
+	require.Equal(t, "5d41402abc4b2a76b9719d911017c592", info.ETag)
+
+	// Unknown size reads to the end, replacing the object.
+	_, err = b.Put("u/a.txt", strings.NewReader("hello world"), -1, "text/plain")
+	require.NoError(t, err)
+
+	obj, info, err := b.Get("u/a.txt")
+	require.NoError(t, err)
+	_, err = obj.Seek(6, 0)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(obj)
+	require.NoError(t, err)
+	require.NoError(t, obj.Close())
+	require.Equal(t, "world", string(content))
+	require.Equal(t, int64(11), info.Size)
+	require.Equal(t, "text/plain", info.ContentType)
+
+	_, err = b.Put("u/short", strings.NewReader("abc"), 5, "")
+	require.Error(t, err)
+	_, err = b.Stat("u/short")
+	require.Equal(t, errNotFound, err)
+
+	_, err = b.Put("../escape", strings.NewReader("x"), 1, "")
+	require.Equal(t, errInvalidName, err)
+
+	_, _, err = b.Get("u/missing")
+	require.Equal(t, errNotFound, err)
+}
+
+func testCopyDelete(t *testing.T, b Backend) {
+	info, err := b.Copy("u/a.txt", "u/dir/b.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(11), info.Size)
+
+	stat, err := b.Stat("u/dir/b.txt")
+	require.NoError(t, err)
+	require.Equal(t, info.ETag, stat.ETag)
+
+	_, err = b.Copy("u/missing", "u/c.txt")
+	require.Equal(t, errNotFound, err)
+
+	require.NoError(t, b.Delete("u/dir/b.txt"))
+	require.NoError(t, b.Delete("u/dir/b.txt"))
+	_, err = b.Stat("u/dir/b.txt")
+	require.Equal(t, errNotFound, err)
+}
+
+func testList(t *testing.T, b Backend) {
+	// Walking the directories on disk lists v/a/b before v/a-b.
+	for _, name := range []string{"v/a-b", "v/a/b", "v/a/c/d", "v/b", "w/a"} {
+		_, err := b.Put(name, strings.NewReader(name), int64(len(name)), "")
+		require.NoError(t, err)
+	}
+
+	// listAll lists prefix two entries at a time.
+	listAll := func(prefix string, recursive bool) (objects, prefixes []string) {
+		token := ""
+		for {
+			listing, err := b.List(prefix, token, 2, recursive)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(listing.Objects)+len(listing.Prefixes), 2)
+			for _, obj := range listing.Objects {
+				objects = append(objects, obj.Name)
+			}
+			prefixes = append(prefixes, listing.Prefixes...)
+			if listing.NextToken == "" {
+				return objects, prefixes
+			}
+			token = listing.NextToken
+		}
+	}
+
+	objects, prefixes := listAll("v/", true)
+	require.Equal(t, []string{"v/a-b", "v/a/b", "v/a/c/d", "v/b"}, objects)
+	require.Empty(t, prefixes)
+
+	objects, prefixes = listAll("v/", false)
+	require.Equal(t, []string{"v/a-b", "v/b"}, objects)
+	require.Equal(t, []string{"v/a/"}, prefixes)
+
+	objects, prefixes = listAll("v/a", false)
+	require.Equal(t, []string{"v/a-b"}, objects)
+	require.Equal(t, []string{"v/a/"}, prefixes)
+
+	objects, prefixes = listAll("v/b/", true)
+	require.Empty(t, objects)
+	require.Empty(t, prefixes)
+
+	objects, prefixes = listAll("", false)
+	require.Empty(t, objects)
+	require.Contains(t, prefixes, "v/")
+	require.Contains(t, prefixes, "w/")
+
+	listing, err := b.List("v/a/", "", maxListKeys, true)
+	require.NoError(t, err)
+	require.Len(t, listing.Objects, 2)
+	require.Equal(t, int64(len("v/a/b")), listing.Objects[0].Size)
+
+	listing, err = b.List("../", "", maxListKeys, true)
+	require.NoError(t, err)
+	require.Empty(t, listing.Objects)
+}
+
+func testMultipart(t *testing.T, mb multipartBackend) {
+	id, err := mb.NewMultipart("u/big")
+	require.NoError(t, err)
+
+	var parts []completedPart
+	for i, content := range []string{"foo", "bar", "baz"} {
+		etag, err := mb.PutPart("u/big", id, i+1, strings.NewReader(content), int64(len(content)))
+		require.NoError(t, err)
+		parts = append(parts, completedPart{PartNumber: i + 1, ETag: etag})
+	}
+
+	_, err = mb.PutPart("u/other", id, 1, strings.NewReader("x"), 1)
+	require.Equal(t, errNotFound, err)
+	_, err = mb.CompleteMultipart("u/big", id, []completedPart{{PartNumber: 4, ETag: "x"}})
+	require.Equal(t, errNoSuchPart, err)
+
+	info, err := mb.CompleteMultipart("u/big", id, parts)
+	require.NoError(t, err)
+	require.Equal(t, int64(9), info.Size)
+
+	b := mb.(Backend)
+	obj, _, err := b.Get("u/big")
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(obj)
+	require.NoError(t, err)
+	obj.Close()
+	require.Equal(t, "foobarbaz", string(content))
+
+	// Nothing is left of the upload.
+	listing, err := b.List(multipartPrefix, "", maxListKeys, true)
+	require.NoError(t, err)
+	require.Empty(t, listing.Objects)
+	require.Equal(t, errNotFound, mb.AbortMultipart("u/big", id))
+}
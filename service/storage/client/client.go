@@ -2,7 +2,10 @@ package client
 
 import (
 	"io"
+	"mime/multipart"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 )
@@ -12,24 +15,62 @@ const (
 	uploadPath   = "/upload"
 	downloadPath = "/download"
 	deletePath   = "/delete"
+	statPath     = "/stat"
+	listPath     = "/list"
+	copyPath     = "/copy"
+	statsPath    = "/stats"
+
+	initMultipartPath     = "/multipart/init"
+	uploadPartPath        = "/multipart/part"
+	completeMultipartPath = "/multipart/complete"
+	abortMultipartPath    = "/multipart/abort"
 )
 
+// DefaultTimeout bounds the requests of a client without a Timeout of its
+// own.
+const DefaultTimeout = 30 * time.Second
+
+// CompletedPart is a part of a multipart upload to complete.
+type CompletedPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
 // StorageClient is a client of storage service.
 type StorageClient struct {
 	Name     string
 	Endpoint string
 	Username string
 	Password string
+	// Timeout bounds the requests that neither stream an object nor wait
+	// for the server to assemble one, DefaultTimeout if 0.
+	Timeout time.Duration
 }
 
 // NewStorageClient constructs a new storage client.
 func NewStorageClient(name, endpoint, username, password string) *StorageClient {
-	return &StorageClient{name, endpoint, username, password}
+	return &StorageClient{
+		Name:     name,
+		Endpoint: endpoint,
+		Username: username,
+		Password: password,
+	}
+}
+
+// timed returns a resty client whose requests time out after c.Timeout, so
+// that a hung server does not hold up the caller.
+func (c *StorageClient) timed() *resty.Client {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	return resty.New().SetTimeout(timeout)
 }
 
 // Ping pings storage server with basic auth.
 func (c *StorageClient) Ping() (*http.Response, error) {
-	client := resty.New()
+	client := c.timed()
 
 	resp, err := client.R().SetBasicAuth(c.Username, c.Password).Get(c.Endpoint + pingPath)
 	if err != nil {
@@ -39,15 +80,23 @@ func (c *StorageClient) Ping() (*http.Response, error) {
 	return resp.RawResponse, nil
 }
 
-// Upload uploads a file to storage server using given io.Reader.
-func (c *StorageClient) Upload(file io.Reader, filename string) (*http.Response, error) {
+// Upload streams a file to storage server using given io.Reader. The request
+// body is written while it is being sent, so the file is never buffered in
+// memory. size may be -1 if it is unknown.
+func (c *StorageClient) Upload(file io.Reader, filename string, size int64) (*http.Response, error) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	form := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUploadForm(form, file, filename, size))
+	}()
+
 	client := resty.New()
 
 	resp, err := client.R().
-		SetFileReader("file", filename, file).
-		SetFormData(map[string]string{
-			"filename": filename,
-		}).
+		SetBody(pr).
+		SetHeader("Content-Type", form.FormDataContentType()).
 		SetBasicAuth(c.Username, c.Password).
 		SetDoNotParseResponse(true).
 		Post(c.Endpoint + uploadPath)
@@ -58,15 +107,56 @@ func (c *StorageClient) Upload(file io.Reader, filename string) (*http.Response,
 	return resp.RawResponse, nil
 }
 
+// writeUploadForm writes the multipart form of an upload request. Fields
+// precede the file part so that the server knows them before the data.
+func writeUploadForm(form *multipart.Writer, file io.Reader, filename string, size int64) error {
+	err := form.WriteField("filename", filename)
+	if err != nil {
+		return err
+	}
+
+	err = form.WriteField("size", strconv.FormatInt(size, 10))
+	if err != nil {
+		return err
+	}
+
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(part, file)
+	if err != nil {
+		return err
+	}
+
+	return form.Close()
+}
+
 // Download downloads given filename from storage server.
 func (c *StorageClient) Download(filename string) (*http.Response, error) {
+	return c.DownloadRange(filename, 0, -1)
+}
+
+// DownloadRange downloads length bytes of given filename from offset, or up
+// to the end if length is -1. The response is 206 Partial Content unless the
+// whole file is requested.
+func (c *StorageClient) DownloadRange(filename string, offset, length int64) (*http.Response, error) {
 	client := resty.New()
 
-	resp, err := client.R().
+	req := client.R().
 		SetQueryParam("filename", filename).
 		SetBasicAuth(c.Username, c.Password).
-		SetDoNotParseResponse(true).
-		Get(c.Endpoint + downloadPath)
+		SetDoNotParseResponse(true)
+	if offset > 0 || length >= 0 {
+		end := ""
+		if length >= 0 {
+			end = strconv.FormatInt(offset+length-1, 10)
+		}
+		req.SetHeader("Range", "bytes="+strconv.FormatInt(offset, 10)+"-"+end)
+	}
+
+	resp, err := req.Get(c.Endpoint + downloadPath)
 	if err != nil {
 		return nil, err
 	}
@@ -76,7 +166,7 @@ func (c *StorageClient) Download(filename string) (*http.Response, error) {
 
 // Delete deletes given filename from storage server.
 func (c *StorageClient) Delete(filename string) (*http.Response, error) {
-	client := resty.New()
+	client := c.timed()
 
 	resp, err := client.R().
 		SetQueryParam("filename", filename).
@@ -89,3 +179,162 @@ func (c *StorageClient) Delete(filename string) (*http.Response, error) {
 
 	return resp.RawResponse, nil
 }
+
+// Stat returns the info of given filename, the response is 404 Not Found if
+// it does not exist.
+func (c *StorageClient) Stat(filename string) (*http.Response, error) {
+	client := c.timed()
+
+	resp, err := client.R().
+		SetQueryParam("filename", filename).
+		SetBasicAuth(c.Username, c.Password).
+		SetDoNotParseResponse(true).
+		Get(c.Endpoint + statPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.RawResponse, nil
+}
+
+// List lists a page of at most max objects whose names start with prefix.
+// token is the next_token of the previous page, or "" for the first page.
+// Unless recursive, objects with a slash after prefix are rolled up into
+// the prefixes of the response.
+func (c *StorageClient) List(prefix, token string, max int, recursive bool) (*http.Response, error) {
+	client := c.timed()
+
+	resp, err := client.R().
+		SetQueryParams(map[string]string{
+			"prefix":    prefix,
+			"token":     token,
+			"max":       strconv.Itoa(max),
+			"recursive": strconv.FormatBool(recursive),
+		}).
+		SetBasicAuth(c.Username, c.Password).
+		SetDoNotParseResponse(true).
+		Get(c.Endpoint + listPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.RawResponse, nil
+}
+
+// Stats returns the capacity and usage of storage server, and the usage of
+// each user of this account.
+func (c *StorageClient) Stats() (*http.Response, error) {
+	client := c.timed()
+
+	resp, err := client.R().
+		SetBasicAuth(c.Username, c.Password).
+		SetDoNotParseResponse(true).
+		Get(c.Endpoint + statsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.RawResponse, nil
+}
+
+// Copy copies filename to dest on storage server.
+func (c *StorageClient) Copy(filename, dest string) (*http.Response, error) {
+	client := resty.New()
+
+	resp, err := client.R().
+		SetQueryParams(map[string]string{
+			"filename": filename,
+			"dest":     dest,
+		}).
+		SetBasicAuth(c.Username, c.Password).
+		SetDoNotParseResponse(true).
+		Post(c.Endpoint + copyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.RawResponse, nil
+}
+
+// InitMultipart starts a multipart upload of filename, the response holds
+// the upload id.
+func (c *StorageClient) InitMultipart(filename string) (*http.Response, error) {
+	client := c.timed()
+
+	resp, err := client.R().
+		SetQueryParam("filename", filename).
+		SetBasicAuth(c.Username, c.Password).
+		SetDoNotParseResponse(true).
+		Post(c.Endpoint + initMultipartPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.RawResponse, nil
+}
+
+// UploadPart streams a part of size bytes of a multipart upload, the
+// response holds the etag of the part.
+func (c *StorageClient) UploadPart(part io.Reader, filename, uploadID string, number int, size int64) (*http.Response, error) {
+	client := resty.New()
+	// The storage server needs the size of a part up front.
+	client.SetPreRequestHook(func(_ *resty.Client, req *http.Request) error {
+		req.ContentLength = size
+		return nil
+	})
+
+	resp, err := client.R().
+		SetBody(part).
+		SetQueryParams(map[string]string{
+			"filename":    filename,
+			"upload_id":   uploadID,
+			"part_number": strconv.Itoa(number),
+		}).
+		SetBasicAuth(c.Username, c.Password).
+		SetDoNotParseResponse(true).
+		Put(c.Endpoint + uploadPartPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.RawResponse, nil
+}
+
+// CompleteMultipart assembles the given parts of a multipart upload.
+func (c *StorageClient) CompleteMultipart(filename, uploadID string, parts []CompletedPart) (*http.Response, error) {
+	client := resty.New()
+
+	resp, err := client.R().
+		SetBody(parts).
+		SetQueryParams(map[string]string{
+			"filename":  filename,
+			"upload_id": uploadID,
+		}).
+		SetBasicAuth(c.Username, c.Password).
+		SetDoNotParseResponse(true).
+		Post(c.Endpoint + completeMultipartPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.RawResponse, nil
+}
+
+// AbortMultipart aborts a multipart upload and drops its parts.
+func (c *StorageClient) AbortMultipart(filename, uploadID string) (*http.Response, error) {
+	client := c.timed()
+
+	resp, err := client.R().
+		SetQueryParams(map[string]string{
+			"filename":  filename,
+			"upload_id": uploadID,
+		}).
+		SetBasicAuth(c.Username, c.Password).
+		SetDoNotParseResponse(true).
+		Delete(c.Endpoint + abortMultipartPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.RawResponse, nil
+}
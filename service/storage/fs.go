@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Directories under the root of a fsBackend.
+const (
+	fsObjects = "objects"
+	fsMeta    = "meta"
+	fsTmp     = "tmp"
+)
+
+// fsBackend keeps objects as files in a directory. The file of an object is
+// at its name under objects/, the metadata beside it under meta/. Files are
+// written under tmp/ and renamed into place, so readers never see a partial
+// object.
+type fsBackend struct {
+	root string
+}
+
+// fsMetadata is what is kept of an object besides its content.
+type fsMetadata struct {
+	ETag        string `json:"etag"`
+	ContentType string `json:"content_type"`
+}
+
+func newFSBackend(root string) (*fsBackend, error) {
+	for _, dir := range []string{fsObjects, fsMeta, fsTmp} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &fsBackend{root: root}, nil
+}
+
+// path returns the path of name under dir.
+func (b *fsBackend) path(dir, name string) string {
+	return filepath.Join(b.root, dir, filepath.FromSlash(name))
+}
+
+func (b *fsBackend) Put(name string, r io.Reader, size int64, contentType string) (*ObjectInfo, error) {
+	if !validName(name) {
+		return nil, errInvalidName
+	}
+
+	data, err := ioutil.TempFile(filepath.Join(b.root, fsTmp), "object-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(data.Name())
+	_, etag, err := copyHashed(data, r, size)
+	if err == nil {
+		err = data.Sync()
+	}
+	if cerr := data.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := json.Marshal(fsMetadata{ETag: etag, ContentType: contentType})
+	if err != nil {
+		return nil, err
+	}
+	err = b.place(fsMeta, name, meta)
+	if err != nil {
+		return nil, err
+	}
+	err = b.rename(data.Name(), b.path(fsObjects, name))
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Stat(name)
+}
+
+// place writes content to the file of name under dir.
+func (b *fsBackend) place(dir, name string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Join(b.root, fsTmp), "meta-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return b.rename(f.Name(), b.path(dir, name))
+}
+
+// rename moves a file to p, creating the directories on the way.
+func (b *fsBackend) rename(from, p string) error {
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(from, p)
+}
+
+func (b *fsBackend) Get(name string) (Object, *ObjectInfo, error) {
+	info, err := b.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(b.path(fsObjects, name))
+	if os.IsNotExist(err) {
+		return nil, nil, errNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f, info, nil
+}
+
+func (b *fsBackend) Stat(name string) (*ObjectInfo, error) {
+	if !validName(name) {
+		return nil, errNotFound
+	}
+
+	fi, err := os.Stat(b.path(fsObjects, name))
+	if os.IsNotExist(err) || err == nil && fi.IsDir() {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := b.metadata(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Name:         name,
+		Size:         fi.Size(),
+		ETag:         meta.ETag,
+		ContentType:  meta.ContentType,
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+// metadata reads the metadata of name. Files put in place by hand have
+// none, their etag is computed.
+func (b *fsBackend) metadata(name string) (*fsMetadata, error) {
+	var meta fsMetadata
+	content, err := ioutil.ReadFile(b.path(fsMeta, name))
+	if err == nil {
+		err = json.Unmarshal(content, &meta)
+		return &meta, err
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.Open(b.path(fsObjects, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := md5.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	meta.ETag = hex.EncodeToString(h.Sum(nil))
+
+	return &meta, nil
+}
+
+func (b *fsBackend) Delete(name string) error {
+	if !validName(name) {
+		return nil
+	}
+
+	for _, dir := range []string{fsObjects, fsMeta} {
+		err := os.Remove(b.path(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		b.prune(dir, path.Dir(name))
+	}
+
+	return nil
+}
+
+// prune removes the empty directories from dir up under the given root
+// directory.
+func (b *fsBackend) prune(root, dir string) {
+	for ; dir != "."; dir = path.Dir(dir) {
+		if os.Remove(b.path(root, dir)) != nil {
+			return
+		}
+	}
+}
+
+// List pages by name, the next token is the last entry of a page. Only the
+// directory holding prefix is walked, and not the directories rolled up. The
+// walk goes in the order of names, skipping the directories before token, and
+// stops once the page is full.
+func (b *fsBackend) List(prefix, token string, max int, recursive bool) (*Listing, error) {
+	listing := &Listing{Objects: []ObjectInfo{}, Prefixes: []string{}}
+	dir := path.Dir(prefix + "x")
+	if dir != "." && !validName(dir) {
+		return listing, nil
+	}
+	fi, err := os.Stat(b.path(fsObjects, dir))
+	if os.IsNotExist(err) || err == nil && !fi.IsDir() {
+		return listing, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// One entry past max tells whether there is a next page.
+	names := []string{}
+	var walk func(dir string) (bool, error)
+	walk = func(dir string) (bool, error) {
+		infos, err := ioutil.ReadDir(b.path(fsObjects, dir))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		// A directory sorts as its name with a slash, which is where the
+		// names below it are.
+		keys := make([]string, 0, len(infos))
+		for _, fi := range infos {
+			key := path.Join(dir, fi.Name())
+			if dir == "." {
+				key = fi.Name()
+			}
+			if fi.IsDir() {
+				key += "/"
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if len(names) > max {
+				return true, nil
+			}
+			if !strings.HasSuffix(key, "/") {
+				if strings.HasPrefix(key, prefix) && key > token {
+					names = append(names, key)
+				}
+				continue
+			}
+
+			// Skip directories outside prefix and those whose names all
+			// come before token.
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+				continue
+			}
+			if key <= token && !strings.HasPrefix(token, key) {
+				continue
+			}
+			// A directory below prefix rolls up into a prefix as a whole.
+			if !recursive && len(key) > len(prefix) && strings.HasPrefix(key, prefix) {
+				if key > token {
+					names = append(names, key)
+				}
+				continue
+			}
+
+			done, err := walk(strings.TrimSuffix(key, "/"))
+			if done || err != nil {
+				return done, err
+			}
+		}
+		return false, nil
+	}
+	_, err = walk(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names, listing.Prefixes, listing.NextToken = page(names, prefix, token, max, recursive)
+	for _, name := range names {
+		info, err := b.Stat(name)
+		if err == errNotFound {
+			// Deleted while listing.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		listing.Objects = append(listing.Objects, *info)
+	}
+
+	return listing, nil
+}
+
+func (b *fsBackend) Copy(src, dst string) (*ObjectInfo, error) {
+	obj, info, err := b.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	return b.Put(dst, obj, info.Size, info.ContentType)
+}
@@ -5,8 +5,10 @@ import (
 	"flag"
 	"io/ioutil"
 
+	pb "github.com/Sean-Pearce/jcs/service/scheduler/proto"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -16,16 +18,37 @@ const (
 var (
 	configFile = flag.String("config", "storage.json", "config file")
 	port       = flag.String("port", ":5002", "port number")
+	backend    = flag.String("backend", "minio", "storage backend, one of minio, fs and memory")
+	dataDir    = flag.String("dir", "data", "directory objects are kept in by the fs backend")
+	bucket     = flag.String("bucket", "jcs", "bucket objects are kept in by the minio backend")
 	endpoint   = flag.String("endpoint", "127.0.0.1:9000", "minio endpoint")
 	accessKey  = flag.String("ak", "", "access key")
 	secretKey  = flag.String("sk", "", "secret key")
 	useSSL     = flag.Bool("ssl", false, "minio use ssl")
 	debug      = flag.Bool("debug", false, "debug mode")
+	schedAddr  = flag.String("sched", "", "scheduler address, registration is disabled if empty")
+	siteName   = flag.String("name", "", "site name to register with")
+	advertise  = flag.String("advertise", "", "endpoint httpserver reaches this node at, e.g. http://storage-bj:5002")
+	region     = flag.String("region", "", "region of the site")
+	capacity   = flag.Int64("capacity", 0, "capacity of the site in bytes, 0 if unlimited")
 )
 
 func main() {
+	flag.Parse()
+
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
 	log.Infoln("Starting storage", version)
 
+	var err error
+	store, err = newBackend(*backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uploads = multipartOf(store)
+
 	config, err := ioutil.ReadFile(*configFile)
 	if err != nil {
 		panic(err)
@@ -36,13 +59,39 @@ func main() {
 		panic(err)
 	}
 
+	if *schedAddr != "" {
+		if *siteName == "" || *advertise == "" {
+			log.Fatal("-name and -advertise are required to register with the scheduler")
+		}
+
+		conn, err := grpc.Dial(*schedAddr, grpc.WithInsecure())
+		if err != nil {
+			panic(err)
+		}
+		go keepRegistered(pb.NewSchedulerClient(conn))
+	}
+
+	r := newRouter(accounts)
+	r.Run(*port)
+}
+
+// newRouter routes the requests of given accounts.
+func newRouter(accounts map[string]string) *gin.Engine {
 	r := gin.Default()
 
 	authorized := r.Group("/", gin.BasicAuth(accounts))
 	authorized.GET("/ping", ping)
 	authorized.POST("/upload", upload)
 	authorized.GET("/download", download)
+	authorized.GET("/stat", stat)
+	authorized.GET("/list", list)
+	authorized.GET("/stats", getStats)
+	authorized.POST("/copy", copyObject)
 	authorized.DELETE("/delete", deleteFile)
+	authorized.POST("/multipart/init", initMultipart)
+	authorized.PUT("/multipart/part", uploadPart)
+	authorized.POST("/multipart/complete", completeMultipart)
+	authorized.DELETE("/multipart/abort", abortMultipart)
 
-	r.Run(*port)
+	return r
 }
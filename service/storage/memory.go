@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryBackend keeps objects in memory, it is meant for tests.
+type memoryBackend struct {
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+}
+
+type memoryObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+// memoryReader is the content of an object kept in memory.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{objects: make(map[string]*memoryObject)}
+}
+
+func (b *memoryBackend) Put(name string, r io.Reader, size int64, contentType string) (*ObjectInfo, error) {
+	if !validName(name) {
+		return nil, errInvalidName
+	}
+
+	var buf bytes.Buffer
+	n, etag, err := copyHashed(&buf, r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &memoryObject{
+		data: buf.Bytes(),
+		info: ObjectInfo{
+			Name:         name,
+			Size:         n,
+			ETag:         etag,
+			ContentType:  contentType,
+			LastModified: time.Now(),
+		},
+	}
+	b.mu.Lock()
+	b.objects[name] = obj
+	b.mu.Unlock()
+
+	info := obj.info
+	return &info, nil
+}
+
+func (b *memoryBackend) Get(name string) (Object, *ObjectInfo, error) {
+	b.mu.RLock()
+	obj, ok := b.objects[name]
+	b.mu.RUnlock()
+	if !ok {
+		return nil, nil, errNotFound
+	}
+
+	// Objects are replaced rather than modified, the data stays as is.
+	info := obj.info
+	return memoryReader{bytes.NewReader(obj.data)}, &info, nil
+}
+
+func (b *memoryBackend) Stat(name string) (*ObjectInfo, error) {
+	b.mu.RLock()
+	obj, ok := b.objects[name]
+	b.mu.RUnlock()
+	if !ok {
+		return nil, errNotFound
+	}
+
+	info := obj.info
+	return &info, nil
+}
+
+func (b *memoryBackend) Delete(name string) error {
+	b.mu.Lock()
+	delete(b.objects, name)
+	b.mu.Unlock()
+
+	return nil
+}
+
+// List pages by name, the next token is the last entry of a page.
+func (b *memoryBackend) List(prefix, token string, max int, recursive bool) (*Listing, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	names := []string{}
+	for name := range b.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	names, prefixes, next := page(names, prefix, token, max, recursive)
+	listing := &Listing{
+		Objects:   make([]ObjectInfo, len(names)),
+		Prefixes:  prefixes,
+		NextToken: next,
+	}
+	for i, name := range names {
+		listing.Objects[i] = b.objects[name].info
+	}
+
+	return listing, nil
+}
+
+func (b *memoryBackend) Copy(src, dst string) (*ObjectInfo, error) {
+	if !validName(dst) {
+		return nil, errInvalidName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj, ok := b.objects[src]
+	if !ok {
+		return nil, errNotFound
+	}
+	copied := &memoryObject{data: obj.data, info: obj.info}
+	copied.info.Name = dst
+	copied.info.LastModified = time.Now()
+	b.objects[dst] = copied
+
+	info := copied.info
+	return &info, nil
+}
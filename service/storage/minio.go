@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io"
+
+	"github.com/minio/minio-go/v6"
+	log "github.com/sirupsen/logrus"
+)
+
+// minioBackend keeps objects in a bucket of minio or any other s3 service.
+type minioBackend struct {
+	client *minio.Client
+	bucket string
+}
+
+func newMinioBackend(endpoint, accessKey, secretKey string, useSSL bool, bucket string) (*minioBackend, error) {
+	client, err := minio.New(endpoint, accessKey, secretKey, useSSL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ensure that the bucket exists
+	location := "us-east-1"
+	err = client.MakeBucket(bucket, location)
+	if err != nil {
+		// Check to see if we already own this bucket (which happens if you run this twice)
+		exists, errBucketExists := client.BucketExists(bucket)
+		if errBucketExists != nil || !exists {
+			return nil, err
+		}
+		log.Infof("We already own %s\n", bucket)
+	} else {
+		log.Infof("Successfully created %s\n", bucket)
+	}
+
+	return &minioBackend{client: client, bucket: bucket}, nil
+}
+
+func (b *minioBackend) core() minio.Core {
+	return minio.Core{Client: b.client}
+}
+
+// minioError returns errNotFound for the errors minio returns for objects
+// that do not exist.
+func minioError(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return errNotFound
+	}
+
+	return err
+}
+
+func minioInfo(info minio.ObjectInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Name:         info.Key,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+	}
+}
+
+func (b *minioBackend) Put(name string, r io.Reader, size int64, contentType string) (*ObjectInfo, error) {
+	opts := minio.PutObjectOptions{ContentType: contentType}
+	if size < 0 {
+		// minio sizes parts for a 5TiB object when size is unknown, which
+		// means buffering several hundred MiB per upload.
+		opts.PartSize = streamPartSize
+	}
+
+	_, err := b.client.PutObject(b.bucket, name, r, size, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Stat(name)
+}
+
+func (b *minioBackend) Get(name string) (Object, *ObjectInfo, error) {
+	info, err := b.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The object fetches what is read with ranged requests.
+	obj, err := b.client.GetObject(b.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, minioError(err)
+	}
+
+	return obj, info, nil
+}
+
+func (b *minioBackend) Stat(name string) (*ObjectInfo, error) {
+	info, err := b.client.StatObject(b.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, minioError(err)
+	}
+
+	return minioInfo(info), nil
+}
+
+func (b *minioBackend) Delete(name string) error {
+	return b.client.RemoveObject(b.bucket, name)
+}
+
+// List pages with the continuation tokens of minio.
+func (b *minioBackend) List(prefix, token string, max int, recursive bool) (*Listing, error) {
+	delimiter := "/"
+	if recursive {
+		delimiter = ""
+	}
+	result, err := b.core().ListObjectsV2(b.bucket, prefix, token, false, delimiter, max, "")
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &Listing{
+		Objects:   make([]ObjectInfo, len(result.Contents)),
+		Prefixes:  make([]string, len(result.CommonPrefixes)),
+		NextToken: result.NextContinuationToken,
+	}
+	for i, obj := range result.Contents {
+		listing.Objects[i] = *minioInfo(obj)
+	}
+	for i, p := range result.CommonPrefixes {
+		listing.Prefixes[i] = p.Prefix
+	}
+
+	return listing, nil
+}
+
+func (b *minioBackend) Copy(src, dst string) (*ObjectInfo, error) {
+	_, err := b.core().CopyObject(b.bucket, src, b.bucket, dst, nil)
+	if err != nil {
+		return nil, minioError(err)
+	}
+
+	return b.Stat(dst)
+}
+
+func (b *minioBackend) NewMultipart(name string) (string, error) {
+	return b.core().NewMultipartUpload(b.bucket, name, minio.PutObjectOptions{})
+}
+
+func (b *minioBackend) PutPart(name, uploadID string, number int, r io.Reader, size int64) (string, error) {
+	part, err := b.core().PutObjectPart(b.bucket, name, uploadID, number, r, size, "", "", nil)
+	if err != nil {
+		return "", err
+	}
+
+	return part.ETag, nil
+}
+
+func (b *minioBackend) CompleteMultipart(name, uploadID string, parts []completedPart) (*ObjectInfo, error) {
+	completed := make([]minio.CompletePart, len(parts))
+	for i, part := range parts {
+		completed[i] = minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag}
+	}
+
+	_, err := b.core().CompleteMultipartUpload(b.bucket, name, uploadID, completed)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Stat(name)
+}
+
+func (b *minioBackend) AbortMultipart(name, uploadID string) error {
+	return b.core().AbortMultipartUpload(b.bucket, name, uploadID)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/md5"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxPartNumber is the largest part number s3 accepts.
+const maxPartNumber = 10000
+
+// completedPart is a part listed when completing a multipart upload.
+type completedPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// multipartObject returns the object name of a multipart request, it writes
+// the error response if the filename is invalid.
+func multipartObject(c *gin.Context) (string, bool) {
+	user, _, _ := c.Request.BasicAuth()
+	filename := c.Query("filename")
+	if !validateFilename(filename) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid filename",
+		})
+		return "", false
+	}
+
+	return path.Join(user, filename), true
+}
+
+func initMultipart(c *gin.Context) {
+	objName, ok := multipartObject(c)
+	if !ok {
+		return
+	}
+
+	uploadID, err := uploads.NewMultipart(objName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "init multipart upload error",
+		})
+		log.WithError(err).Errorf("init multipart upload of %v error", objName)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"upload_id": uploadID,
+	})
+}
+
+func uploadPart(c *gin.Context) {
+	objName, ok := multipartObject(c)
+	if !ok {
+		return
+	}
+
+	uploadID := c.Query("upload_id")
+	number, err := strconv.Atoi(c.Query("part_number"))
+	if uploadID == "" || err != nil || number < 1 || number > maxPartNumber {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid upload id or part number",
+		})
+		return
+	}
+	// Backends need the size of a part.
+	if c.Request.ContentLength < 0 {
+		c.JSON(http.StatusLengthRequired, gin.H{
+			"error": "content length required",
+		})
+		return
+	}
+
+	h := md5.New()
+	body := io.TeeReader(c.Request.Body, h)
+	etag, err := uploads.PutPart(objName, uploadID, number, body, c.Request.ContentLength)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "upload part error",
+		})
+		log.WithError(err).Errorf("upload part %v of %v error", number, objName)
+		return
+	}
+	if sum := h.Sum(nil); !etagMatches(etag, sum) {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "checksum mismatch",
+		})
+		log.Errorf("part %v of %v has etag %v, md5 is %x", number, objName, etag, sum)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"etag": etag,
+		"size": c.Request.ContentLength,
+	})
+}
+
+func completeMultipart(c *gin.Context) {
+	objName, ok := multipartObject(c)
+	if !ok {
+		return
+	}
+
+	var parts []completedPart
+	err := c.ShouldBindJSON(&parts)
+	uploadID := c.Query("upload_id")
+	if err != nil || uploadID == "" || len(parts) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid upload id or parts",
+		})
+		return
+	}
+
+	objInfo, err := uploads.CompleteMultipart(objName, uploadID, parts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "complete multipart upload error",
+		})
+		log.WithError(err).Errorf("complete multipart upload of %v error", objName)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"created": c.Query("filename"),
+		"size":    objInfo.Size,
+	})
+}
+
+func abortMultipart(c *gin.Context) {
+	objName, ok := multipartObject(c)
+	if !ok {
+		return
+	}
+
+	err := uploads.AbortMultipart(objName, c.Query("upload_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "abort multipart upload error",
+		})
+		log.WithError(err).Errorf("abort multipart upload of %v error", objName)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/Sean-Pearce/jcs/service/scheduler/proto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// retryInterval is the interval between registration attempts.
+	retryInterval = 5 * time.Second
+	rpcTimeout    = 5 * time.Second
+)
+
+// keepRegistered registers this node with the scheduler and keeps sending
+// heartbeats, registering again whenever the scheduler has forgotten it.
+func keepRegistered(s pb.SchedulerClient) {
+	registered := false
+	interval := retryInterval
+	for {
+		info, err := siteInfo()
+		if err != nil {
+			log.WithError(err).Errorln("collect site info failed")
+		} else if !registered {
+			ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+			resp, err := s.RegisterSite(ctx, info)
+			cancel()
+			if err != nil {
+				log.WithError(err).Warnln("register with scheduler failed")
+			} else {
+				log.Infof("registered with scheduler as %v", info.Name)
+				registered = true
+				interval = time.Duration(resp.HeartbeatInterval) * time.Second
+			}
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+			resp, err := s.Heartbeat(ctx, info)
+			cancel()
+			if err != nil {
+				log.WithError(err).Warnln("heartbeat failed")
+			} else if !resp.Registered {
+				registered = false
+				interval = retryInterval
+				continue
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// siteInfo describes this node.
+func siteInfo() (*pb.SiteInfo, error) {
+	stats, err := currentStats()
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.SiteInfo{
+		Name:     *siteName,
+		Endpoint: *advertise,
+		Region:   *region,
+		Capacity: *capacity,
+		Used:     stats.Used,
+	}, nil
+}
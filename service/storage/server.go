@@ -1,48 +1,33 @@
 package main
 
 import (
-	"flag"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"path"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/minio/minio-go/v6"
 	log "github.com/sirupsen/logrus"
 )
 
-var minioClient *minio.Client
-
-const bucketName = "jcs"
-
-func init() {
-	flag.Parse()
-
-	if *debug {
-		log.SetLevel(log.DebugLevel)
-	}
-
-	// Initialize minio client
-	var err error
-	minioClient, err = minio.New(*endpoint, *accessKey, *secretKey, *useSSL)
-	if err != nil {
-		log.Fatal(err)
-	}
+var (
+	store   Backend
+	uploads multipartBackend
+)
 
-	// Ensure that bucket 'jcs' exists
-	location := "us-east-1"
-	err = minioClient.MakeBucket(bucketName, location)
-	if err != nil {
-		// Check to see if we already own this bucket (which happens if you run this twice)
-		exists, errBucketExists := minioClient.BucketExists(bucketName)
-		if errBucketExists == nil && exists {
-			log.Infof("We already own %s\n", bucketName)
-		} else {
-			log.Fatal(err)
-		}
-	} else {
-		log.Infof("Successfully created %s\n", bucketName)
-	}
-}
+const (
+	// streamPartSize is the multipart part size used for uploads of unknown size.
+	streamPartSize = 64 << 20
+	// maxFormValueSize limits the size of non-file form fields.
+	maxFormValueSize = 4096
+	// maxListKeys is the largest page of objects listed at once.
+	maxListKeys = 1000
+)
 
 func ping(c *gin.Context) {
 	user, _, _ := c.Request.BasicAuth()
@@ -52,27 +37,64 @@ func ping(c *gin.Context) {
 }
 
 func upload(c *gin.Context) {
-	file, err := c.FormFile("file")
+	reader, err := c.Request.MultipartReader()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "file not found",
+			"error": "multipart form expected",
 		})
-		log.WithError(err).Debug("file not found")
+		log.WithError(err).Debug("multipart form expected")
 		return
 	}
 
-	body, err := file.Open()
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "open file error",
-		})
-		log.WithError(err).Debug("open file error")
-		return
+	// Fields come before the file part, the file part itself is streamed
+	// into the backend without being staged.
+	var (
+		filename string
+		size     int64 = -1
+	)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "read form error",
+			})
+			log.WithError(err).Debug("read form error")
+			return
+		}
+
+		switch part.FormName() {
+		case "filename":
+			filename, err = readFormValue(part)
+		case "size":
+			var value string
+			value, err = readFormValue(part)
+			if err == nil {
+				size, err = strconv.ParseInt(value, 10, 64)
+			}
+		case "file":
+			putObject(c, part, filename, size)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid form value",
+			})
+			log.WithError(err).Debugf("invalid form value %v", part.FormName())
+			return
+		}
 	}
-	defer body.Close()
 
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": "file not found",
+	})
+	log.Debug("file not found")
+}
+
+func putObject(c *gin.Context, part *multipart.Part, filename string, size int64) {
 	user, _, _ := c.Request.BasicAuth()
-	filename := c.PostForm("filename")
 	if !validateFilename(filename) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "invalid filename",
@@ -82,7 +104,14 @@ func upload(c *gin.Context) {
 	}
 	objName := path.Join(user, filename)
 
-	_, err = minioClient.PutObject(bucketName, objName, body, file.Size, minio.PutObjectOptions{ContentType: c.ContentType()})
+	h := md5.New()
+	info, err := store.Put(objName, io.TeeReader(part, h), size, part.Header.Get("Content-Type"))
+	if err == errInvalidName {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid filename",
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "upload file error",
@@ -91,11 +120,35 @@ func upload(c *gin.Context) {
 		return
 	}
 
+	sum := h.Sum(nil)
+	if !etagMatches(info.ETag, sum) {
+		store.Delete(objName)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "checksum mismatch",
+		})
+		log.Errorf("object %v has etag %v, md5 is %x", objName, info.ETag, sum)
+		return
+	}
+
 	c.JSON(http.StatusCreated, gin.H{
-		"created": file.Filename,
+		"created": filename,
+		"size":    info.Size,
+		"md5":     hex.EncodeToString(sum),
 	})
 }
 
+// etagMatches reports whether the ETag the backend returns for an object or
+// part matches the MD5 of the content sent. The ETag of an object uploaded in
+// parts is not the MD5 of the content, it matches anything.
+func etagMatches(etag string, sum []byte) bool {
+	etag = strings.Trim(etag, `"`)
+	if strings.Contains(etag, "-") {
+		return true
+	}
+
+	return etag == hex.EncodeToString(sum)
+}
+
 func download(c *gin.Context) {
 	user, _, _ := c.Request.BasicAuth()
 	filename := c.Query("filename")
@@ -107,7 +160,54 @@ func download(c *gin.Context) {
 	}
 	objName := path.Join(user, filename)
 
-	objInfo, err := minioClient.StatObject(bucketName, objName, minio.StatObjectOptions{})
+	// Objects are read as they are served, so seeking to serve a range
+	// does not read the skipped bytes.
+	obj, objInfo, err := store.Get(objName)
+	if err == errNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "object not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "get object error",
+		})
+		log.WithError(err).Errorf("get object %v error", objName)
+		return
+	}
+	defer obj.Close()
+
+	contentType := objInfo.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", "attachment; filename="+objName)
+	c.Header("ETag", `"`+objInfo.ETag+`"`)
+
+	// ServeContent answers Range, If-None-Match and If-Modified-Since.
+	http.ServeContent(c.Writer, c.Request, objName, objInfo.LastModified, obj)
+}
+
+func stat(c *gin.Context) {
+	user, _, _ := c.Request.BasicAuth()
+	filename := c.Query("filename")
+	if !validateFilename(filename) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid filename",
+		})
+		return
+	}
+	objName := path.Join(user, filename)
+
+	objInfo, err := store.Stat(objName)
+	if err == errNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "object not found",
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "stat object error",
@@ -116,17 +216,113 @@ func download(c *gin.Context) {
 		return
 	}
 
-	obj, err := minioClient.GetObject(bucketName, objName, minio.GetObjectOptions{})
+	c.JSON(http.StatusOK, gin.H{
+		"size":          objInfo.Size,
+		"etag":          objInfo.ETag,
+		"content_type":  objInfo.ContentType,
+		"last_modified": objInfo.LastModified.Unix(),
+	})
+}
+
+// list lists the objects whose names start with prefix, a page of at most
+// max entries at a time. The next page starts at the returned next_token.
+// Listing is recursive unless recursive=false, objects with a slash after
+// prefix are then rolled up into prefixes like directories.
+func list(c *gin.Context) {
+	user, _, _ := c.Request.BasicAuth()
+	max, err := strconv.Atoi(c.DefaultQuery("max", strconv.Itoa(maxListKeys)))
+	if err != nil || max < 1 || max > maxListKeys {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid max",
+		})
+		return
+	}
+	recursive, err := strconv.ParseBool(c.DefaultQuery("recursive", "true"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid recursive",
+		})
+		return
+	}
+	// The user's own objects are under user/, prefix is relative to it.
+	root := user + "/"
+	prefix := c.Query("prefix")
+	if !validatePrefix(prefix) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid prefix",
+		})
+		return
+	}
+
+	listing, err := store.List(root+prefix, c.Query("token"), max, recursive)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "get object error",
+			"error": "list objects error",
 		})
-		log.WithError(err).Errorf("get object %v error", objName)
+		log.WithError(err).Errorf("list objects of %v error", user)
 		return
 	}
 
-	c.DataFromReader(http.StatusOK, objInfo.Size, objInfo.ContentType, obj, map[string]string{
-		"Content-Disposition": "attachment; filename=" + objName,
+	objects := make([]gin.H, len(listing.Objects))
+	for i, obj := range listing.Objects {
+		objects[i] = gin.H{
+			"name":          strings.TrimPrefix(obj.Name, root),
+			"size":          obj.Size,
+			"etag":          obj.ETag,
+			"content_type":  obj.ContentType,
+			"last_modified": obj.LastModified.Unix(),
+		}
+	}
+	prefixes := make([]string, len(listing.Prefixes))
+	for i, p := range listing.Prefixes {
+		prefixes[i] = strings.TrimPrefix(p, root)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"objects":    objects,
+		"prefixes":   prefixes,
+		"next_token": listing.NextToken,
+	})
+}
+
+// copyObject copies filename to dest on the server side.
+func copyObject(c *gin.Context) {
+	user, _, _ := c.Request.BasicAuth()
+	filename := c.Query("filename")
+	dest := c.Query("dest")
+	if !validateFilename(filename) || !validateFilename(dest) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid filename",
+		})
+		return
+	}
+	objName := path.Join(user, filename)
+	destName := path.Join(user, dest)
+
+	objInfo, err := store.Copy(objName, destName)
+	if err == errInvalidName {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid filename",
+		})
+		return
+	}
+	if err == errNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "object not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "copy object error",
+		})
+		log.WithError(err).Errorf("copy object %v to %v error", objName, destName)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"created": dest,
+		"size":    objInfo.Size,
 	})
 }
 
@@ -142,7 +338,7 @@ func deleteFile(c *gin.Context) {
 	}
 	objName := path.Join(user, filename)
 
-	err := minioClient.RemoveObject(bucketName, objName)
+	err := store.Delete(objName)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "remove object error",
@@ -154,7 +350,32 @@ func deleteFile(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{})
 }
 
+func readFormValue(part *multipart.Part) (string, error) {
+	value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueSize))
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+// validateFilename reports whether filename is a clean name relative to the
+// account, so that joined to the user it stays within the user's objects.
 func validateFilename(filename string) bool {
-	// TODO: use regexp to validate
-	return filename != ""
+	return validName(filename)
+}
+
+// validatePrefix reports whether a listing prefix stays within the user's
+// objects. Prefixes need not be whole names, they only must not climb up.
+func validatePrefix(prefix string) bool {
+	if strings.HasPrefix(prefix, "/") {
+		return false
+	}
+	for _, segment := range strings.Split(prefix, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+
+	return true
 }
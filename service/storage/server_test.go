@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Sean-Pearce/jcs/service/storage/client"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store = newMemoryBackend()
+	uploads = multipartOf(store)
+	server := httptest.NewServer(newRouter(map[string]string{"u": "p"}))
+	defer server.Close()
+	c := client.NewStorageClient("test", server.URL, "u", "p")
+
+	resp, err := c.Upload(strings.NewReader("hello world"), "a.txt", 11)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = c.DownloadRange("a.txt", 6, 5)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, "world", string(content))
+
+	resp, err = c.Copy("a.txt", "b.txt")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = c.List("", "", 1, true)
+	require.NoError(t, err)
+	var page struct {
+		Objects []struct {
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+		} `json:"objects"`
+		NextToken string `json:"next_token"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+	resp.Body.Close()
+	require.Len(t, page.Objects, 1)
+	require.Equal(t, "a.txt", page.Objects[0].Name)
+	require.NotEmpty(t, page.NextToken)
+
+	resp, err = c.Stat("a.txt")
+	require.NoError(t, err)
+	var info struct {
+		Size        int64  `json:"size"`
+		ContentType string `json:"content_type"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	resp.Body.Close()
+	require.Equal(t, int64(11), info.Size)
+	require.Equal(t, "application/octet-stream", info.ContentType)
+
+	resp, err = c.Delete("a.txt")
+	require.NoError(t, err)
+	resp.Body.Close()
+	resp, err = c.Stat("a.txt")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Objects belong to the account they are put with.
+	_, err = store.Stat("u/b.txt")
+	require.NoError(t, err)
+
+	resp, err = c.Upload(strings.NewReader("hi"), "alice/c.txt", 2)
+	require.NoError(t, err)
+	resp.Body.Close()
+	resp, err = c.Stats()
+	require.NoError(t, err)
+	var stats struct {
+		Used    int64                 `json:"used"`
+		Objects int64                 `json:"objects"`
+		Users   map[string]usageStats `json:"users"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	resp.Body.Close()
+	require.Equal(t, int64(13), stats.Used)
+	require.Equal(t, int64(2), stats.Objects)
+	require.Equal(t, usageStats{Used: 2, Objects: 1}, stats.Users["alice"])
+	require.Equal(t, usageStats{Used: 11, Objects: 1}, stats.Users[""])
+
+	// Names are relative to the account and cannot climb out of it.
+	for _, name := range []string{"../alice/c.txt", "/alice/c.txt", "x/../../alice/c.txt", "./b.txt", ""} {
+		resp, err = c.Upload(strings.NewReader("hi"), name, 2)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+
+		resp, err = c.Download(name)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+
+		resp, err = c.Stat(name)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+
+		resp, err = c.Copy("b.txt", name)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+
+		resp, err = c.Delete(name)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+	}
+	for _, prefix := range []string{"../", "../alice/", "/alice", "x/../../"} {
+		resp, err = c.List(prefix, "", 10, true)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, prefix)
+	}
+	_, err = store.Stat("u/alice/c.txt")
+	require.NoError(t, err)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// statsMaxAge is how long collected stats are served before they are
+// collected again, collecting lists all objects.
+const statsMaxAge = 10 * time.Second
+
+// usageStats is how much is stored.
+type usageStats struct {
+	Used    int64 `json:"used"`
+	Objects int64 `json:"objects"`
+}
+
+func (u *usageStats) add(size int64) {
+	u.Used += size
+	u.Objects++
+}
+
+// nodeStats is the usage of this node.
+type nodeStats struct {
+	usageStats
+	// users holds the usage of each account by the first element of the
+	// object names under it, which is the user of httpserver.
+	users     map[string]map[string]*usageStats
+	collected time.Time
+}
+
+var statsCache struct {
+	mu    sync.Mutex
+	stats *nodeStats
+}
+
+// currentStats returns the stats of this node, collected at most
+// statsMaxAge ago.
+func currentStats() (*nodeStats, error) {
+	statsCache.mu.Lock()
+	defer statsCache.mu.Unlock()
+
+	if statsCache.stats != nil && time.Since(statsCache.stats.collected) < statsMaxAge {
+		return statsCache.stats, nil
+	}
+
+	stats, err := collectStats()
+	if err != nil {
+		return nil, err
+	}
+	statsCache.stats = stats
+
+	return stats, nil
+}
+
+// collectStats lists all objects to sum up their sizes.
+func collectStats() (*nodeStats, error) {
+	stats := &nodeStats{
+		users:     make(map[string]map[string]*usageStats),
+		collected: time.Now(),
+	}
+
+	token := ""
+	for {
+		listing, err := store.List("", token, maxListKeys, true)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range listing.Objects {
+			stats.add(obj.Size)
+
+			// Staged multipart uploads belong to no account.
+			if strings.HasPrefix(obj.Name, multipartPrefix) {
+				continue
+			}
+			elems := strings.SplitN(obj.Name, "/", 3)
+			user := ""
+			if len(elems) == 3 {
+				user = elems[1]
+			}
+			users, ok := stats.users[elems[0]]
+			if !ok {
+				users = make(map[string]*usageStats)
+				stats.users[elems[0]] = users
+			}
+			if users[user] == nil {
+				users[user] = &usageStats{}
+			}
+			users[user].add(obj.Size)
+		}
+
+		if listing.NextToken == "" {
+			return stats, nil
+		}
+		token = listing.NextToken
+	}
+}
+
+// getStats reports the capacity and usage of this node, and the usage of
+// the users of the calling account. Objects right under the account are
+// reported as of user "".
+func getStats(c *gin.Context) {
+	account, _, _ := c.Request.BasicAuth()
+
+	stats, err := currentStats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "collect stats error",
+		})
+		log.WithError(err).Error("collect stats error")
+		return
+	}
+
+	users := stats.users[account]
+	if users == nil {
+		users = map[string]*usageStats{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"name":      *siteName,
+		"region":    *region,
+		"capacity":  *capacity,
+		"used":      stats.Used,
+		"objects":   stats.Objects,
+		"users":     users,
+		"collected": stats.collected.Unix(),
+	})
+}